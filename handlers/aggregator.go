@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"ssat_backend_rebuild/models"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 后台聚合任务：上传时只将设备入队，由固定数量的 worker 计算统计数据。
+// 同一设备总是分配给同一个 worker，保证同一设备的聚合按顺序执行
+type Aggregator struct {
+	Data       *DataHandler
+	Workers    int           // worker 数量
+	QueueSize  int           // 每个 worker 的队列长度
+	MaxRetries int           // 失败后的最大重试次数
+	RetryDelay time.Duration // 首次重试的等待时间，之后每次翻倍
+
+	queues []chan aggregateTask
+	queued sync.Map // 已在队列中或等待重试的设备及其 flushBefore，避免重复入队
+}
+
+// 聚合任务，attempt 为已重试的次数
+type aggregateTask struct {
+	deviceID    string
+	flushBefore int64 // 不为 0 时同时聚合早于该时间戳的剩余数据，不受 MongoToSQLThreshold 限制
+	attempt     int
+}
+
+func NewAggregator(data *DataHandler, workers, queueSize, maxRetries int) *Aggregator {
+	if workers <= 0 {
+		workers = 4
+	}
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	a := &Aggregator{
+		Data:       data,
+		Workers:    workers,
+		QueueSize:  queueSize,
+		MaxRetries: maxRetries,
+		RetryDelay: time.Second,
+		queues:     make([]chan aggregateTask, workers),
+	}
+	for i := range a.queues {
+		a.queues[i] = make(chan aggregateTask, queueSize)
+	}
+	return a
+}
+
+// 启动全部 worker
+func (a *Aggregator) Start() {
+	for _, queue := range a.queues {
+		go a.work(queue)
+	}
+}
+
+// 将设备加入聚合队列，flushBefore 不为 0 时补充聚合早于该时间戳的数据。
+// 队列已满时丢弃，设备下次上传或补充聚合时会重新入队
+func (a *Aggregator) Enqueue(device *models.Device, flushBefore int64) bool {
+	if a.mark(device.DeviceID, flushBefore) {
+		return true
+	}
+	return a.push(aggregateTask{deviceID: device.DeviceID, flushBefore: flushBefore})
+}
+
+// 标记设备待聚合，返回设备是否已在队列中。已在队列中时保留较晚的 flushBefore，由出队时合并到任务中
+func (a *Aggregator) mark(deviceID string, flushBefore int64) bool {
+	for {
+		old, loaded := a.queued.LoadOrStore(deviceID, flushBefore)
+		if !loaded {
+			return false
+		}
+		if old.(int64) >= flushBefore || a.queued.CompareAndSwap(deviceID, old, flushBefore) {
+			return true
+		}
+	}
+}
+
+// 将任务放入设备对应 worker 的队列，调用前需已标记设备
+func (a *Aggregator) push(task aggregateTask) bool {
+	h := fnv.New32a()
+	h.Write([]byte(task.deviceID))
+	select {
+	case a.queues[h.Sum32()%uint32(len(a.queues))] <- task:
+		return true
+	default:
+		a.queued.Delete(task.deviceID)
+		log.Printf("聚合队列已满，设备%s本次未入队", task.deviceID)
+		return false
+	}
+}
+
+func (a *Aggregator) work(queue chan aggregateTask) {
+	for task := range queue {
+		// 先移出标记，执行期间到达的数据会让设备重新入队
+		if flushBefore, ok := a.queued.LoadAndDelete(task.deviceID); ok {
+			task.flushBefore = max(task.flushBefore, flushBefore.(int64))
+		}
+		a.process(task)
+	}
+}
+
+// 聚合一个设备的未处理数据，失败时按指数退避定时重新入队，不占用 worker
+func (a *Aggregator) process(task aggregateTask) {
+	device := &models.Device{}
+	if err := a.Data.DB.First(device, "device_id = ?", task.deviceID).Error; err != nil {
+		log.Printf("聚合任务找不到设备%s: %v", task.deviceID, err)
+		return
+	}
+
+	start := time.Now()
+	var batches, readings int
+	var err error
+	if task.flushBefore != 0 {
+		batches, readings, err = a.Data.flushDevice(context.Background(), device, task.flushBefore)
+	} else {
+		batches, readings, err = a.Data.aggregatePending(context.Background(), device)
+	}
+
+	progress := map[string]any{"last_run_at": start}
+	if batches > 0 {
+		progress["batches"] = gorm.Expr("batches + ?", batches)
+		progress["readings"] = gorm.Expr("readings + ?", readings)
+	}
+	if err == nil {
+		progress["last_success_at"] = time.Now()
+		progress["failures"] = 0
+		progress["last_error"] = ""
+		a.updateProgress(device, progress)
+		return
+	}
+
+	progress["failures"] = gorm.Expr("failures + 1")
+	progress["last_error"] = err.Error()
+	a.updateProgress(device, progress)
+	if task.attempt >= a.MaxRetries {
+		log.Printf("设备%s聚合失败，已重试%d次: %v", task.deviceID, task.attempt, err)
+		return
+	}
+	// 等待期间设备保持标记，新上传的数据由这次重试一并处理；设备已重新入队时无需重试
+	if a.mark(task.deviceID, task.flushBefore) {
+		return
+	}
+	retry := aggregateTask{deviceID: task.deviceID, flushBefore: task.flushBefore, attempt: task.attempt + 1}
+	time.AfterFunc(a.RetryDelay<<task.attempt, func() { a.push(retry) })
+}
+
+// 记录聚合进度，记录不存在时创建
+func (a *Aggregator) updateProgress(device *models.Device, values map[string]any) {
+	progress := &models.AggregationProgress{}
+	db := a.Data.DB
+	if err := db.Where(models.AggregationProgress{DeviceUUID: device.UUID}).FirstOrCreate(progress).Error; err != nil {
+		log.Printf("记录设备%s的聚合进度失败: %v", device.DeviceID, err)
+		return
+	}
+	if err := db.Model(progress).Updates(values).Error; err != nil {
+		log.Printf("记录设备%s的聚合进度失败: %v", device.DeviceID, err)
+	}
+}
+
+type AggregationProgressHandler struct {
+	BaseHandler[models.AggregationProgress]
+}
+
+// 查看各设备的聚合进度，可按设备或连续失败筛选
+func (h *AggregationProgressHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			if deviceUUID := c.Query("device_uuid"); deviceUUID != "" {
+				query = query.Where("device_uuid = ?", deviceUUID)
+			}
+			if c.Query("failing") == "true" {
+				query = query.Where("failures > 0")
+			}
+			return query
+		},
+	)(c)
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"ssat_backend_rebuild/models"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 某项污染物的分指数分段浓度限值，浓度使用指标注册表中的单位
+type AQIBreakpoints struct {
+	Metric         string
+	Unit           string    // 浓度限值的单位，与指标注册表中的单位不一致时不参与计算
+	Concentrations []float64 // 与 AQITable.Index 一一对应，可以少于 Index 的段数
+}
+
+// 空气质量指数的类别
+type AQICategory struct {
+	Max   int    // 该类别指数的上限（含）
+	Level int    // 级别
+	Name  string // 类别名称
+}
+
+// 空气质量指数分段表
+type AQITable struct {
+	Name       string
+	Index      []float64        // 各分段的指数
+	Hourly     []AQIBreakpoints // 小时及更短时间的平均浓度使用的限值
+	Daily      []AQIBreakpoints // 日平均浓度使用的限值，为空时使用 Hourly
+	Categories []AQICategory    // 按 Max 升序
+	Threshold  int              // 指数超过该值时才有首要污染物
+}
+
+// 空气质量指数计算结果
+type AQIResult struct {
+	Table      string         `json:"table"`
+	AQI        int            `json:"aqi"`
+	Level      int            `json:"level"`
+	Category   string         `json:"category"`
+	Primary    []string       `json:"primary_pollutants"` // 首要污染物，指数未超过阈值时为空
+	SubIndices map[string]int `json:"sub_indices"`        // 各污染物的分指数
+}
+
+// HJ 633-2012《环境空气质量指数（AQI）技术规定》。小时数据使用 1 小时平均浓度限值（颗粒物使用 24 小时限值），
+// 日数据使用 24 小时平均浓度限值，臭氧使用 8 小时滑动平均限值近似
+var HJ633 = AQITable{
+	Name:  "hj633",
+	Index: []float64{0, 50, 100, 150, 200, 300, 400, 500},
+	Hourly: []AQIBreakpoints{
+		{Metric: "so2", Unit: "mg/m³", Concentrations: []float64{0, 0.15, 0.5, 0.65, 0.8}},
+		{Metric: "nitro_dio", Unit: "mg/m³", Concentrations: []float64{0, 0.1, 0.2, 0.7, 1.2, 2.34, 3.09, 3.84}},
+		{Metric: "carb_momo", Unit: "mg/m³", Concentrations: []float64{0, 5, 10, 35, 60, 90, 120, 150}},
+		{Metric: "ozone", Unit: "mg/m³", Concentrations: []float64{0, 0.16, 0.2, 0.3, 0.4, 0.8, 1.0, 1.2}},
+		{Metric: "pm10", Unit: "μg/m³", Concentrations: []float64{0, 50, 150, 250, 350, 420, 500, 600}},
+		{Metric: "pm2_5", Unit: "μg/m³", Concentrations: []float64{0, 35, 75, 115, 150, 250, 350, 500}},
+	},
+	Daily: []AQIBreakpoints{
+		{Metric: "so2", Unit: "mg/m³", Concentrations: []float64{0, 0.05, 0.15, 0.475, 0.8, 1.6, 2.1, 2.62}},
+		{Metric: "nitro_dio", Unit: "mg/m³", Concentrations: []float64{0, 0.04, 0.08, 0.18, 0.28, 0.565, 0.75, 0.94}},
+		{Metric: "carb_momo", Unit: "mg/m³", Concentrations: []float64{0, 2, 4, 14, 24, 36, 48, 60}},
+		{Metric: "ozone", Unit: "mg/m³", Concentrations: []float64{0, 0.1, 0.16, 0.215, 0.265, 0.8}},
+		{Metric: "pm10", Unit: "μg/m³", Concentrations: []float64{0, 50, 150, 250, 350, 420, 500, 600}},
+		{Metric: "pm2_5", Unit: "μg/m³", Concentrations: []float64{0, 35, 75, 115, 150, 250, 350, 500}},
+	},
+	Categories: []AQICategory{
+		{Max: 50, Level: 1, Name: "优"},
+		{Max: 100, Level: 2, Name: "良"},
+		{Max: 150, Level: 3, Name: "轻度污染"},
+		{Max: 200, Level: 4, Name: "中度污染"},
+		{Max: 300, Level: 5, Name: "重度污染"},
+		{Max: math.MaxInt, Level: 6, Name: "严重污染"},
+	},
+	Threshold: 50,
+}
+
+// 已注册的分段表及当前使用的分段表
+var aqiTables = struct {
+	sync.RWMutex
+	tables  map[string]*AQITable
+	current string
+}{tables: map[string]*AQITable{"hj633": &HJ633}, current: "hj633"}
+
+// 注册新的分段表
+func RegisterAQITable(table *AQITable) {
+	aqiTables.Lock()
+	defer aqiTables.Unlock()
+	aqiTables.tables[table.Name] = table
+}
+
+// 选择计算空气质量指数使用的分段表，为空时使用 HJ 633
+func SetAQITable(name string) error {
+	if name == "" {
+		name = HJ633.Name
+	}
+	aqiTables.Lock()
+	defer aqiTables.Unlock()
+	if _, ok := aqiTables.tables[name]; !ok {
+		return fmt.Errorf("未知的空气质量指数分段表：%s", name)
+	}
+	aqiTables.current = name
+	return nil
+}
+
+func currentAQITable() *AQITable {
+	aqiTables.RLock()
+	defer aqiTables.RUnlock()
+	return aqiTables.tables[aqiTables.current]
+}
+
+// 按分段线性插值计算分指数并向上取整，超过最高限值时取最高分段的指数
+func (t *AQITable) subIndex(bp AQIBreakpoints, value float64) int {
+	c := bp.Concentrations
+	top := min(len(c), len(t.Index)) - 1
+	if value >= c[top] {
+		return int(t.Index[top])
+	}
+	i := sort.SearchFloat64s(c[:top+1], value)
+	if i == 0 {
+		return 0
+	}
+	iaqi := (t.Index[i]-t.Index[i-1])/(c[i]-c[i-1])*(value-c[i-1]) + t.Index[i-1]
+	return int(math.Ceil(iaqi))
+}
+
+// 读数按十进制的最短表示转换，避免 0.8 等限值上的读数因 float32 误差落入下一分段
+func decimalValue(value float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	return v
+}
+
+// 1 小时限值未覆盖全部分段且浓度超过最高限值时改用 24 小时限值。
+// HJ 633 规定二氧化硫 1 小时平均浓度高于 800 μg/m³ 时按 24 小时平均浓度计算分指数
+func (t *AQITable) fallback(bp AQIBreakpoints, value float64, daily bool) AQIBreakpoints {
+	c := bp.Concentrations
+	if daily || len(c) >= len(t.Index) || value <= c[len(c)-1] {
+		return bp
+	}
+	for _, d := range t.Daily {
+		if d.Metric == bp.Metric && d.Unit == bp.Unit && len(d.Concentrations) >= 2 {
+			return d
+		}
+	}
+	return bp
+}
+
+// 计算空气质量指数，daily 表示数据为日平均值。没有可计算的污染物时返回 nil
+func (t *AQITable) Compute(entry models.DataEntry, daily bool) *AQIResult {
+	breakpoints := t.Hourly
+	if daily && len(t.Daily) > 0 {
+		breakpoints = t.Daily
+	}
+	result := &AQIResult{Table: t.Name, Primary: []string{}, SubIndices: make(map[string]int)}
+	for _, bp := range breakpoints {
+		value, ok := entry.Get(bp.Metric)
+		if !ok || len(bp.Concentrations) < 2 {
+			continue
+		}
+		if metric, registered := LookupMetric(bp.Metric); registered && metric.Unit != bp.Unit {
+			continue
+		}
+		concentration := decimalValue(value)
+		result.SubIndices[bp.Metric] = t.subIndex(t.fallback(bp, concentration, daily), math.Max(concentration, 0))
+	}
+	if len(result.SubIndices) == 0 {
+		return nil
+	}
+
+	for _, iaqi := range result.SubIndices {
+		result.AQI = max(result.AQI, iaqi)
+	}
+	if result.AQI > t.Threshold {
+		for metric, iaqi := range result.SubIndices {
+			if iaqi == result.AQI {
+				result.Primary = append(result.Primary, metric)
+			}
+		}
+		sort.Strings(result.Primary)
+	}
+	for _, category := range t.Categories {
+		if result.AQI <= category.Max {
+			result.Level, result.Category = category.Level, category.Name
+			break
+		}
+	}
+	return result
+}
+
+// 按当前分段表计算一条读数的空气质量指数
+func computeAQI(entry models.DataEntry) *AQIResult {
+	return currentAQITable().Compute(entry, false)
+}
+
+// 写入统计数据的空气质量指数，天统计数据按日平均值计算
+func applyAQI(data *models.Data) {
+	result := currentAQITable().Compute(data.Avg, data.Resolution == models.ResolutionDay)
+	if result == nil {
+		data.AQI, data.AQILevel, data.AQICategory, data.PrimaryPollutant = nil, 0, "", ""
+		return
+	}
+	data.AQI = &result.AQI
+	data.AQILevel, data.AQICategory = result.Level, result.Category
+	data.PrimaryPollutant = strings.Join(result.Primary, ",")
+}
+
+// 数据中某项指标的值，metric 为 aqi 时返回空气质量指数
+func metricValue(entry models.DataEntry, metric string, daily bool) (float32, bool) {
+	if metric != "aqi" {
+		return entry.Get(metric)
+	}
+	result := currentAQITable().Compute(entry, daily)
+	if result == nil {
+		return 0, false
+	}
+	return float32(result.AQI), true
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"ssat_backend_rebuild/models"
+	"testing"
+)
+
+func TestHourlySO2AboveLimitUsesDailyBreakpoints(t *testing.T) {
+	for _, tc := range []struct {
+		so2  float32
+		want int
+	}{
+		{0.5, 100},
+		{0.8, 200},
+		// 超过 1 小时最高限值后按 24 小时限值计算，不再停留在 200
+		{1.6, 300},
+		{2.62, 500},
+	} {
+		entry := models.EmptyDataEntry()
+		entry.Set("so2", tc.so2)
+		result := HJ633.Compute(entry, false)
+		if result == nil {
+			t.Fatalf("so2 %v: no result", tc.so2)
+		}
+		if got := result.SubIndices["so2"]; got != tc.want {
+			t.Errorf("so2 %v: sub-index %d, want %d", tc.so2, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"ssat_backend_rebuild/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm/clause"
+)
+
+// 已认领但未完成的批次超过该时长后才由其他聚合接手，避免接手仍在认领中的批次
+const batchClaimLease = 2 * time.Minute
+
+// 按条数聚合使用的存储操作，默认由 MongoDB 和 SQL 数据库实现
+type batchStore interface {
+	// 认领时间早于 claimedBefore 且仍有未处理读数的批次
+	StalledBatches(ctx context.Context, deviceID string, claimedBefore time.Time) ([]string, error)
+	// 未认领的读数条数，before 不为 0 时只统计早于该时间戳的读数
+	CountUnclaimed(ctx context.Context, deviceID string, before int64) (int64, error)
+	// 按时间顺序认领最早的至多 limit 条未认领读数，limit 为 0 时不限
+	ClaimOldest(ctx context.Context, deviceID string, before int64, limit int, token string, now time.Time) error
+	// 批次中的全部读数，包括已处理的
+	BatchReadings(ctx context.Context, token string) ([]MongoData, error)
+	CountBatch(ctx context.Context, token string) (int64, error)
+	MarkProcessed(ctx context.Context, ids []primitive.ObjectID) error
+	// 写入统计数据，已存在时按新的结果覆盖
+	SaveStats(data *models.Data) error
+}
+
+func (h *DataHandler) batches() batchStore {
+	if h.batchStore != nil {
+		return h.batchStore
+	}
+	return mongoBatchStore{h}
+}
+
+type mongoBatchStore struct {
+	h *DataHandler
+}
+
+// 未完成批次的筛选条件，没有认领时间的旧数据视为已超时
+func stalledBatchFilter(deviceID string, claimedBefore time.Time) bson.M {
+	return bson.M{
+		"device_id": deviceID,
+		"processed": false,
+		"batch_id":  bson.M{"$exists": true},
+		"$or": bson.A{
+			bson.M{"claimed_at": bson.M{"$exists": false}},
+			bson.M{"claimed_at": bson.M{"$lt": claimedBefore.Unix()}},
+		},
+	}
+}
+
+func unclaimedFilter(deviceID string, before int64) bson.M {
+	filter := bson.M{"device_id": deviceID, "processed": false, "batch_id": bson.M{"$exists": false}}
+	if before != 0 {
+		filter["timestamp"] = bson.M{"$lt": before}
+	}
+	return filter
+}
+
+func (s mongoBatchStore) StalledBatches(ctx context.Context, deviceID string, claimedBefore time.Time) ([]string, error) {
+	values, err := s.h.MongoCollection.Distinct(ctx, "batch_id", stalledBatchFilter(deviceID, claimedBefore))
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]string, 0, len(values))
+	for _, value := range values {
+		if token, ok := value.(string); ok {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (s mongoBatchStore) CountUnclaimed(ctx context.Context, deviceID string, before int64) (int64, error) {
+	return s.h.MongoCollection.CountDocuments(ctx, unclaimedFilter(deviceID, before))
+}
+
+// 认领时只修改仍未被认领的文档，并发的聚合不会认领到同一条数据
+func (s mongoBatchStore) ClaimOldest(ctx context.Context, deviceID string, before int64, limit int, token string, now time.Time) error {
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"_id": 1})
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+	cursor, err := s.h.MongoCollection.Find(ctx, unclaimedFilter(deviceID, before), findOptions)
+	if err != nil {
+		return err
+	}
+	var docs []MongoData
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+	ids := make([]primitive.ObjectID, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+
+	claim := bson.M{"_id": bson.M{"$in": ids}, "batch_id": bson.M{"$exists": false}}
+	_, err = s.h.MongoCollection.UpdateMany(ctx, claim, bson.M{"$set": bson.M{"batch_id": token, "claimed_at": now.Unix()}})
+	return err
+}
+
+func (s mongoBatchStore) BatchReadings(ctx context.Context, token string) ([]MongoData, error) {
+	cursor, err := s.h.MongoCollection.Find(ctx, bson.M{"batch_id": token})
+	if err != nil {
+		return nil, err
+	}
+	var readings []MongoData
+	err = cursor.All(ctx, &readings)
+	return readings, err
+}
+
+func (s mongoBatchStore) CountBatch(ctx context.Context, token string) (int64, error) {
+	return s.h.MongoCollection.CountDocuments(ctx, bson.M{"batch_id": token})
+}
+
+func (s mongoBatchStore) MarkProcessed(ctx context.Context, ids []primitive.ObjectID) error {
+	_, err := s.h.MongoCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"processed": true}})
+	return err
+}
+
+func (s mongoBatchStore) SaveStats(data *models.Data) error {
+	return s.h.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(data).Error
+}
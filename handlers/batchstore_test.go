@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"ssat_backend_rebuild/models"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 内存中的批次存储。认领与 MongoDB 的 UpdateMany 一样逐条生效，可以观察到认领到一半的批次
+type memBatchStore struct {
+	mu         sync.Mutex
+	readings   []*MongoData
+	stats      map[uuid.UUID]models.Data
+	afterClaim func(claimed int) // 每认领一条读数后调用一次，调用后清空
+}
+
+func newMemBatchStore() *memBatchStore {
+	return &memBatchStore{stats: make(map[uuid.UUID]models.Data)}
+}
+
+func (s *memBatchStore) insert(deviceID string, timestamp int64) {
+	entry := models.EmptyDataEntry()
+	entry.Set("temperature", float32(timestamp%40))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readings = append(s.readings, &MongoData{ID: primitive.NewObjectID(), DeviceID: deviceID, Timestamp: timestamp, Data: entry})
+}
+
+func (s *memBatchStore) StalledBatches(ctx context.Context, deviceID string, claimedBefore time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, r := range s.readings {
+		if r.DeviceID == deviceID && !r.Processed && r.BatchID != "" && r.ClaimedAt < claimedBefore.Unix() && !seen[r.BatchID] {
+			seen[r.BatchID] = true
+			tokens = append(tokens, r.BatchID)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *memBatchStore) unclaimed(deviceID string, before int64) []*MongoData {
+	var result []*MongoData
+	for _, r := range s.readings {
+		if r.DeviceID == deviceID && !r.Processed && r.BatchID == "" && (before == 0 || r.Timestamp < before) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func (s *memBatchStore) CountUnclaimed(ctx context.Context, deviceID string, before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.unclaimed(deviceID, before))), nil
+}
+
+func (s *memBatchStore) ClaimOldest(ctx context.Context, deviceID string, before int64, limit int, token string, now time.Time) error {
+	s.mu.Lock()
+	candidates := s.unclaimed(deviceID, before)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Timestamp < candidates[j].Timestamp })
+	if limit > 0 && len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	s.mu.Unlock()
+
+	for i, r := range candidates {
+		s.mu.Lock()
+		if r.BatchID == "" {
+			r.BatchID, r.ClaimedAt = token, now.Unix()
+		}
+		hook := s.afterClaim
+		s.afterClaim = nil
+		s.mu.Unlock()
+		if hook != nil {
+			hook(i + 1)
+		}
+		runtime.Gosched()
+	}
+	return nil
+}
+
+func (s *memBatchStore) BatchReadings(ctx context.Context, token string) ([]MongoData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []MongoData
+	for _, r := range s.readings {
+		if r.BatchID == token {
+			result = append(result, *r)
+		}
+	}
+	return result, nil
+}
+
+func (s *memBatchStore) CountBatch(ctx context.Context, token string) (int64, error) {
+	readings, err := s.BatchReadings(ctx, token)
+	return int64(len(readings)), err
+}
+
+func (s *memBatchStore) MarkProcessed(ctx context.Context, ids []primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	marked := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		marked[id] = true
+	}
+	for _, r := range s.readings {
+		if marked[r.ID] {
+			r.Processed = true
+		}
+	}
+	return nil
+}
+
+func (s *memBatchStore) SaveStats(data *models.Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats[data.UUID] = *data
+	return nil
+}
+
+// 每条已处理的读数都恰好计入一条统计数据，统计数据的条数与批次一致
+func (s *memBatchStore) checkConsistent(t *testing.T) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	perBatch := make(map[string]int)
+	processed := 0
+	for _, r := range s.readings {
+		if !r.Processed {
+			if r.BatchID != "" {
+				t.Errorf("reading %d claimed by %s but not processed", r.Timestamp, r.BatchID)
+			}
+			continue
+		}
+		processed++
+		perBatch[r.BatchID]++
+	}
+	counted := 0
+	for id, data := range s.stats {
+		counted += data.Count
+		if n := perBatch[id.String()]; n != data.Count {
+			t.Errorf("batch %s: stats count %d, processed readings %d", id, data.Count, n)
+		}
+	}
+	if counted != processed {
+		t.Errorf("stats cover %d readings, %d processed", counted, processed)
+	}
+}
+
+func newCountModeHandler(store *memBatchStore, threshold int) *DataHandler {
+	return &DataHandler{MongoToSQLThreshold: threshold, AggregationMode: AggregationModeCount, batchStore: store}
+}
+
+func TestConcurrentUploadsAggregateEachReadingOnce(t *testing.T) {
+	store := newMemBatchStore()
+	h := newCountModeHandler(store, 10)
+	device := &models.Device{DeviceID: "dev-1"}
+
+	const uploaders, perUploader = 8, 50
+	var wg sync.WaitGroup
+	for u := range uploaders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perUploader {
+				store.insert(device.DeviceID, int64(1700000000+u*perUploader+i))
+				if _, _, err := h.aggregatePending(context.Background(), device); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	store.checkConsistent(t)
+	if n, _ := store.CountUnclaimed(context.Background(), device.DeviceID, 0); n >= 10 {
+		t.Errorf("%d readings left unclaimed", n)
+	}
+}
+
+func TestResumeSkipsBatchBeingClaimed(t *testing.T) {
+	store := newMemBatchStore()
+	h := newCountModeHandler(store, 10)
+	device := &models.Device{DeviceID: "dev-1"}
+	for i := range 10 {
+		store.insert(device.DeviceID, int64(1700000000+i))
+	}
+
+	// 认领到一半时另一次聚合开始，认领未超时，不应接手该批次
+	store.afterClaim = func(claimed int) {
+		if batches, _, err := h.aggregatePending(context.Background(), device); err != nil || batches != 0 {
+			t.Errorf("concurrent aggregation finished %d batches, err %v", batches, err)
+		}
+	}
+	batches, readings, err := h.aggregatePending(context.Background(), device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches != 1 || readings != 10 {
+		t.Errorf("got %d batches with %d readings, want 1 with 10", batches, readings)
+	}
+	store.checkConsistent(t)
+}
+
+func TestResumeAfterLeaseRecomputesBatch(t *testing.T) {
+	store := newMemBatchStore()
+	h := newCountModeHandler(store, 10)
+	device := &models.Device{DeviceID: "dev-1"}
+	for i := range 10 {
+		store.insert(device.DeviceID, int64(1700000000+i))
+	}
+
+	// 认领过慢超过租期，另一次聚合接手认领到一半的批次
+	store.afterClaim = func(claimed int) {
+		store.mu.Lock()
+		for _, r := range store.readings {
+			if r.BatchID != "" {
+				r.ClaimedAt -= int64(2 * batchClaimLease / time.Second)
+			}
+		}
+		store.mu.Unlock()
+		if _, readings, err := h.aggregatePending(context.Background(), device); err != nil || readings != claimed {
+			t.Errorf("resumed %d readings, want %d, err %v", readings, claimed, err)
+		}
+	}
+	if _, _, err := h.aggregatePending(context.Background(), device); err != nil {
+		t.Fatal(err)
+	}
+
+	store.checkConsistent(t)
+	if len(store.stats) != 1 {
+		t.Fatalf("got %d stats rows, want 1", len(store.stats))
+	}
+	for _, data := range store.stats {
+		if data.Count != 10 {
+			t.Errorf("stats count %d, want 10", data.Count)
+		}
+	}
+}
+
+func TestFlushClaimsOnlyExpiredReadings(t *testing.T) {
+	store := newMemBatchStore()
+	h := newCountModeHandler(store, 100)
+	device := &models.Device{DeviceID: "dev-1"}
+	for i := range 15 {
+		store.insert(device.DeviceID, int64(1700000000+i))
+	}
+
+	batches, readings, err := h.flushDevice(context.Background(), device, 1700000010)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches != 1 || readings != 10 {
+		t.Errorf("got %d batches with %d readings, want 1 with 10", batches, readings)
+	}
+	if n, _ := store.CountUnclaimed(context.Background(), device.DeviceID, 0); n != 5 {
+		t.Errorf("%d readings left unclaimed, want 5", n)
+	}
+	store.checkConsistent(t)
+}
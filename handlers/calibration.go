@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+type CalibrationHandler struct {
+	BaseHandler[models.Calibration]
+}
+
+// 查询设备的全部校准系数，按生效时间排序
+func loadCalibrations(db *gorm.DB, device *models.Device) ([]models.Calibration, error) {
+	var calibrations []models.Calibration
+	err := db.Where("device_uuid = ?", device.UUID).Order("valid_from ASC").Find(&calibrations).Error
+	return calibrations, err
+}
+
+// 筛选某一时刻生效的校准系数，同一字段取生效时间最晚的一条
+func calibrationsAt(calibrations []models.Calibration, at time.Time) map[string]models.Calibration {
+	result := make(map[string]models.Calibration, len(calibrations))
+	for _, calibration := range calibrations {
+		if calibration.ValidFrom.After(at) {
+			continue
+		}
+		if calibration.ValidTo != nil && !calibration.ValidTo.After(at) {
+			continue
+		}
+		result[calibration.Field] = calibration
+	}
+	return result
+}
+
+// 对原始数据应用校准系数
+func calibrate(raw models.DataEntry, calibrations map[string]models.Calibration) models.DataEntry {
+	calibrated := raw
+	for field, calibration := range calibrations {
+		if value, ok := raw.Get(field); ok {
+			calibrated.Set(field, float32(float64(value)*calibration.Gain+calibration.Offset))
+		}
+	}
+	return calibrated
+}
+
+// 返回校准后的数据
+func ApplyCalibration(db *gorm.DB, device *models.Device, timestamp int64, raw models.DataEntry) (models.DataEntry, error) {
+	calibrations, err := loadCalibrations(db, device)
+	if err != nil {
+		return raw, err
+	}
+	return calibrate(raw, calibrationsAt(calibrations, time.Unix(timestamp, 0))), nil
+}
+
+// 解析校准参数
+func parseCalibration(calibration *models.Calibration, data map[string]any, creating bool) error {
+	if field, ok := data["field"].(string); ok {
+		if _, exists := LookupMetric(field); !exists {
+			return errors.New("invalid field")
+		}
+		calibration.Field = field
+	} else if creating {
+		return errors.New("field is required")
+	}
+
+	if offset, ok := data["offset"].(float64); ok {
+		calibration.Offset = offset
+	}
+	if gain, ok := data["gain"].(float64); ok {
+		if gain == 0 {
+			return errors.New("invalid gain")
+		}
+		calibration.Gain = gain
+	} else if creating {
+		calibration.Gain = 1
+	}
+
+	if validFrom, ok := data["valid_from"].(string); ok {
+		t, err := time.Parse(time.RFC3339, validFrom)
+		if err != nil {
+			return errors.New("invalid valid_from")
+		}
+		calibration.ValidFrom = t
+	} else if creating {
+		calibration.ValidFrom = time.Now()
+	}
+
+	if value, ok := data["valid_to"]; ok {
+		if value == nil {
+			calibration.ValidTo = nil
+		} else {
+			validTo, ok := value.(string)
+			t, err := time.Parse(time.RFC3339, validTo)
+			if !ok || err != nil {
+				return errors.New("invalid valid_to")
+			}
+			calibration.ValidTo = &t
+		}
+	}
+	if calibration.ValidTo != nil && !calibration.ValidTo.After(calibration.ValidFrom) {
+		return errors.New("valid_to must be after valid_from")
+	}
+	return nil
+}
+
+func (h *CalibrationHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, calibration *models.Calibration, data map[string]any) error {
+			device := &models.Device{}
+			if err := h.DB.First(device, "uuid = ?", c.Param("uuid")).Error; err != nil {
+				return utils.ErrNotFound
+			}
+			calibration.DeviceUUID = device.UUID
+			return parseCalibration(calibration, data, true)
+		},
+	)(c)
+}
+
+func (h *CalibrationHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			query = query.Where("device_uuid = ?", c.Param("uuid"))
+			if field := c.Query("field"); field != "" {
+				query = query.Where("field = ?", field)
+			}
+			return query
+		},
+	)(c)
+}
+
+func (h *CalibrationHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, calibration *models.Calibration, data map[string]any) error {
+			return parseCalibration(calibration, data, false)
+		},
+	)(c)
+}
+
+func (h *CalibrationHandler) Destroy(c *gin.Context) {
+	h.BaseHandler.Destroy(
+		nil,
+	)(c)
+}
+
+// 重新校准时每批写回的读数条数
+const recalibrateBatchSize = 500
+
+type RecalibrateRequest struct {
+	StartTime string `json:"start_time"` // 开始时间（ISO8601格式），为空表示不限
+	EndTime   string `json:"end_time"`   // 结束时间（ISO8601格式），为空表示不限
+}
+
+// 校准系数变更后，按原始数据重新计算历史读数及其所属的统计数据
+func (h *DataHandler) Recalibrate(c *gin.Context) {
+	var req RecalibrateRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+
+	device := &models.Device{}
+	if err := h.DB.First(device, "uuid = ?", c.Param("uuid")).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+
+	filter := bson.M{"device_id": device.DeviceID}
+	timeRange := bson.M{}
+	if startTime, err := time.Parse(time.RFC3339, req.StartTime); err == nil {
+		timeRange["$gte"] = startTime.Unix()
+	}
+	if endTime, err := time.Parse(time.RFC3339, req.EndTime); err == nil {
+		timeRange["$lt"] = endTime.Unix()
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	calibrations, err := loadCalibrations(h.DB, device)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	// 逐条读取并分批写回，避免一次加载全部读数
+	cursor, err := h.MongoCollection.Find(c, filter, options.Find().SetBatchSize(recalibrateBatchSize))
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	defer cursor.Close(c)
+
+	updates := make([]mongo.WriteModel, 0, recalibrateBatchSize)
+	flush := func() error {
+		if len(updates) == 0 {
+			return nil
+		}
+		_, err := h.MongoCollection.BulkWrite(c, updates, options.BulkWrite().SetOrdered(false))
+		updates = updates[:0]
+		return err
+	}
+
+	// 重新计算每条读数的校准值
+	readings := 0
+	batches := make(map[string]bool)
+	for cursor.Next(c) {
+		var reading MongoData
+		if err := cursor.Decode(&reading); err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		raw := reading.Data
+		if reading.RawData != nil {
+			raw = *reading.RawData
+		}
+		calibrated := calibrate(raw, calibrationsAt(calibrations, time.Unix(reading.Timestamp, 0)))
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": reading.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"data": calibrated, "raw_data": raw}}))
+		if reading.BatchID != "" {
+			batches[reading.BatchID] = true
+		}
+		readings++
+		if len(updates) >= recalibrateBatchSize {
+			if err := flush(); err != nil {
+				utils.Respond(c, nil, utils.ErrInternalServer)
+				return
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	if err := flush(); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	// 重新计算受影响的统计数据
+	for batchID := range batches {
+		cursor, err := h.MongoCollection.Find(c, bson.M{"batch_id": batchID})
+		if err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		var batch []MongoData
+		if err := cursor.All(c, &batch); err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+
+		data := &models.Data{}
+		if err := h.DB.First(data, "uuid = ?", batchID).Error; err != nil {
+			// 统计数据已被删除时跳过
+			log.Printf("重新计算统计数据%s失败：%v", batchID, err)
+			continue
+		}
+		summary := SummarizeReadings(batch)
+		summary.Apply(data)
+		if err := h.DB.Save(data).Error; err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		if err := h.rebuildParents(device, data); err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+	}
+
+	utils.Respond(c, gin.H{"readings": readings, "aggregates": len(batches)}, utils.ErrOK)
+}
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"net/url"
+	"ssat_backend_rebuild/models"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 设备上传支持的编码，由请求头 Content-Type 决定，默认为 JSON。
+// 签名始终按解码后字段的规范形式计算，与编码无关
+const (
+	MIMECBOR     = "application/cbor"
+	MIMEProtobuf = "application/x-protobuf"
+)
+
+// 上传请求体的大小上限
+const maxUploadBodySize = 8 << 20
+
+var errInvalidProtobuf = errors.New("invalid protobuf payload")
+
+// DataEntry 中扩展指标的字段编号
+const extraMetricsField = 16
+
+// 按 Content-Type 和 Content-Encoding 解码设备上传的请求体并校验
+func bindDeviceRequest(c *gin.Context, obj any) error {
+	var body io.Reader = c.Request.Body
+	if strings.EqualFold(c.GetHeader("Content-Encoding"), "gzip") {
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		body = reader
+	}
+	payload, err := io.ReadAll(io.LimitReader(body, maxUploadBodySize))
+	if err != nil {
+		return err
+	}
+
+	switch c.ContentType() {
+	case MIMECBOR:
+		// 未声明 cbor 标签时沿用 json 标签的字段名
+		err = cbor.Unmarshal(payload, obj)
+	case MIMEProtobuf:
+		err = unmarshalUploadProto(payload, obj)
+	default:
+		err = binding.JSON.BindBody(payload, obj)
+		// BindBody 已完成校验
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
+
+func unmarshalUploadProto(payload []byte, obj any) error {
+	switch req := obj.(type) {
+	case *DataUploadRequest:
+		return decodeUploadRequest(payload, req)
+	case *DataBatchUploadRequest:
+		return decodeBatchUploadRequest(payload, req)
+	}
+	return errors.New("unsupported message")
+}
+
+// 依次处理消息中的字段，value 为字段值的原始字节
+func walkProto(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errInvalidProtobuf
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return errInvalidProtobuf
+		}
+		if err := fn(num, typ, b[:m]); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+func protoVarint(typ protowire.Type, value []byte) (int64, error) {
+	v, n := protowire.ConsumeVarint(value)
+	if typ != protowire.VarintType || n < 0 {
+		return 0, errInvalidProtobuf
+	}
+	return int64(v), nil
+}
+
+func protoFloat(typ protowire.Type, value []byte) (float32, error) {
+	v, n := protowire.ConsumeFixed32(value)
+	if typ != protowire.Fixed32Type || n < 0 {
+		return 0, errInvalidProtobuf
+	}
+	return math.Float32frombits(v), nil
+}
+
+func protoBytes(typ protowire.Type, value []byte) ([]byte, error) {
+	v, n := protowire.ConsumeBytes(value)
+	if typ != protowire.BytesType || n < 0 {
+		return nil, errInvalidProtobuf
+	}
+	return v, nil
+}
+
+func protoString(typ protowire.Type, value []byte, dst *string) error {
+	v, err := protoBytes(typ, value)
+	*dst = string(v)
+	return err
+}
+
+func decodeDataEntry(b []byte, entry *models.DataEntry) error {
+	return walkProto(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		// 扩展指标为 map<string, float>，键为字段 1，值为字段 2
+		if num == extraMetricsField {
+			item, err := protoBytes(typ, value)
+			if err != nil {
+				return err
+			}
+			var key string
+			var v float32
+			if err := walkProto(item, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch num {
+				case 1:
+					return protoString(typ, value, &key)
+				case 2:
+					v, err = protoFloat(typ, value)
+					return err
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			entry.Set(key, v)
+			return nil
+		}
+		// 内置指标的字段编号与 DataEntryKeys 的顺序一致
+		if num < 1 || int(num) > len(models.DataEntryKeys) {
+			return nil
+		}
+		v, err := protoFloat(typ, value)
+		if err != nil {
+			return err
+		}
+		entry.Set(models.DataEntryKeys[num-1], v)
+		return nil
+	})
+}
+
+func decodeTwinReport(b []byte, report *TwinReport) error {
+	return walkProto(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch num {
+		case 1:
+			v, err := protoVarint(typ, value)
+			report.Version = int(v)
+			return err
+		case 2:
+			config, err := protoBytes(typ, value)
+			if err != nil {
+				return err
+			}
+			return walkProto(config, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch num {
+				case 1, 2:
+					v, err := protoVarint(typ, value)
+					i := int(v)
+					if num == 1 {
+						report.Config.SamplingInterval = &i
+					} else {
+						report.Config.UploadThreshold = &i
+					}
+					return err
+				case 3:
+					var scene string
+					report.Config.Scene = &scene
+					return protoString(typ, value, &scene)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func decodeUploadRequest(b []byte, req *DataUploadRequest) error {
+	return walkProto(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch num {
+		case 1:
+			return protoString(typ, value, &req.DeviceID)
+		case 2:
+			v, err := protoVarint(typ, value)
+			req.Timestamp = v
+			return err
+		case 3:
+			entry, err := protoBytes(typ, value)
+			if err != nil {
+				return err
+			}
+			if req.Data == nil {
+				empty := models.EmptyDataEntry()
+				req.Data = &empty
+			}
+			return decodeDataEntry(entry, req.Data)
+		case 4:
+			return protoString(typ, value, &req.Season)
+		case 5:
+			return protoString(typ, value, &req.Scene)
+		case 6:
+			return protoString(typ, value, &req.Signature)
+		case 7:
+			report, err := protoBytes(typ, value)
+			if err != nil {
+				return err
+			}
+			req.Reported = &TwinReport{}
+			return decodeTwinReport(report, req.Reported)
+		case 8:
+			return protoString(typ, value, &req.FirmwareVersion)
+		case 9:
+			return protoString(typ, value, &req.FirmwareError)
+		}
+		return nil
+	})
+}
+
+func decodeBatchReading(b []byte, reading *BatchReading) error {
+	return walkProto(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch num {
+		case 1:
+			v, err := protoVarint(typ, value)
+			reading.Timestamp = v
+			return err
+		case 2:
+			entry, err := protoBytes(typ, value)
+			if err != nil {
+				return err
+			}
+			if reading.Data == nil {
+				empty := models.EmptyDataEntry()
+				reading.Data = &empty
+			}
+			return decodeDataEntry(entry, reading.Data)
+		case 3:
+			return protoString(typ, value, &reading.Season)
+		case 4:
+			return protoString(typ, value, &reading.Scene)
+		}
+		return nil
+	})
+}
+
+func decodeBatchUploadRequest(b []byte, req *DataBatchUploadRequest) error {
+	return walkProto(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch num {
+		case 1:
+			return protoString(typ, value, &req.DeviceID)
+		case 2:
+			v, err := protoVarint(typ, value)
+			req.Timestamp = v
+			return err
+		case 3:
+			message, err := protoBytes(typ, value)
+			if err != nil {
+				return err
+			}
+			var reading BatchReading
+			if err := decodeBatchReading(message, &reading); err != nil {
+				return err
+			}
+			req.Readings = append(req.Readings, reading)
+		case 4:
+			return protoString(typ, value, &req.Signature)
+		}
+		return nil
+	})
+}
+
+// 读数的规范形式，用于计算签名：各字段按名称排序后以 key=value 表示并以 & 连接（即 URL 查询字符串编码），
+// 数值取 float32 的最短十进制表示，未上报的指标和空字符串不参与
+func canonicalValues(values url.Values, prefix string, entry models.DataEntry) {
+	for _, key := range entry.Keys() {
+		v, _ := entry.Get(key)
+		values.Set(prefix+key, strconv.FormatFloat(float64(v), 'g', -1, 32))
+	}
+}
+
+func setCanonical(values url.Values, key, value string) {
+	if value != "" {
+		values.Set(key, value)
+	}
+}
+
+// 单条上传的规范形式，包含除 device_id、timestamp 和 signature 以外的所有字段
+func (r *DataUploadRequest) canonical() string {
+	values := url.Values{}
+	if r.Data != nil {
+		canonicalValues(values, "data.", *r.Data)
+	}
+	setCanonical(values, "season", r.Season)
+	setCanonical(values, "scene", r.Scene)
+	setCanonical(values, "firmware_version", r.FirmwareVersion)
+	setCanonical(values, "firmware_error", r.FirmwareError)
+	if r.Reported != nil {
+		values.Set("reported.version", strconv.Itoa(r.Reported.Version))
+		if v := r.Reported.Config.SamplingInterval; v != nil {
+			values.Set("reported.sampling_interval", strconv.Itoa(*v))
+		}
+		if v := r.Reported.Config.UploadThreshold; v != nil {
+			values.Set("reported.upload_threshold", strconv.Itoa(*v))
+		}
+		if v := r.Reported.Config.Scene; v != nil {
+			values.Set("reported.scene", *v)
+		}
+	}
+	return values.Encode()
+}
+
+// 批量上传中单条读数的规范形式
+func (r *BatchReading) canonical() string {
+	values := url.Values{}
+	values.Set("timestamp", strconv.FormatInt(r.Timestamp, 10))
+	if r.Data != nil {
+		canonicalValues(values, "data.", *r.Data)
+	}
+	setCanonical(values, "season", r.Season)
+	setCanonical(values, "scene", r.Scene)
+	return values.Encode()
+}
+
+// 批量上传的规范形式：各条读数的规范形式按上传顺序以换行连接
+func (r *DataBatchUploadRequest) canonical() string {
+	lines := make([]string, len(r.Readings))
+	for i := range r.Readings {
+		lines[i] = r.Readings[i].canonical()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 规范形式的摘要，作为签名的一部分：sha256 的十六进制表示
+func canonicalDigest(canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 以指定编码解码请求体
+func decodeAs(t *testing.T, contentType string, body []byte, obj any) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", contentType)
+	if err := bindDeviceRequest(c, obj); err != nil {
+		t.Fatalf("%s: %v", contentType, err)
+	}
+}
+
+func protoAppendString(b []byte, num protowire.Number, v string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func protoAppendVarint(b []byte, num protowire.Number, v int64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func protoAppendFloat(b []byte, num protowire.Number, v float32) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(v))
+}
+
+func protoAppendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// temperature、humidity 及扩展指标 co2
+func protoTestEntry() []byte {
+	var entry []byte
+	entry = protoAppendFloat(entry, 1, 23.45)
+	entry = protoAppendFloat(entry, 2, 40.1)
+	var extra []byte
+	extra = protoAppendString(extra, 1, "co2")
+	extra = protoAppendFloat(extra, 2, 612.3)
+	return protoAppendMessage(entry, extraMetricsField, extra)
+}
+
+var testEntry = map[string]float32{"temperature": 23.45, "humidity": 40.1, "co2": 612.3}
+
+func TestUploadCanonicalAcrossEncodings(t *testing.T) {
+	request := map[string]any{
+		"device_id": "dev-1",
+		"timestamp": int64(1700000000),
+		"data":      testEntry,
+		"scene":     "office",
+		"signature": "sig",
+		"reported": map[string]any{
+			"version": 3,
+			"config":  map[string]any{"sampling_interval": 60, "scene": "office"},
+		},
+		"firmware_version": "1.2.0",
+	}
+	jsonBody, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cborBody, err := cbor.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config, reported, protoBody []byte
+	config = protoAppendVarint(config, 1, 60)
+	config = protoAppendString(config, 3, "office")
+	reported = protoAppendVarint(reported, 1, 3)
+	reported = protoAppendMessage(reported, 2, config)
+	protoBody = protoAppendString(protoBody, 1, "dev-1")
+	protoBody = protoAppendVarint(protoBody, 2, 1700000000)
+	protoBody = protoAppendMessage(protoBody, 3, protoTestEntry())
+	protoBody = protoAppendString(protoBody, 5, "office")
+	protoBody = protoAppendString(protoBody, 6, "sig")
+	protoBody = protoAppendMessage(protoBody, 7, reported)
+	protoBody = protoAppendString(protoBody, 8, "1.2.0")
+
+	want := "data.co2=612.3&data.humidity=40.1&data.temperature=23.45&firmware_version=1.2.0" +
+		"&reported.sampling_interval=60&reported.scene=office&reported.version=3&scene=office"
+	for contentType, body := range map[string][]byte{
+		"application/json": jsonBody,
+		MIMECBOR:           cborBody,
+		MIMEProtobuf:       protoBody,
+	} {
+		var req DataUploadRequest
+		decodeAs(t, contentType, body, &req)
+		if got := req.canonical(); got != want {
+			t.Errorf("%s: canonical = %q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestUploadCanonicalCoversReadings(t *testing.T) {
+	base := DataUploadRequest{}
+	decodeAs(t, "application/json", []byte(`{"device_id":"d","timestamp":1,"signature":"s","data":{"temperature":20}}`), &base)
+	if got := base.canonical(); got != "data.temperature=20" {
+		t.Fatalf("canonical = %q", got)
+	}
+
+	// 篡改读数或补报未上报的指标都会改变摘要
+	for _, body := range []string{
+		`{"device_id":"d","timestamp":1,"signature":"s","data":{"temperature":21}}`,
+		`{"device_id":"d","timestamp":1,"signature":"s","data":{"temperature":20,"humidity":0}}`,
+	} {
+		var req DataUploadRequest
+		decodeAs(t, "application/json", []byte(body), &req)
+		if canonicalDigest(req.canonical()) == canonicalDigest(base.canonical()) {
+			t.Errorf("%s: digest unchanged", body)
+		}
+	}
+}
+
+func TestBatchCanonicalAcrossEncodings(t *testing.T) {
+	request := map[string]any{
+		"device_id": "dev-1",
+		"timestamp": int64(1700000100),
+		"signature": "sig",
+		"readings": []map[string]any{
+			{"timestamp": int64(1700000000), "data": testEntry, "scene": "office"},
+			{"timestamp": int64(1700000060), "data": map[string]float32{"temperature": -1.5}},
+		},
+	}
+	jsonBody, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cborBody, err := cbor.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, second, protoBody []byte
+	first = protoAppendVarint(first, 1, 1700000000)
+	first = protoAppendMessage(first, 2, protoTestEntry())
+	first = protoAppendString(first, 4, "office")
+	second = protoAppendVarint(second, 1, 1700000060)
+	second = protoAppendMessage(second, 2, protoAppendFloat(nil, 1, -1.5))
+	protoBody = protoAppendString(protoBody, 1, "dev-1")
+	protoBody = protoAppendVarint(protoBody, 2, 1700000100)
+	protoBody = protoAppendMessage(protoBody, 3, first)
+	protoBody = protoAppendMessage(protoBody, 3, second)
+	protoBody = protoAppendString(protoBody, 4, "sig")
+
+	want := "data.co2=612.3&data.humidity=40.1&data.temperature=23.45&scene=office&timestamp=1700000000\n" +
+		"data.temperature=-1.5&timestamp=1700000060"
+	for contentType, body := range map[string][]byte{
+		"application/json": jsonBody,
+		MIMECBOR:           cborBody,
+		MIMEProtobuf:       protoBody,
+	} {
+		var req DataBatchUploadRequest
+		decodeAs(t, contentType, body, &req)
+		if got := req.canonical(); got != want {
+			t.Errorf("%s: canonical = %q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestBatchCanonicalOrder(t *testing.T) {
+	a := DataBatchUploadRequest{}
+	b := DataBatchUploadRequest{}
+	decodeAs(t, "application/json", []byte(`{"device_id":"d","timestamp":1,"signature":"s","readings":[`+
+		`{"timestamp":1,"data":{"temperature":20}},{"timestamp":2,"data":{"temperature":21}}]}`), &a)
+	decodeAs(t, "application/json", []byte(`{"device_id":"d","timestamp":1,"signature":"s","readings":[`+
+		`{"timestamp":1,"data":{"temperature":21}},{"timestamp":2,"data":{"temperature":20}}]}`), &b)
+	// 条数相同但读数不同的批次摘要不同
+	if canonicalDigest(a.canonical()) == canonicalDigest(b.canonical()) {
+		t.Error("digest unchanged after swapping readings")
+	}
+}
+
+func TestLegacyJSONUploadSignature(t *testing.T) {
+	body := []byte(`{"device_id":"d","timestamp":1700000000,"signature":"s","data":{"temperature":20}}`)
+	legacy := deviceSignature("d", 1700000000, "secret", nil)
+	for _, tc := range []struct {
+		contentType, version string
+		accepted             bool
+	}{
+		{"application/json", "", true},
+		{"", "", true},
+		// 声明新版签名或使用新编码时只接受规范形式的签名
+		{"application/json", "2", false},
+		{MIMECBOR, "", false},
+		{MIMEProtobuf, "", false},
+	} {
+		var req DataUploadRequest
+		decodeAs(t, "application/json", body, &req)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/", nil)
+		c.Request.Header.Set("Content-Type", tc.contentType)
+		if tc.version != "" {
+			c.Request.Header.Set("X-Signature-Version", tc.version)
+		}
+		accepted := uploadSignatures(c, &req)
+		legacyOK := slices.ContainsFunc(accepted, func(extra []string) bool {
+			return deviceSignature("d", 1700000000, "secret", extra) == legacy
+		})
+		if legacyOK != tc.accepted {
+			t.Errorf("%q version %q: legacy signature accepted = %v, want %v", tc.contentType, tc.version, legacyOK, tc.accepted)
+		}
+		canonical := deviceSignature("d", 1700000000, "secret", []string{canonicalDigest(req.canonical())})
+		if !slices.ContainsFunc(accepted, func(extra []string) bool {
+			return deviceSignature("d", 1700000000, "secret", extra) == canonical
+		}) {
+			t.Errorf("%q version %q: canonical signature rejected", tc.contentType, tc.version)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"errors"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CommandHandler struct {
+	TTL    int         // 指令默认有效期（秒）
+	Broker *MQTTBroker // 未启用 MQTT 时为空
+	BaseHandler[models.DeviceCommand]
+}
+
+// 支持下发的指令
+var DeviceCommandNames = map[string]string{
+	"reboot":      "重启",
+	"recalibrate": "重新校准",
+	"self_test":   "自检",
+}
+
+// 每次最多下发的指令数
+const maxCommandsPerDelivery = 10
+
+// 将超时未确认的指令标记为已过期
+func expireCommands(db *gorm.DB, deviceUUID any) error {
+	return db.Model(&models.DeviceCommand{}).
+		Where("device_uuid = ? AND status IN ? AND expires_at < ?", deviceUUID, []uint8{0, 1}, time.Now()).
+		Update("status", 4).Error
+}
+
+// 取出待执行的指令并标记为已下发。
+// 已下发但未确认的指令会被重复下发，设备需按 uuid 去重
+func DeliverCommands(db *gorm.DB, device *models.Device) ([]models.DeviceCommand, error) {
+	if err := expireCommands(db, device.UUID); err != nil {
+		return nil, err
+	}
+
+	var commands []models.DeviceCommand
+	if err := db.Where("device_uuid = ? AND status IN ?", device.UUID, []uint8{0, 1}).
+		Order("seq ASC").Limit(maxCommandsPerDelivery).Find(&commands).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range commands {
+		if commands[i].Status != 0 {
+			continue
+		}
+		if err := db.Model(&commands[i]).Where("status = ?", 0).
+			Updates(map[string]any{"status": 1, "delivered_at": now}).Error; err != nil {
+			return nil, err
+		}
+		commands[i].Status = 1
+		commands[i].DeliveredAt = &now
+	}
+	return commands, nil
+}
+
+// 设备回报指令执行结果
+func AckCommand(db *gorm.DB, device *models.Device, commandUUID string, status string, result string) error {
+	command := &models.DeviceCommand{}
+	if err := db.First(command, "uuid = ? AND device_uuid = ?", commandUUID, device.UUID).Error; err != nil {
+		return utils.ErrNotFound
+	}
+
+	// 重复确认直接忽略
+	if command.Status == 2 || command.Status == 3 {
+		return nil
+	}
+	if command.Status == 4 {
+		return errors.New("指令已过期")
+	}
+
+	newStatus := uint8(2)
+	if status == "failed" {
+		newStatus = 3
+	}
+	now := time.Now()
+	return db.Model(command).Updates(map[string]any{"status": newStatus, "acked_at": now, "result": result}).Error
+}
+
+// 管理员向设备下发指令
+func (h *CommandHandler) Create(c *gin.Context) {
+	var data map[string]any
+	if err := c.ShouldBindJSON(&data); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	name, ok := data["name"].(string)
+	if _, exists := DeviceCommandNames[name]; !ok || !exists {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: "invalid command name"})
+		return
+	}
+	params, _ := data["params"].(map[string]any)
+
+	ttl := h.TTL
+	if ttl <= 0 {
+		ttl = 24 * 3600 // 默认一天
+	}
+	if value, ok := data["ttl"]; ok {
+		seconds, ok := value.(float64)
+		if !ok || seconds <= 0 {
+			utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: "invalid ttl"})
+			return
+		}
+		ttl = int(seconds)
+	}
+
+	device := &models.Device{}
+	command := &models.DeviceCommand{
+		Name:      name,
+		Params:    params,
+		Status:    0,
+		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// 锁定设备行，同一设备的指令依次分配序号
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(device, "uuid = ?", c.Param("uuid")).Error; err != nil {
+			return err
+		}
+		var maxSeq int64
+		if err := tx.Model(&models.DeviceCommand{}).Where("device_uuid = ?", device.UUID).
+			Select("COALESCE(MAX(seq), 0)").Scan(&maxSeq).Error; err != nil {
+			return err
+		}
+		command.DeviceUUID = device.UUID
+		command.Seq = maxSeq + 1
+		return tx.Create(command).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, command, utils.ErrCreated)
+
+	// 设备通过 MQTT 连接时立即推送
+	if h.Broker != nil && c.Writer.Status() < 300 {
+		h.Broker.PushCommands(device)
+	}
+}
+
+// 管理员查看设备的指令队列
+func (h *CommandHandler) List(c *gin.Context) {
+	expireCommands(h.DB, c.Param("uuid"))
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			query = query.Where("device_uuid = ?", c.Param("uuid"))
+			if status := c.Query("status"); status != "" {
+				if s, err := strconv.ParseUint(status, 10, 8); err == nil {
+					query = query.Where("status = ?", s)
+				}
+			}
+			return query
+		},
+	)(c)
+}
+
+type CommandPollRequest struct {
+	DeviceID  string `json:"device_id" binding:"required"`
+	Timestamp int64  `json:"timestamp" binding:"required"`
+	Signature string `json:"signature" binding:"required"` // md5(device_id:timestamp:secret)
+}
+
+// 设备主动拉取待执行的指令
+func (h *CommandHandler) Poll(c *gin.Context) {
+	var req CommandPollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	device, ok := authenticateDevice(c, h.DB, req.DeviceID, req.Timestamp, req.Signature)
+	if !ok {
+		return
+	}
+
+	commands, err := DeliverCommands(h.DB, device)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, gin.H{"commands": commands}, utils.ErrOK)
+}
+
+type CommandAckRequest struct {
+	DeviceID    string `json:"device_id" binding:"required"`
+	Timestamp   int64  `json:"timestamp" binding:"required"`
+	CommandUUID string `json:"command_uuid" binding:"required"`
+	Status      string `json:"status" binding:"required,oneof=acked failed"`
+	Result      string `json:"result"`
+	Signature   string `json:"signature" binding:"required"` // md5(device_id:timestamp:command_uuid:status:secret)
+}
+
+// 设备确认指令执行结果
+func (h *CommandHandler) Ack(c *gin.Context) {
+	var req CommandAckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	device, ok := authenticateDevice(c, h.DB, req.DeviceID, req.Timestamp, req.Signature, req.CommandUUID, req.Status)
+	if !ok {
+		return
+	}
+
+	if err := AckCommand(h.DB, device, req.CommandUUID, req.Status, req.Result); err != nil {
+		if errors.Is(err, utils.ErrNotFound) {
+			utils.Respond(c, nil, utils.ErrNotFound)
+			return
+		}
+		utils.Respond(c, nil, utils.ErrorCode{
+			Code:     4,
+			HttpCode: 400,
+			Message:  err.Error(),
+		})
+		return
+	}
+	utils.Respond(c, nil, utils.ErrOK)
+}
@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"slices"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 室内空气质量标准中某项指标的要求
+type ComplianceLimit struct {
+	Metric   string                // 指标名
+	Unit     string                // 限值的单位，与指标注册表中的单位不一致时不评价
+	Period   time.Duration         // 平均时间：1 小时、8 小时或 24 小时
+	Min      *float64              // 下限，为空表示不限
+	Max      *float64              // 上限，为空表示不限
+	Seasonal map[string][2]float64 // 按季节不同的范围，优先于 Min、Max
+	Note     string
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// 平均时间的显示形式，如 8h
+func periodLabel(d time.Duration) string {
+	return strconv.Itoa(int(d.Hours())) + "h"
+}
+
+// 某季节下的范围
+func (l ComplianceLimit) bounds(season string) (lo, hi float64) {
+	lo, hi = math.Inf(-1), math.Inf(1)
+	if r, ok := l.Seasonal[season]; ok {
+		return r[0], r[1]
+	}
+	if l.Min != nil {
+		lo = *l.Min
+	}
+	if l.Max != nil {
+		hi = *l.Max
+	}
+	return lo, hi
+}
+
+// GB/T 18883-2022《室内空气质量标准》。温湿度的夏季、冬季分别对应制冷、采暖期，春秋两季取两者的包络范围；
+// 新风量的要求按人均风量计算，与设备测量的换气次数不可比较，不参与评价
+var GBT18883 = []ComplianceLimit{
+	{Metric: "temperature", Unit: "℃", Period: time.Hour, Seasonal: map[string][2]float64{
+		"summer": {22, 28}, "winter": {16, 24}, "spring": {16, 28}, "autumn": {16, 28},
+	}},
+	{Metric: "humidity", Unit: "%", Period: time.Hour, Seasonal: map[string][2]float64{
+		"summer": {40, 80}, "winter": {30, 60}, "spring": {30, 80}, "autumn": {30, 80},
+	}},
+	{Metric: "ozone", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(0.16)},
+	{Metric: "nitro_dio", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(0.20)},
+	{Metric: "so2", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(0.50)},
+	{Metric: "co2", Unit: "ppm", Period: time.Hour, Max: floatPtr(1000)},
+	{Metric: "carb_momo", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(10)},
+	{Metric: "methanal", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(0.08)},
+	{Metric: "benzene", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(0.03)},
+	{Metric: "toluene", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(0.20)},
+	{Metric: "xylene", Unit: "mg/m³", Period: time.Hour, Max: floatPtr(0.20)},
+	{Metric: "tvoc", Unit: "mg/m³", Period: 8 * time.Hour, Max: floatPtr(0.60)},
+	{Metric: "pm10", Unit: "μg/m³", Period: 24 * time.Hour, Max: floatPtr(100)},
+	{Metric: "pm2_5", Unit: "μg/m³", Period: 24 * time.Hour, Max: floatPtr(50)},
+	{Metric: "bacteria", Unit: "CFU/m³", Period: time.Hour, Max: floatPtr(1500)},
+	// 300 Bq/m³ 换算为 pCi/L（1 pCi/L = 37 Bq/m³）
+	{Metric: "radon", Unit: "pCi/L", Period: 24 * time.Hour, Max: floatPtr(300.0 / 37), Note: "标准为年平均值，此处按日平均值评价，仅供参考"},
+}
+
+// 8 小时和 24 小时平均值所需的最少有效小时数
+const (
+	minHoursFor8h  = 6
+	minHoursFor24h = 20
+)
+
+// 连续超标的时间段
+type Exceedance struct {
+	Start int64   `json:"start"`
+	End   int64   `json:"end"`
+	Peak  float64 `json:"peak"` // 时间段内偏离限值最远的平均值
+}
+
+// 某项指标的评价结果
+type ComplianceResult struct {
+	Metric      string       `json:"metric"`
+	Name        string       `json:"name"`
+	Unit        string       `json:"unit"`
+	Period      string       `json:"period"`
+	Min         *float64     `json:"min,omitempty"`
+	Max         *float64     `json:"max,omitempty"`
+	Seasonal    any          `json:"seasonal,omitempty"`
+	Status      string       `json:"status"`    // pass 达标、fail 超标、no_data 数据不足、unit_mismatch 单位不一致
+	Evaluated   int          `json:"evaluated"` // 参与评价的平均值个数
+	Exceeded    int          `json:"exceeded"`  // 超标的平均值个数
+	Duration    int64        `json:"exceedance_seconds"`
+	Worst       *float64     `json:"worst,omitempty"` // 偏离限值最远的平均值
+	Exceedances []Exceedance `json:"exceedances"`
+	Note        string       `json:"note,omitempty"`
+}
+
+// 按小时计算平均值的数据来源，按优先级排列
+var hourlySources = []string{models.ResolutionHour, models.Resolution5Min, models.ResolutionBatch, "raw"}
+
+// 按小时计算各项指标的平均值。每个小时分别选用优先级最高且有数据的来源，返回实际用到的来源
+func (h *DataHandler) hourlyAverages(ctx context.Context, device *models.Device, from, to time.Time, keys []string) (map[string]map[int64]float64, []string, error) {
+	buckets := make(map[string]map[string]map[int64]*seriesBucket, len(hourlySources))
+	add := func(source, key string, hour int64, value, weight float64) {
+		if buckets[source] == nil {
+			buckets[source] = make(map[string]map[int64]*seriesBucket)
+		}
+		if buckets[source][key] == nil {
+			buckets[source][key] = make(map[int64]*seriesBucket)
+		}
+		if buckets[source][key][hour] == nil {
+			buckets[source][key][hour] = &seriesBucket{}
+		}
+		buckets[source][key][hour].add(value, value, value, weight)
+	}
+
+	for _, resolution := range hourlySources[:3] {
+		var rows []models.Data
+		if err := h.DB.WithContext(ctx).Where("my_device_id = ? AND resolution = ? AND window_start >= ? AND window_start < ?", device.UUID, resolution, from, to).
+			Find(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, row := range rows {
+			for _, share := range hourShares(&row) {
+				for _, key := range keys {
+					if avg, ok := row.Avg.Get(key); ok {
+						add(resolution, key, share.hour, float64(avg), share.weight)
+					}
+				}
+			}
+		}
+	}
+
+	raw, err := h.rawHourlyAverages(ctx, device, from, to, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, hours := range raw {
+		for hour, bucket := range hours {
+			add("raw", key, hour, bucket.sum/bucket.weight, bucket.weight)
+		}
+	}
+
+	averages := make(map[string]map[int64]float64, len(keys))
+	var used []string
+	for _, source := range hourlySources {
+		found := false
+		for key, hours := range buckets[source] {
+			if averages[key] == nil {
+				averages[key] = make(map[int64]float64, len(hours))
+			}
+			for hour, bucket := range hours {
+				if _, ok := averages[key][hour]; ok || bucket.weight == 0 {
+					continue
+				}
+				averages[key][hour] = bucket.sum / bucket.weight
+				found = true
+			}
+		}
+		if found {
+			used = append(used, source)
+		}
+	}
+	return averages, used, nil
+}
+
+// 统计数据在各小时中所占的权重
+type hourShare struct {
+	hour   int64
+	weight float64
+}
+
+// 统计数据按时间跨度分摊到各小时，权重为读数条数乘以与该小时重叠的比例。
+// 按条数聚合的批次跨度超过一小时时无法代表其中任一小时，不参与计算，由原始读数补充
+func hourShares(row *models.Data) []hourShare {
+	weight := float64(max(row.Count, 1))
+	start := *row.WindowStart
+	if row.Resolution != models.ResolutionBatch || row.WindowEnd == nil || !row.WindowEnd.After(start) {
+		return []hourShare{{start.Truncate(time.Hour).Unix(), weight}}
+	}
+	end := *row.WindowEnd
+	span := end.Sub(start)
+	if span > time.Hour {
+		return nil
+	}
+	var shares []hourShare
+	for hour := start.Truncate(time.Hour); hour.Before(end); hour = hour.Add(time.Hour) {
+		overlap := minTime(end, hour.Add(time.Hour)).Sub(maxTime(start, hour))
+		if overlap > 0 {
+			shares = append(shares, hourShare{hour.Unix(), weight * float64(overlap) / float64(span)})
+		}
+	}
+	return shares
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// 由原始读数在 MongoDB 中按小时分组计算平均值。未上报的指标和未审核的异常读数不参与计算
+func (h *DataHandler) rawHourlyAverages(ctx context.Context, device *models.Device, from, to time.Time, keys []string) (map[string]map[int64]*seriesBucket, error) {
+	group := bson.M{"_id": bson.M{"$subtract": bson.A{"$timestamp", bson.M{"$mod": bson.A{"$timestamp", 3600}}}}}
+	for i, key := range keys {
+		value := any("$data." + models.DataEntryBSONField(key))
+		if slices.Contains(models.DataEntryKeys, key) {
+			value = bson.M{"$cond": bson.A{
+				bson.M{"$in": bson.A{key, bson.M{"$ifNull": bson.A{"$data.missing", bson.A{}}}}},
+				nil,
+				value,
+			}}
+		}
+		group["sum"+strconv.Itoa(i)] = bson.M{"$sum": value}
+		group["n"+strconv.Itoa(i)] = bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$isNumber": value}, 1, 0}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"device_id": device.DeviceID,
+			"timestamp": bson.M{"$gte": from.Unix(), "$lt": to.Unix()},
+			"anomalous": bson.M{"$ne": true},
+		}}},
+		{{Key: "$group", Value: group}},
+	}
+	cursor, err := h.MongoCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []bson.M
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[int64]*seriesBucket, len(keys))
+	for _, g := range groups {
+		hour := int64(bsonNumber(g["_id"]))
+		for i, key := range keys {
+			n := bsonNumber(g["n"+strconv.Itoa(i)])
+			if n == 0 {
+				continue
+			}
+			if result[key] == nil {
+				result[key] = make(map[int64]*seriesBucket)
+			}
+			result[key][hour] = &seriesBucket{sum: bsonNumber(g["sum"+strconv.Itoa(i)]), weight: n}
+		}
+	}
+	return result, nil
+}
+
+// 聚合结果中的数值
+func bsonNumber(v any) float64 {
+	switch n := v.(type) {
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// 按平均时间计算评价用的平均值，返回各平均值的起点及时长。
+// 8 小时为滑动平均，每小时计算一次；24 小时按设备所在时区的自然日计算
+func periodAverages(hourly map[int64]float64, period time.Duration, from, to time.Time, loc *time.Location) (starts []int64, values []float64, span time.Duration) {
+	switch period {
+	case 8 * time.Hour:
+		for t := from.Truncate(time.Hour); t.Before(to); t = t.Add(time.Hour) {
+			sum, n := 0.0, 0
+			for i := 0; i < 8; i++ {
+				if v, ok := hourly[t.Add(-time.Duration(i)*time.Hour).Unix()]; ok {
+					sum += v
+					n++
+				}
+			}
+			if n >= minHoursFor8h {
+				starts = append(starts, t.Unix())
+				values = append(values, sum/float64(n))
+			}
+		}
+		return starts, values, time.Hour
+	case 24 * time.Hour:
+		local := from.In(loc)
+		day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+			next := day.AddDate(0, 0, 1)
+			sum, n := 0.0, 0
+			for t := day.Truncate(time.Hour); t.Before(next); t = t.Add(time.Hour) {
+				if v, ok := hourly[t.Unix()]; ok {
+					sum += v
+					n++
+				}
+			}
+			if n >= minHoursFor24h {
+				starts = append(starts, day.Unix())
+				values = append(values, sum/float64(n))
+			}
+		}
+		return starts, values, 24 * time.Hour
+	}
+	for hour := range hourly {
+		if hour >= from.Truncate(time.Hour).Unix() && hour < to.Unix() {
+			starts = append(starts, hour)
+		}
+	}
+	slices.Sort(starts)
+	for _, hour := range starts {
+		values = append(values, hourly[hour])
+	}
+	return starts, values, time.Hour
+}
+
+// 按标准评价一项指标
+func evaluateCompliance(limit ComplianceLimit, hourly map[int64]float64, device *models.Device, from, to time.Time) ComplianceResult {
+	result := ComplianceResult{
+		Metric:      limit.Metric,
+		Name:        metricName(limit.Metric),
+		Unit:        limit.Unit,
+		Period:      periodLabel(limit.Period),
+		Min:         limit.Min,
+		Max:         limit.Max,
+		Exceedances: []Exceedance{},
+		Note:        limit.Note,
+	}
+	if limit.Seasonal != nil {
+		result.Seasonal = limit.Seasonal
+	}
+
+	starts, values, span := periodAverages(hourly, limit.Period, from, to, deviceLocation(device))
+	var worstDeviation, peakDeviation float64
+	var current *Exceedance
+	for i, start := range starts {
+		lo, hi := limit.bounds(DeriveSeason(time.Unix(start, 0), device))
+		value := values[i]
+		result.Evaluated++
+		deviation := math.Max(lo-value, value-hi)
+		if deviation > worstDeviation || result.Worst == nil {
+			worstDeviation = deviation
+			result.Worst = &values[i]
+		}
+		if deviation <= 0 {
+			current = nil
+			continue
+		}
+		result.Exceeded++
+		result.Duration += int64(span.Seconds())
+		end := time.Unix(start, 0).Add(span).Unix()
+		// 与上一个超标时间段相连时合并
+		if current != nil && current.End >= start {
+			current.End = end
+			if deviation > peakDeviation {
+				current.Peak, peakDeviation = value, deviation
+			}
+			continue
+		}
+		result.Exceedances = append(result.Exceedances, Exceedance{Start: start, End: end, Peak: value})
+		current, peakDeviation = &result.Exceedances[len(result.Exceedances)-1], deviation
+	}
+
+	switch {
+	case result.Evaluated == 0:
+		result.Status = "no_data"
+	case result.Exceeded > 0:
+		result.Status = "fail"
+	default:
+		result.Status = "pass"
+	}
+	return result
+}
+
+// 按 GB/T 18883-2022 评价设备在某时间段内的室内空气质量
+func (h *DataHandler) Compliance(c *gin.Context) {
+	deviceUUID := c.Query("device_id")
+	if deviceUUID == "" {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	// 管理员可查询任意设备，用户只能查询自己的设备
+	device := &models.Device{}
+	query := h.DB.Where("uuid = ?", deviceUUID)
+	_, isAdmin := c.Get("CurrentAdminUser")
+	if !isAdmin {
+		query = query.Where("owner_id = ?", c.MustGet("CurrentUser").(*models.User).UUID)
+	}
+	if err := query.First(device).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+
+	to := time.Now()
+	if t, err := time.Parse(time.RFC3339, c.Query("to")); err == nil {
+		to = t
+	}
+	from := to.Add(-7 * 24 * time.Hour)
+	if t, err := time.Parse(time.RFC3339, c.Query("from")); err == nil {
+		from = t
+	}
+	if !from.Before(to) || to.Sub(from) > 366*24*time.Hour {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+	if !isAdmin && device.DataVisibleFrom != nil && device.DataVisibleFrom.After(from) {
+		from = *device.DataVisibleFrom
+	}
+
+	// 只评价设备支持且单位与标准一致的指标
+	capabilities := deviceMetrics(device)
+	var limits []ComplianceLimit
+	var keys []string
+	for _, limit := range GBT18883 {
+		if !slices.Contains(capabilities, limit.Metric) {
+			continue
+		}
+		limits = append(limits, limit)
+		keys = append(keys, limit.Metric)
+	}
+
+	hourly, sources, err := h.hourlyAverages(c, device, from, to, keys)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	results := make([]ComplianceResult, 0, len(limits))
+	status := "no_data"
+	for _, limit := range limits {
+		var result ComplianceResult
+		if metric, ok := LookupMetric(limit.Metric); ok && metric.Unit != limit.Unit {
+			result = ComplianceResult{Metric: limit.Metric, Name: metricName(limit.Metric), Unit: limit.Unit, Period: periodLabel(limit.Period), Status: "unit_mismatch", Exceedances: []Exceedance{}}
+		} else {
+			result = evaluateCompliance(limit, hourly[limit.Metric], device, from, to)
+		}
+		// 任一指标超标即不达标，全部无数据时为无数据
+		switch {
+		case result.Status == "fail":
+			status = "fail"
+		case result.Status == "pass" && status == "no_data":
+			status = "pass"
+		}
+		results = append(results, result)
+	}
+
+	utils.Respond(c, gin.H{
+		"standard": "GB/T 18883-2022",
+		"from":     from.Unix(),
+		"to":       to.Unix(),
+		"sources":  sources,
+		"status":   status,
+		"metrics":  results,
+	}, utils.ErrOK)
+}
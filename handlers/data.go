@@ -5,244 +5,253 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"ssat_backend_rebuild/models"
 	"ssat_backend_rebuild/utils"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/patrickmn/go-cache"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"gorm.io/gorm"
 )
 
 type DataHandler struct {
-	MongoCollection     *mongo.Collection
-	MongoToSQLThreshold int
-	AiApiUrl            string
-	AiApiKey            string
+	MongoCollection        *mongo.Collection
+	QuarantineCollection   *mongo.Collection // 异常读数的隔离区
+	QuarantineInAggregates bool              // 超出场景阈值的异常读数在审核前是否计入统计
+	MongoToSQLThreshold    int
+	HistoryWindow          int         // 批量上传可接受的历史数据时间范围（秒）
+	BatchUploadMax         int         // 批量上传单次最多条数
+	Aggregator             *Aggregator // 后台聚合任务，为空时在上传请求中同步聚合
+	AggregationMode        string      // 聚合方式，count 或 window，默认为 count
+	FlushAge               int         // 未处理数据超过该时长（秒）后强制聚合
+	RawMaxPoints           int         // 原始读数查询单次最多返回条数
+	AiApiUrl               string
+	AiApiKey               string
 	BaseHandler[models.Data]
+
+	batchStore batchStore // 按条数聚合使用的存储，为空时使用 MongoDB 和 SQL 数据库
 }
 
 type DataUploadRequest struct {
-	DeviceID  string           `json:"device_id" binding:"required"`
-	Timestamp int64            `json:"timestamp" binding:"required"`
-	Data      models.DataEntry `json:"data" binding:"required"`
-	Season    string           `json:"season" binding:"required"` // 季节
-	Scene     string           `json:"scene" binding:"required"`  // 场景
-	Signature string           `json:"signature" binding:"required"`
+	DeviceID  string            `json:"device_id" binding:"required"`
+	Timestamp int64             `json:"timestamp" binding:"required"`
+	Data      *models.DataEntry `json:"data" binding:"required"`
+	Season    string            `json:"season"`                       // 季节，仅作参考，服务端根据日期和设备所在半球推算
+	Scene     string            `json:"scene"`                        // 场景，仅作参考，以设备记录的场景为准
+	Signature string            `json:"signature" binding:"required"` // md5(device_id:timestamp:sha256(规范形式):secret)，旧版 JSON 上传为 md5(device_id:timestamp:secret)
+	Reported  *TwinReport       `json:"reported"`                     // 设备当前已应用的配置
+
+	FirmwareVersion string `json:"firmware_version"` // 设备当前运行的固件版本
+	FirmwareError   string `json:"firmware_error"`   // 固件升级失败时的原因
 }
 
 type MongoData struct {
-	DeviceID  string           `json:"device_id" bson:"device_id"`
-	Timestamp int64            `json:"timestamp" bson:"timestamp"`
-	Data      models.DataEntry `json:"data" bson:"data"`
-	Processed bool             `json:"processed" bson:"processed"`
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	DeviceID  string             `json:"device_id" bson:"device_id"`
+	Timestamp int64              `json:"timestamp" bson:"timestamp"`
+	Data      models.DataEntry   `json:"data" bson:"data"`                             // 校准后的数据
+	RawData   *models.DataEntry  `json:"raw_data,omitempty" bson:"raw_data,omitempty"` // 校准前的原始数据
+	Processed bool               `json:"processed" bson:"processed"`
+	BatchID   string             `json:"batch_id,omitempty" bson:"batch_id,omitempty"`   // 所属统计数据的UUID
+	ClaimedAt int64              `json:"-" bson:"claimed_at,omitempty"`                  // 被批次认领的时间
+	Anomalous bool               `json:"anomalous,omitempty" bson:"anomalous,omitempty"` // 未经审核的异常读数，按配置计入统计
 }
 
 var DataCache = cache.New(5*time.Minute, 10*time.Minute)
-var deviceTimers = make(map[string]*time.Timer)
 
 // 计算最大值、最小值、平均值、方差
 func CalcStats(data []float32) (max, min, avg, variance float32) {
-	if len(data) == 0 {
-		return
-	}
-	max, min = data[0], data[0]
-	var sum float32
+	stats := RunningStats{}
 	for _, v := range data {
-		if v > max {
-			max = v
-		}
-		if v < min {
-			min = v
-		}
-		sum += v
+		stats.Add(float64(v))
 	}
-	avg = sum / float32(len(data))
-	for _, v := range data {
-		variance += (v - avg) * (v - avg)
+	if stats.Count == 0 {
+		return
 	}
-	variance /= float32(len(data))
-	return
+	return float32(stats.Max), float32(stats.Min), float32(stats.Mean), float32(stats.Variance())
 }
 
+// 计算每个字段的最大值、最小值、平均值、方差
 func CalcStatsForMongoData(data []MongoData) (maxEntry, minEntry, avgEntry, varEntry models.DataEntry) {
-	var temps, hums, freshAirs, ozones, nitroDios, methanals, pm25s, carbMomos, bacterias, radons []float32
-	for _, d := range data {
-		temps = append(temps, d.Data.Temperature)
-		hums = append(hums, d.Data.Humidity)
-		freshAirs = append(freshAirs, d.Data.FreshAir)
-		ozones = append(ozones, d.Data.Ozone)
-		nitroDios = append(nitroDios, d.Data.NitroDio)
-		methanals = append(methanals, d.Data.Methanal)
-		pm25s = append(pm25s, d.Data.Pm25)
-		carbMomos = append(carbMomos, d.Data.CarbMomo)
-		bacterias = append(bacterias, d.Data.Bacteria)
-		radons = append(radons, d.Data.Radon)
-	}
-	maxEntry.Temperature, minEntry.Temperature, avgEntry.Temperature, varEntry.Temperature = CalcStats(temps)
-	maxEntry.Humidity, minEntry.Humidity, avgEntry.Humidity, varEntry.Humidity = CalcStats(hums)
-	maxEntry.FreshAir, minEntry.FreshAir, avgEntry.FreshAir, varEntry.FreshAir = CalcStats(freshAirs)
-	maxEntry.Ozone, minEntry.Ozone, avgEntry.Ozone, varEntry.Ozone = CalcStats(ozones)
-	maxEntry.NitroDio, minEntry.NitroDio, avgEntry.NitroDio, varEntry.NitroDio = CalcStats(nitroDios)
-	maxEntry.Methanal, minEntry.Methanal, avgEntry.Methanal, varEntry.Methanal = CalcStats(methanals)
-	maxEntry.Pm25, minEntry.Pm25, avgEntry.Pm25, varEntry.Pm25 = CalcStats(pm25s)
-	maxEntry.CarbMomo, minEntry.CarbMomo, avgEntry.CarbMomo, varEntry.CarbMomo = CalcStats(carbMomos)
-	maxEntry.Bacteria, minEntry.Bacteria, avgEntry.Bacteria, varEntry.Bacteria = CalcStats(bacterias)
-	maxEntry.Radon, minEntry.Radon, avgEntry.Radon, varEntry.Radon = CalcStats(radons)
-	return maxEntry, minEntry, avgEntry, varEntry
+	summary := SummarizeReadings(data)
+	return summary.Max, summary.Min, summary.Avg, summary.Var
 }
 
-func (h *DataHandler) Upload(c *gin.Context) {
-	// 解析请求体
-	var reqBody DataUploadRequest
-	if err := c.ShouldBindJSON(&reqBody); err != nil {
-		utils.Respond(c, nil, utils.ErrMissingParam)
-		return
+// 校验设备请求：签名为 md5(device_id:timestamp[:extra...]:secret)，时间戳一分钟内有效且签名不可重复使用。
+// 校验失败时已写入响应并返回 false
+func authenticateDevice(c *gin.Context, db *gorm.DB, deviceID string, timestamp int64, signature string, extra ...string) (*models.Device, bool) {
+	return authenticateDeviceWith(c, db, deviceID, timestamp, signature, extra)
+}
+
+// 设备请求的签名 md5(device_id:timestamp[:extra...]:secret)
+func deviceSignature(deviceID string, timestamp int64, secret string, extra []string) string {
+	payload := fmt.Sprintf("%s:%d", deviceID, timestamp)
+	for _, part := range extra {
+		payload += ":" + part
 	}
+	hash := md5.Sum([]byte(payload + ":" + secret))
+	return hex.EncodeToString(hash[:])
+}
 
+// 与 authenticateDevice 相同，签名与 accepted 中任一组 extra 匹配即通过
+func authenticateDeviceWith(c *gin.Context, db *gorm.DB, deviceID string, timestamp int64, signature string, accepted ...[]string) (*models.Device, bool) {
 	// 验证设备ID
 	device := &models.Device{}
-	if err := h.DB.First(device, "device_id = ?", reqBody.DeviceID).Error; err != nil {
+	if err := db.First(device, "device_id = ?", deviceID).Error; err != nil {
 		utils.Respond(c, nil, utils.ErrUnknownDevice)
-		return
+		return nil, false
 	}
 	c.Set("CurrentDevice", device)
 
 	// 校验时间戳
-	if time.Since(time.Unix(reqBody.Timestamp, 0)) > time.Minute {
+	if time.Since(time.Unix(timestamp, 0)) > time.Minute {
 		utils.Respond(c, nil, utils.ErrExpiredRequest)
-		return
+		return nil, false
 	}
 
 	// 验证签名
-	hash := md5.Sum([]byte(fmt.Sprintf("%s:%d:%s", reqBody.DeviceID, reqBody.Timestamp, device.Secret)))
-	hashedSignature := hex.EncodeToString(hash[:])
-	if reqBody.Signature != hashedSignature {
+	if !slices.ContainsFunc(accepted, func(extra []string) bool {
+		return signature == deviceSignature(deviceID, timestamp, device.Secret, extra)
+	}) {
 		utils.Respond(c, nil, utils.ErrInvalidSignature)
-		return
+		return nil, false
 	}
 
 	// 记录签名，防止重放攻击
-	if _, found := DataCache.Get(reqBody.Signature); found {
+	if _, found := DataCache.Get(signature); found {
 		utils.Respond(c, nil, utils.ErrReplayAttack)
-		return
+		return nil, false
 	}
-	DataCache.Set(reqBody.Signature, true, 2*time.Minute)
+	DataCache.Set(signature, true, 2*time.Minute)
 
-	// 校验数据
-	anomalyResult := CheckDataAnomaly(reqBody.Data, reqBody.Scene, reqBody.Season)
+	return device, true
+}
 
-	if !anomalyResult.IsNormal {
-		// log.Printf("检测到异常数据: %v", anomalyResult.AnomalyFields)
-		// log.Printf("异常详情: %v", anomalyResult.AnomalyDetails)
-		utils.Respond(c, gin.H{
-			"anomaly_fields":  anomalyResult.AnomalyFields,
-			"anomaly_details": anomalyResult.AnomalyDetails,
-		}, utils.ErrDataAnomaly)
-		device.Status = 3 // 设置设备状态为异常
-		if err := h.DB.Save(device).Error; err != nil {
-			utils.Respond(c, nil, utils.ErrInternalServer)
-			return
-		}
-		return
+// 单条上传可接受的签名内容。已部署的设备以 JSON 上传时按 md5(device_id:timestamp:secret) 签名，
+// 继续兼容；CBOR、Protobuf 上传或请求头 X-Signature-Version 为 2 时必须签名规范形式
+func uploadSignatures(c *gin.Context, req *DataUploadRequest) [][]string {
+	accepted := [][]string{{canonicalDigest(req.canonical())}}
+	contentType := c.ContentType()
+	if contentType != MIMECBOR && contentType != MIMEProtobuf && c.GetHeader("X-Signature-Version") != "2" {
+		accepted = append(accepted, nil)
 	}
+	return accepted
+}
 
-	// 创建数据记录
-	mongoData := MongoData{
-		DeviceID:  reqBody.DeviceID,
-		Timestamp: reqBody.Timestamp,
-		Data:      reqBody.Data,
-		Processed: false,
+func (h *DataHandler) Upload(c *gin.Context) {
+	// 解析请求体
+	var reqBody DataUploadRequest
+	if err := bindDeviceRequest(c, &reqBody); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
 	}
-	if _, err := h.MongoCollection.InsertOne(c, mongoData); err != nil {
-		utils.Respond(c, nil, utils.ErrInternalServer)
+
+	// 验证设备与签名
+	device, ok := authenticateDeviceWith(c, h.DB, reqBody.DeviceID, reqBody.Timestamp, reqBody.Signature, uploadSignatures(c, &reqBody)...)
+	if !ok {
 		return
 	}
 
-	filter := bson.M{"device_id": reqBody.DeviceID, "processed": false}
-	count, err := h.MongoCollection.CountDocuments(c, filter)
+	// 校验并保存数据，场景和季节以服务端记录为准
+	result, err := h.ingestReading(c, device, reqBody.Timestamp, *reqBody.Data, reqBody.Scene, reqBody.Season)
+	if errors.Is(err, errEmptyReading) {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
 	if err != nil {
 		utils.Respond(c, nil, utils.ErrInternalServer)
 		return
 	}
-	// log.Println(count)
-
-	if count >= int64(h.MongoToSQLThreshold) {
-		log.Println("数据超过阈值，开始处理")
-		// 获取未处理的数据
-		cursor, err := h.MongoCollection.Find(c, filter)
-		if err != nil {
+	if result.Anomaly != nil {
+		if err := h.markAnomalous(device); err != nil {
 			utils.Respond(c, nil, utils.ErrInternalServer)
 			return
 		}
-		defer cursor.Close(c)
-
-		// 计算数据统计信息
-		var mongoDataList []MongoData
-		if err := cursor.All(c, &mongoDataList); err != nil {
-			utils.Respond(c, nil, utils.ErrInternalServer)
-			return
-		}
-		maxEntry, minEntry, avgEntry, varEntry := CalcStatsForMongoData(mongoDataList)
-
-		// 根据 DeviceID 查询设备
-		device := &models.Device{}
-		if err := h.DB.First(device, "device_id = ?", reqBody.DeviceID).Error; err != nil {
-			utils.Respond(c, nil, utils.ErrUnknownDevice)
-			return
+		if result.Aggregated {
+			if err := h.scheduleAggregation(c, device); err != nil {
+				utils.Respond(c, nil, utils.ErrInternalServer)
+				return
+			}
 		}
+		utils.Respond(c, gin.H{
+			"anomaly_fields":  result.Anomaly.AnomalyFields,
+			"anomaly_details": result.Anomaly.AnomalyDetails,
+			"quarantined":     true,
+		}, utils.ErrDataAnomaly)
+		return
+	}
 
-		// 将统计学数据插入到 SQL 数据库
-		data := models.Data{
-			MyDevice: device,
-			Avg:      avgEntry,
-			Var:      varEntry,
-			Min:      minEntry,
-			Max:      maxEntry,
-		}
-		if err := h.DB.Create(&data).Error; err != nil {
-			utils.Respond(c, nil, utils.ErrInternalServer)
-			return
-		}
+	if err := h.scheduleAggregation(c, device); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
 
-		// 更新 MongoDB 中的数据为已处理
-		if _, err := h.MongoCollection.UpdateMany(c, filter, map[string]any{"$set": map[string]any{"processed": true}}); err != nil {
-			utils.Respond(c, nil, utils.ErrInternalServer)
-			return
-		}
+	if err := h.markReceived(device); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
 	}
 
-	// if err := h.DB.Create(&reqBody).Error; err != nil {
-	// 	utils.Respond(c, nil, utils.ErrInternalServer)
-	// 	return
-	// }
+	response := gin.H{"scene": result.Scene, "season": result.Season}
+	if result.AQI != nil {
+		response["aqi"] = result.AQI
+	}
 
-	// 更新设备的最后接收时间
-	now := time.Now()
-	device.LastReceived = &now
+	// 同步设备孪生，返回期望配置与上报配置的差异
+	twin, err := SyncTwinOnUpload(h.DB, device, reqBody.Reported)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	if twin != nil {
+		response["twin"] = twin
+	}
 
-	// 更新设备的状态
-	device.Status = 1
-	deviceID := device.DeviceID
-	if timer, ok := deviceTimers[deviceID]; ok {
-		timer.Stop() // 停止旧定时器
+	// 顺带下发待执行的指令
+	commands, err := DeliverCommands(h.DB, device)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	if len(commands) > 0 {
+		response["commands"] = commands
 	}
-	deviceTimers[deviceID] = time.AfterFunc(time.Minute, func() {
-		// 1分钟后执行
-		h.DB.Model(&models.Device{}).Where("device_id = ?", deviceID).Update("status", 0)
-	})
 
-	if err := h.DB.Save(device).Error; err != nil {
+	// 记录固件版本并推送待升级的固件
+	firmware, err := OfferFirmware(h.DB, device, reqBody.FirmwareVersion, reqBody.FirmwareError)
+	if err != nil {
 		utils.Respond(c, nil, utils.ErrInternalServer)
 		return
 	}
+	if firmware != nil {
+		response["firmware"] = firmware
+	}
+
+	utils.Respond(c, response, utils.ErrOK)
+}
 
-	utils.Respond(c, nil, utils.ErrOK)
+// 按时间粒度过滤统计数据。未指定时只返回最细粒度的数据（按条数聚合的批次和 5 分钟窗口），
+// 避免与小时、天统计数据重复计算
+func filterResolution(query *gorm.DB, resolution string, column string) *gorm.DB {
+	switch resolution {
+	case "":
+		return query.Where(column+" IN ?", []string{models.ResolutionBatch, models.Resolution5Min})
+	case "batch":
+		return query.Where(column+" = ?", models.ResolutionBatch)
+	}
+	return query.Where(column+" = ?", resolution)
+}
+
+// 按统计数据的时间筛选：使用时间窗口起点，旧数据没有时间窗口时使用写入时间
+func whereDataTime(query *gorm.DB, prefix, op string, t time.Time) *gorm.DB {
+	return query.Where(fmt.Sprintf("(%[1]swindow_start %[2]s ? OR (%[1]swindow_start IS NULL AND %[1]screated_at %[2]s ?))", prefix, op), t, t)
 }
 
 func (h *DataHandler) List(c *gin.Context) {
@@ -257,13 +266,14 @@ func (h *DataHandler) List(c *gin.Context) {
 			if deviceId != "" {
 				query = query.Where("my_device_id = ?", deviceId)
 			}
+			query = filterResolution(query, c.Query("resolution"), "resolution")
 			if before, err := time.Parse(time.RFC3339, before); err == nil {
-				query = query.Where("created_at < ?", before)
+				query = whereDataTime(query, "", "<", before)
 			}
 			if after, err := time.Parse(time.RFC3339, after); err == nil {
-				query = query.Where("created_at > ?", after)
+				query = whereDataTime(query, "", ">", after)
 			}
-			return query
+			return filterByLocation(c, h.DB, query, "my_device_id")
 		},
 	)(c)
 }
@@ -272,6 +282,12 @@ func (h *DataHandler) MyData(c *gin.Context) {
 	h.BaseHandler.List(
 		nil,
 		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			// 只返回当前用户名下设备、且在可见时间范围内的数据
+			query = query.Where(
+				"EXISTS (SELECT 1 FROM devices WHERE devices.uuid = data.my_device_id AND devices.owner_id = ? AND (devices.data_visible_from IS NULL OR devices.data_visible_from <= COALESCE(data.window_start, data.created_at)))",
+				c.MustGet("CurrentUser").(*models.User).UUID,
+			)
+
 			// 通过设备ID查询数据
 			deviceId := c.Query("device_id")
 			before := c.Query("before")
@@ -280,47 +296,99 @@ func (h *DataHandler) MyData(c *gin.Context) {
 			if deviceId != "" {
 				query = query.Where("my_device_id = ?", deviceId)
 			}
+			query = filterResolution(query, c.Query("resolution"), "resolution")
 			if before, err := time.Parse(time.RFC3339, before); err == nil {
-				query = query.Where("created_at < ?", before)
+				query = whereDataTime(query, "", "<", before)
 			}
 			if after, err := time.Parse(time.RFC3339, after); err == nil {
-				query = query.Where("created_at > ?", after)
+				query = whereDataTime(query, "", ">", after)
 			}
-			return query
+			return filterByLocation(c, h.DB, query, "my_device_id")
 		},
 	)(c)
 }
 
+// 按位置层级（组织/站点/楼层/房间）统计某项数据
+func (h *DataHandler) GroupStats(c *gin.Context) {
+	metric := c.DefaultQuery("metric", "pm2_5")
+	if _, ok := LookupMetric(metric); !ok {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+
+	// 分组列及其在结果中的名称
+	groupColumns := map[string][][2]string{
+		"organization": {{"sites.organization_uuid", "organization_uuid"}},
+		"site":         {{"rooms.site_uuid", "site_uuid"}},
+		"floor":        {{"rooms.site_uuid", "site_uuid"}, {"rooms.floor", "floor"}},
+		"room":         {{"rooms.uuid", "room_uuid"}},
+	}
+	groupBy, ok := groupColumns[c.DefaultQuery("group_by", "room")]
+	if !ok {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+
+	query := h.DB.Table("data").
+		Joins("JOIN devices ON devices.uuid = data.my_device_id").
+		Joins("JOIN rooms ON rooms.uuid = devices.room_uuid").
+		Joins("JOIN sites ON sites.uuid = rooms.site_uuid")
+	query = filterByLocation(c, h.DB, query, "data.my_device_id")
+	query = filterResolution(query, c.Query("resolution"), "data.resolution")
+	if before, err := time.Parse(time.RFC3339, c.Query("before")); err == nil {
+		query = whereDataTime(query, "data.", "<", before)
+	}
+	if after, err := time.Parse(time.RFC3339, c.Query("after")); err == nil {
+		query = whereDataTime(query, "data.", ">", after)
+	}
+
+	selects := make([]string, 0, len(groupBy)+4)
+	groups := make([]string, 0, len(groupBy))
+	for _, col := range groupBy {
+		selects = append(selects, fmt.Sprintf("%s AS %s", col[0], col[1]))
+		groups = append(groups, col[0])
+	}
+	// 平均值按各条统计数据的读数条数加权，旧数据没有条数时按一条计
+	avg, weight := metricColumn("data.avg", metric), "GREATEST(data.count, 1)"
+	selects = append(selects,
+		fmt.Sprintf("SUM(%[1]s * %[2]s) / SUM(IF(%[1]s IS NULL, 0, %[2]s)) AS avg", avg, weight),
+		fmt.Sprintf("MIN(%s) AS min", metricColumn("data.min", metric)),
+		fmt.Sprintf("MAX(%s) AS max", metricColumn("data.max", metric)),
+		"COUNT(*) AS count",
+	)
+
+	var rows []map[string]any
+	if err := query.Select(strings.Join(selects, ", ")).Group(strings.Join(groups, ", ")).Find(&rows).Error; err != nil {
+		log.Println("统计分组数据失败：", err)
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	utils.Respond(c, gin.H{"metric": metric, "items": rows}, utils.ErrOK)
+}
+
 type DataAnalysisRequest struct {
-	DeviceID  string `json:"device_id" binding:"required"`   // 设备id
-	Type      string `json:"report_type" binding:"required"` // 分析类型
-	StartTime string `json:"start_time" binding:"required"`  // 开始时间（ISO8601格式）
-	EndTime   string `json:"end_time" binding:"required"`    // 结束时间（ISO8601格式）
-	Model     string `json:"model" binding:"required"`       // 使用的模型
+	DeviceID   string `json:"device_id" binding:"required"`   // 设备id
+	Type       string `json:"report_type" binding:"required"` // 分析类型
+	StartTime  string `json:"start_time" binding:"required"`  // 开始时间（ISO8601格式）
+	EndTime    string `json:"end_time" binding:"required"`    // 结束时间（ISO8601格式）
+	Model      string `json:"model" binding:"required"`       // 使用的模型
+	Resolution string `json:"resolution"`                     // 统计数据的时间粒度，为空时使用最细粒度
 }
 
 func getAIPrompt(req DataAnalysisRequest, dataList []models.Data) string {
 	// 多段统计摘要
 	summary := "本时段各统计段数据如下(每一项数据中的四个数据点分别代表平均值、方差、最小值、最大值)\n"
 	for i, data := range dataList {
-		avg := data.Avg
-		variance := data.Var
-		min := data.Min
-		max := data.Max
-		summary += fmt.Sprintf(
-			"#%d 温度[%.2f,%.2f,%.2f,%.2f] 湿度[%.2f,%.2f,%.2f,%.2f] 新风[%.2f,%.2f,%.2f,%.2f] 臭氧[%.2f,%.2f,%.2f,%.2f] 二氧化氮[%.2f,%.2f,%.2f,%.2f] 甲醛[%.2f,%.2f,%.2f,%.2f] PM2.5[%.2f,%.2f,%.2f,%.2f] 一氧化碳[%.2f,%.2f,%.2f,%.2f] 细菌[%.2f,%.2f,%.2f,%.2f] 氡气[%.2f,%.2f,%.2f,%.2f];",
-			i+1,
-			avg.Temperature, variance.Temperature, min.Temperature, max.Temperature,
-			avg.Humidity, variance.Humidity, min.Humidity, max.Humidity,
-			avg.FreshAir, variance.FreshAir, min.FreshAir, max.FreshAir,
-			avg.Ozone, variance.Ozone, min.Ozone, max.Ozone,
-			avg.NitroDio, variance.NitroDio, min.NitroDio, max.NitroDio,
-			avg.Methanal, variance.Methanal, min.Methanal, max.Methanal,
-			avg.Pm25, variance.Pm25, min.Pm25, max.Pm25,
-			avg.CarbMomo, variance.CarbMomo, min.CarbMomo, max.CarbMomo,
-			avg.Bacteria, variance.Bacteria, min.Bacteria, max.Bacteria,
-			avg.Radon, variance.Radon, min.Radon, max.Radon,
-		)
+		summary += fmt.Sprintf("#%d", i+1)
+		for _, key := range data.Avg.Keys() {
+			avg, _ := data.Avg.Get(key)
+			variance, _ := data.Var.Get(key)
+			lo, _ := data.Min.Get(key)
+			hi, _ := data.Max.Get(key)
+			summary += fmt.Sprintf(" %s[%.2f,%.2f,%.2f,%.2f]", metricName(key), avg, variance, lo, hi)
+		}
+		summary += ";"
 	}
 
 	switch req.Type {
@@ -356,11 +424,12 @@ func (h *DataHandler) Analysis(c *gin.Context) {
 	query := h.DB.Model(&models.Data{})
 	query = query.Where("my_device_id = ?", req.DeviceID)
 	if startTime, err := time.Parse(time.RFC3339, req.StartTime); err == nil {
-		query = query.Where("created_at > ?", startTime)
+		query = whereDataTime(query, "", ">", startTime)
 	}
 	if endTime, err := time.Parse(time.RFC3339, req.EndTime); err == nil {
-		query = query.Where("created_at < ?", endTime)
+		query = whereDataTime(query, "", "<", endTime)
 	}
+	query = filterResolution(query, req.Resolution, "resolution")
 
 	// 查询数据
 	var dataList []models.Data
@@ -481,11 +550,12 @@ func (h *DataHandler) MyAnalysis(c *gin.Context) {
 	query := h.DB.Model(&models.Data{})
 	query = query.Where("my_device_id = ?", device.UUID) // 使用设备的UUID
 	if startTime, err := time.Parse(time.RFC3339, req.StartTime); err == nil {
-		query = query.Where("created_at > ?", startTime)
+		query = whereDataTime(query, "", ">", startTime)
 	}
 	if endTime, err := time.Parse(time.RFC3339, req.EndTime); err == nil {
-		query = query.Where("created_at < ?", endTime)
+		query = whereDataTime(query, "", "<", endTime)
 	}
+	query = filterResolution(query, req.Resolution, "resolution")
 
 	// 查询数据
 	var dataList []models.Data
@@ -571,102 +641,12 @@ type DataRange struct {
 	Max float32
 }
 
-type SeasonData struct {
-	Temperature DataRange
-	Humidity    DataRange
-	FreshAir    DataRange
-	Ozone       DataRange
-	NitroDio    DataRange
-	Methanal    DataRange
-	Pm25        DataRange
-	CarbMomo    DataRange
-	Bacteria    DataRange
-	Radon       DataRange
-}
+// 各指标的正常范围，未列出的指标不检查
+type SeasonData map[string]DataRange
 
+// 各场景在各季节下的阈值
 type SceneConfig map[string]map[string]SeasonData
 
-var SCENES = SceneConfig{
-	"family": {
-		"winter": SeasonData{
-			Temperature: DataRange{16, 22},
-			Humidity:    DataRange{30, 50},
-			FreshAir:    DataRange{0.5, 1.0},
-			Ozone:       DataRange{0.019, 0.031},
-			NitroDio:    DataRange{0.017, 0.032},
-			Methanal:    DataRange{0.021, 0.085},
-			Pm25:        DataRange{15.214, 40.032},
-			CarbMomo:    DataRange{0.601, 4.054},
-			Bacteria:    DataRange{120, 800},
-			Radon:       DataRange{1.245, 3.519},
-		},
-		"summer": SeasonData{
-			Temperature: DataRange{24, 28},
-			Humidity:    DataRange{40, 70},
-			FreshAir:    DataRange{1.0, 1.5},
-			Ozone:       DataRange{0.028, 0.054},
-			NitroDio:    DataRange{0.021, 0.051},
-			Methanal:    DataRange{0.032, 0.112},
-			Pm25:        DataRange{10.012, 45.564},
-			CarbMomo:    DataRange{0.512, 3.521},
-			Bacteria:    DataRange{100, 600},
-			Radon:       DataRange{1.065, 3.041},
-		},
-	},
-	"lab": {
-		"winter": SeasonData{
-			Temperature: DataRange{15, 20},
-			Humidity:    DataRange{40, 55},
-			FreshAir:    DataRange{2.0, 3.0},
-			Ozone:       DataRange{0.005, 0.015},
-			NitroDio:    DataRange{0.005, 0.015},
-			Methanal:    DataRange{0.014, 0.049},
-			Pm25:        DataRange{6.140, 15.001},
-			CarbMomo:    DataRange{0.122, 1.575},
-			Bacteria:    DataRange{60, 400},
-			Radon:       DataRange{0.654, 1.525},
-		},
-		"summer": SeasonData{
-			Temperature: DataRange{20, 24},
-			Humidity:    DataRange{45, 60},
-			FreshAir:    DataRange{2.5, 4.0},
-			Ozone:       DataRange{0.018, 0.028},
-			NitroDio:    DataRange{0.017, 0.028},
-			Methanal:    DataRange{0.014, 0.055},
-			Pm25:        DataRange{5.235, 18.002},
-			CarbMomo:    DataRange{0.185, 1.810},
-			Bacteria:    DataRange{50, 350},
-			Radon:       DataRange{0.540, 1.800},
-		},
-	},
-	"greenhouse": {
-		"winter": SeasonData{
-			Temperature: DataRange{15, 25},
-			Humidity:    DataRange{45, 75},
-			FreshAir:    DataRange{1.0, 2.0},
-			Ozone:       DataRange{0.015, 0.034},
-			NitroDio:    DataRange{0.019, 0.031},
-			Methanal:    DataRange{0.010, 0.041},
-			Pm25:        DataRange{12.201, 35.203},
-			CarbMomo:    DataRange{0.201, 2.530},
-			Bacteria:    DataRange{120, 700},
-			Radon:       DataRange{0.650, 2.510},
-		},
-		"summer": SeasonData{
-			Temperature: DataRange{20, 30},
-			Humidity:    DataRange{50, 80},
-			FreshAir:    DataRange{1.5, 3.0},
-			Ozone:       DataRange{0.011, 0.041},
-			NitroDio:    DataRange{0.019, 0.041},
-			Methanal:    DataRange{0.015, 0.052},
-			Pm25:        DataRange{10.325, 38.914},
-			CarbMomo:    DataRange{0.284, 2.857},
-			Bacteria:    DataRange{100, 750},
-			Radon:       DataRange{0.549, 2.875},
-		},
-	},
-}
-
 // 检查单个数值是否在范围内
 func isInRange(value float32, dataRange DataRange) bool {
 	return value >= dataRange.Min && value <= dataRange.Max
@@ -679,8 +659,8 @@ type AnomalyResult struct {
 	AnomalyDetails map[string]string `json:"anomaly_details"`
 }
 
-// 判断数据是否正常的函数
-func CheckDataAnomaly(data models.DataEntry, scene, season string) AnomalyResult {
+// 判断数据是否正常，metrics 为需要检查的指标
+func CheckDataAnomaly(data models.DataEntry, scene, season string, metrics []string) AnomalyResult {
 	result := AnomalyResult{
 		IsNormal:       true,
 		AnomalyFields:  []string{},
@@ -688,7 +668,7 @@ func CheckDataAnomaly(data models.DataEntry, scene, season string) AnomalyResult
 	}
 
 	// 检查场景和季节是否存在
-	sceneData, exists := SCENES[scene]
+	sceneData, exists := lookupScene(scene)
 	if !exists {
 		result.IsNormal = false
 		result.AnomalyFields = append(result.AnomalyFields, "scene")
@@ -696,40 +676,31 @@ func CheckDataAnomaly(data models.DataEntry, scene, season string) AnomalyResult
 		return result
 	}
 
-	seasonData, exists := sceneData[season]
-	if !exists {
+	// 场景缺少该季节的阈值时使用相邻季节的阈值
+	seasonData := seasonThresholds(sceneData, season)
+	if !slices.Contains(Seasons, season) {
 		result.IsNormal = false
 		result.AnomalyFields = append(result.AnomalyFields, "season")
 		result.AnomalyDetails["season"] = "未知季节类型"
 		return result
 	}
 
-	// 检查各项数据是否在正常范围内
-	checks := map[string]struct {
-		value  float32
-		range_ DataRange
-	}{
-		"temperature": {data.Temperature, seasonData.Temperature},
-		"humidity":    {data.Humidity, seasonData.Humidity},
-		"fresh_air":   {data.FreshAir, seasonData.FreshAir},
-		"ozone":       {data.Ozone, seasonData.Ozone},
-		"nitro_dio":   {data.NitroDio, seasonData.NitroDio},
-		"methanal":    {data.Methanal, seasonData.Methanal},
-		"pm2_5":       {data.Pm25, seasonData.Pm25},
-		"carb_momo":   {data.CarbMomo, seasonData.CarbMomo},
-		"bacteria":    {data.Bacteria, seasonData.Bacteria},
-		"radon":       {data.Radon, seasonData.Radon},
-	}
-
-	for fieldName, check := range checks {
-		if !isInRange(check.value, check.range_) {
-			result.IsNormal = false
-			result.AnomalyFields = append(result.AnomalyFields, fieldName)
-			result.AnomalyDetails[fieldName] = fmt.Sprintf(
-				"数值%.3f超出正常范围[%.3f, %.3f]",
-				check.value, check.range_.Min, check.range_.Max,
-			)
+	// 检查设备支持的各项指标是否在正常范围内
+	for _, key := range metrics {
+		dataRange, exists := seasonData[key]
+		if !exists {
+			continue
 		}
+		value, ok := data.Get(key)
+		if !ok || isInRange(value, dataRange) {
+			continue
+		}
+		result.IsNormal = false
+		result.AnomalyFields = append(result.AnomalyFields, key)
+		result.AnomalyDetails[key] = fmt.Sprintf(
+			"数值%.3f超出正常范围[%.3f, %.3f]",
+			value, dataRange.Min, dataRange.Max,
+		)
 	}
 
 	return result
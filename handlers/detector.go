@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"ssat_backend_rebuild/models"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm/clause"
+)
+
+// 每台设备每项指标保留的历史读数条数，用于计算基线
+const detectorHistorySize = 200
+
+// 连续多少条同方向偏离基线的异常读数后视为数值发生阶跃变化，以这些读数替换基线，使基线能适应新的水平
+const baselineShiftCount = 10
+
+// 历史读数
+type HistoryPoint struct {
+	Time  int64
+	Value float64
+}
+
+// 检测时的输入
+type DetectionInput struct {
+	Device    *models.Device
+	Timestamp int64
+	Data      models.DataEntry
+	Scene     string
+	Season    string
+	Metrics   []string                        // 需要检查的指标
+	History   func(key string) []HistoryPoint // 该时间之前的历史读数，按时间升序
+}
+
+// 异常检测器。Detect 返回异常指标及原因，sensitivity 为 0 时使用默认阈值
+type Detector interface {
+	Detect(input *DetectionInput, sensitivity float64) map[string]string
+}
+
+// 已注册的检测器
+var detectors = map[string]Detector{
+	"range":    rangeDetector{},
+	"zscore":   zscoreDetector{},
+	"mad":      madDetector{},
+	"rate":     rateDetector{},
+	"flatline": flatlineDetector{},
+}
+
+// 未配置检测器时只按场景阈值检测
+var defaultDetectors = []models.DetectorSetting{{Name: "range"}}
+
+// 注册新的检测器
+func RegisterDetector(name string, detector Detector) {
+	detectors[name] = detector
+}
+
+// 场景阈值检测：按场景和季节的静态范围检查
+type rangeDetector struct{}
+
+func (rangeDetector) Detect(input *DetectionInput, sensitivity float64) map[string]string {
+	result := CheckDataAnomaly(input.Data, input.Scene, input.Season, input.Metrics)
+	return result.AnomalyDetails
+}
+
+// 滚动 z 值检测：偏离近期均值超过 sensitivity 个标准差（默认 3）
+type zscoreDetector struct{}
+
+func (zscoreDetector) Detect(input *DetectionInput, sensitivity float64) map[string]string {
+	threshold := sensitivity
+	if threshold <= 0 {
+		threshold = 3
+	}
+	details := make(map[string]string)
+	for _, key := range input.Metrics {
+		value, ok := input.Data.Get(key)
+		history := input.History(key)
+		if !ok || len(history) < 20 {
+			continue
+		}
+		stats := RunningStats{}
+		for _, point := range history {
+			stats.Add(point.Value)
+		}
+		std := math.Sqrt(stats.Variance())
+		if std == 0 {
+			continue
+		}
+		if z := math.Abs(float64(value)-stats.Mean) / std; z > threshold {
+			details[key] = fmt.Sprintf("偏离近期均值%.1f个标准差", z)
+		}
+	}
+	return details
+}
+
+// 滚动 MAD 检测：稳健 z 值（0.6745 × 偏差 / 中位数绝对偏差）超过 sensitivity（默认 3.5）
+type madDetector struct{}
+
+func (madDetector) Detect(input *DetectionInput, sensitivity float64) map[string]string {
+	threshold := sensitivity
+	if threshold <= 0 {
+		threshold = 3.5
+	}
+	details := make(map[string]string)
+	for _, key := range input.Metrics {
+		value, ok := input.Data.Get(key)
+		history := input.History(key)
+		if !ok || len(history) < 20 {
+			continue
+		}
+		values := make([]float64, len(history))
+		for i, point := range history {
+			values[i] = point.Value
+		}
+		sort.Float64s(values)
+		median := percentile(values, 0.5)
+		for i := range values {
+			values[i] = math.Abs(values[i] - median)
+		}
+		sort.Float64s(values)
+		mad := percentile(values, 0.5)
+		if mad == 0 {
+			continue
+		}
+		if z := 0.6745 * math.Abs(float64(value)-median) / mad; z > threshold {
+			details[key] = fmt.Sprintf("偏离近期中位数（稳健 z 值 %.1f）", z)
+		}
+	}
+	return details
+}
+
+// 变化率检测：与上一条读数相比每分钟变化量超过指标的 MaxRate × sensitivity（默认 1 倍）
+type rateDetector struct{}
+
+func (rateDetector) Detect(input *DetectionInput, sensitivity float64) map[string]string {
+	factor := sensitivity
+	if factor <= 0 {
+		factor = 1
+	}
+	details := make(map[string]string)
+	for _, key := range input.Metrics {
+		metric, registered := LookupMetric(key)
+		value, ok := input.Data.Get(key)
+		history := input.History(key)
+		if !registered || metric.MaxRate == nil || !ok || len(history) == 0 {
+			continue
+		}
+		// 间隔过长时变化率没有意义
+		last := history[len(history)-1]
+		elapsed := float64(input.Timestamp-last.Time) / 60
+		if elapsed <= 0 || elapsed > 60 {
+			continue
+		}
+		limit := *metric.MaxRate * factor
+		if rate := math.Abs(float64(value)-last.Value) / math.Max(elapsed, 1.0/60); rate > limit {
+			details[key] = fmt.Sprintf("每分钟变化%.3f，超过上限%.3f", rate, limit)
+		}
+	}
+	return details
+}
+
+// 卡值检测：连续 sensitivity 条（默认 30）读数数值完全相同，通常为传感器故障
+type flatlineDetector struct{}
+
+func (flatlineDetector) Detect(input *DetectionInput, sensitivity float64) map[string]string {
+	count := int(sensitivity)
+	if count <= 1 {
+		count = 30
+	}
+	details := make(map[string]string)
+	for _, key := range input.Metrics {
+		value, ok := input.Data.Get(key)
+		history := input.History(key)
+		if !ok || len(history) < count-1 {
+			continue
+		}
+		stuck := true
+		for _, point := range history[len(history)-(count-1):] {
+			if point.Value != float64(value) {
+				stuck = false
+				break
+			}
+		}
+		if stuck {
+			details[key] = fmt.Sprintf("连续%d条读数数值不变", count)
+		}
+	}
+	return details
+}
+
+// 各设备的历史读数，按指标保存，首次使用时从已保存的读数加载
+type deviceHistory struct {
+	sync.Mutex
+	metrics map[string][]HistoryPoint
+	streaks map[string][]HistoryPoint // 各指标连续的异常读数，出现正常读数时清空
+}
+
+// 设备历史缓存在进程内，只在首次使用时加载。基线的阶跃记录保存在 DetectorBaseline 中，重启后可以恢复；
+// 多实例部署时其他实例已加载的历史不会同步阶跃，需在重新加载后才使用新的基线
+var detectorHistory sync.Map // device_id -> *deviceHistory
+
+func (h *DataHandler) loadHistory(ctx context.Context, device *models.Device) (*deviceHistory, error) {
+	if value, ok := detectorHistory.Load(device.DeviceID); ok {
+		return value.(*deviceHistory), nil
+	}
+
+	// 未审核的异常读数不参与基线
+	filter := bson.M{"device_id": device.DeviceID, "anomalous": bson.M{"$ne": true}}
+	cursor, err := h.MongoCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetLimit(detectorHistorySize))
+	if err != nil {
+		return nil, err
+	}
+	var readings []MongoData
+	if err := cursor.All(ctx, &readings); err != nil {
+		return nil, err
+	}
+
+	history := &deviceHistory{metrics: make(map[string][]HistoryPoint), streaks: make(map[string][]HistoryPoint)}
+	for i := len(readings) - 1; i >= 0; i-- {
+		for _, key := range readings[i].Data.Keys() {
+			value, _ := readings[i].Data.Get(key)
+			history.metrics[key] = append(history.metrics[key], HistoryPoint{readings[i].Timestamp, float64(value)})
+		}
+	}
+
+	// 替换基线的异常读数不在上面的结果中，按阶跃记录恢复
+	var baselines []models.DetectorBaseline
+	if err := h.DB.WithContext(ctx).Where("device_id = ?", device.DeviceID).Find(&baselines).Error; err != nil {
+		return nil, err
+	}
+	for _, baseline := range baselines {
+		streak := make([]HistoryPoint, len(baseline.Points))
+		for i, point := range baseline.Points {
+			streak[i] = HistoryPoint{point.Time, point.Value}
+		}
+		history.rebase(baseline.Metric, streak)
+	}
+	actual, _ := detectorHistory.LoadOrStore(device.DeviceID, history)
+	return actual.(*deviceHistory), nil
+}
+
+// 某时间之前的历史读数
+func (d *deviceHistory) before(key string, timestamp int64) []HistoryPoint {
+	d.Lock()
+	defer d.Unlock()
+	points := d.metrics[key]
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time >= timestamp })
+	return append([]HistoryPoint(nil), points[:i]...)
+}
+
+// 记录一条正常读数到已加载的设备历史中
+func recordHistory(deviceID string, timestamp int64, data models.DataEntry) {
+	if value, ok := detectorHistory.Load(deviceID); ok {
+		value.(*deviceHistory).add(timestamp, data)
+	}
+}
+
+// 记录一条正常读数，补传的历史读数按时间插入
+func (d *deviceHistory) add(timestamp int64, data models.DataEntry) {
+	d.Lock()
+	defer d.Unlock()
+	for _, key := range data.Keys() {
+		value, _ := data.Get(key)
+		d.insert(key, HistoryPoint{timestamp, float64(value)})
+		delete(d.streaks, key)
+	}
+}
+
+func (d *deviceHistory) insert(key string, point HistoryPoint) {
+	points := d.metrics[key]
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time >= point.Time })
+	if i < len(points) && points[i].Time == point.Time {
+		return
+	}
+	points = append(points, HistoryPoint{})
+	copy(points[i+1:], points[i:])
+	points[i] = point
+	if len(points) > detectorHistorySize {
+		points = points[len(points)-detectorHistorySize:]
+	}
+	d.metrics[key] = points
+}
+
+// 记录一条异常读数中的异常指标到已加载的设备历史中，基线发生阶跃时保存阶跃记录
+func (h *DataHandler) recordAnomaly(ctx context.Context, deviceID string, timestamp int64, data models.DataEntry, fields []string) error {
+	value, ok := detectorHistory.Load(deviceID)
+	if !ok {
+		return nil
+	}
+	for key, streak := range value.(*deviceHistory).addAnomaly(timestamp, data, fields) {
+		baseline := models.DetectorBaseline{DeviceID: deviceID, Metric: key, Points: make([]models.BaselinePoint, len(streak))}
+		for i, point := range streak {
+			baseline.Points[i] = models.BaselinePoint{Time: point.Time, Value: point.Value}
+		}
+		if err := h.DB.WithContext(ctx).Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"points"})}).
+			Create(&baseline).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 累计连续的异常读数。方向与之前的异常相反时重新计数，
+// 连续 baselineShiftCount 条同方向的异常读数视为阶跃变化，以这些读数重新建立基线。返回发生阶跃的指标及新的基线
+func (d *deviceHistory) addAnomaly(timestamp int64, data models.DataEntry, fields []string) map[string][]HistoryPoint {
+	d.Lock()
+	defer d.Unlock()
+	shifted := make(map[string][]HistoryPoint)
+	for _, key := range fields {
+		value, ok := data.Get(key)
+		points := d.metrics[key]
+		if !ok || len(points) == 0 {
+			continue
+		}
+		stats := RunningStats{}
+		for _, point := range points {
+			stats.Add(point.Value)
+		}
+		above := float64(value) > stats.Mean
+
+		streak := d.streaks[key]
+		if len(streak) > 0 && (streak[0].Value > stats.Mean) != above {
+			streak = nil
+		}
+		streak = append(streak, HistoryPoint{timestamp, float64(value)})
+		if len(streak) < baselineShiftCount {
+			d.streaks[key] = streak
+			continue
+		}
+		sort.Slice(streak, func(i, j int) bool { return streak[i].Time < streak[j].Time })
+		d.rebase(key, streak)
+		delete(d.streaks, key)
+		shifted[key] = streak
+	}
+	return shifted
+}
+
+// 以阶跃后的异常读数作为基线，丢弃阶跃之前的历史读数，保留之后的正常读数
+func (d *deviceHistory) rebase(key string, streak []HistoryPoint) {
+	if len(streak) == 0 {
+		return
+	}
+	points := d.metrics[key]
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time >= streak[0].Time })
+	d.metrics[key] = append([]HistoryPoint(nil), points[i:]...)
+	for _, point := range streak {
+		d.insert(key, point)
+	}
+}
+
+// 按设备配置的检测器检查读数，多个检测器的结果合并
+func (h *DataHandler) detectAnomalies(ctx context.Context, device *models.Device, timestamp int64, data models.DataEntry, scene, season string) (AnomalyResult, error) {
+	result := AnomalyResult{IsNormal: true, AnomalyFields: []string{}, AnomalyDetails: make(map[string]string)}
+	settings := device.Detectors
+	if len(settings) == 0 {
+		settings = defaultDetectors
+	}
+
+	// 场景或季节无效时直接返回，不再运行其他检测器
+	if check := CheckDataAnomaly(data, scene, season, nil); !check.IsNormal {
+		return check, nil
+	}
+
+	history, err := h.loadHistory(ctx, device)
+	if err != nil {
+		return result, err
+	}
+	input := &DetectionInput{
+		Device:    device,
+		Timestamp: timestamp,
+		Data:      data,
+		Scene:     scene,
+		Season:    season,
+		Metrics:   deviceMetrics(device),
+		History: func(key string) []HistoryPoint {
+			return history.before(key, timestamp)
+		},
+	}
+
+	for _, setting := range settings {
+		detector, ok := detectors[setting.Name]
+		if !ok {
+			continue
+		}
+		for key, detail := range detector.Detect(input, setting.Sensitivity) {
+			if existing, found := result.AnomalyDetails[key]; found {
+				result.AnomalyDetails[key] = existing + "；" + detail
+				continue
+			}
+			result.IsNormal = false
+			result.AnomalyFields = append(result.AnomalyFields, key)
+			result.AnomalyDetails[key] = detail
+		}
+	}
+	sort.Strings(result.AnomalyFields)
+	return result, nil
+}
+
+// 解析设备的检测器配置
+func parseDetectorSettings(value any) ([]models.DetectorSetting, error) {
+	list, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("invalid detectors")
+	}
+	settings := make([]models.DetectorSetting, 0, len(list))
+	for _, item := range list {
+		entry, ok := item.(map[string]any)
+		if !ok {
+			return nil, errors.New("invalid detectors")
+		}
+		name, _ := entry["name"].(string)
+		if _, exists := detectors[name]; !exists {
+			names := make([]string, 0, len(detectors))
+			for name := range detectors {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("未知的检测器，可选：%s", strings.Join(names, "、"))
+		}
+		setting := models.DetectorSetting{Name: name}
+		if sensitivity, ok := entry["sensitivity"]; ok {
+			number, ok := sensitivity.(float64)
+			if !ok || number < 0 {
+				return nil, errors.New("invalid sensitivity")
+			}
+			setting.Sensitivity = number
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"ssat_backend_rebuild/models"
+	"testing"
+)
+
+func temperatureReading(value float32) models.DataEntry {
+	entry := models.EmptyDataEntry()
+	entry.Set("temperature", value)
+	return entry
+}
+
+// 用设备历史检测一条温度读数
+func detectTemperature(history *deviceHistory, timestamp int64, value float32) map[string]string {
+	input := &DetectionInput{
+		Timestamp: timestamp,
+		Data:      temperatureReading(value),
+		Metrics:   []string{"temperature"},
+		History:   func(key string) []HistoryPoint { return history.before(key, timestamp) },
+	}
+	return zscoreDetector{}.Detect(input, 0)
+}
+
+func TestBaselineAdaptsAfterStepChange(t *testing.T) {
+	history := &deviceHistory{metrics: make(map[string][]HistoryPoint), streaks: make(map[string][]HistoryPoint)}
+	ts := int64(1700000000)
+	for i := range 50 {
+		history.add(ts, temperatureReading(20+float32(i%5)*0.1))
+		ts += 60
+	}
+
+	// 温度阶跃到 30℃ 后持续保持，前 baselineShiftCount 条为异常
+	for i := range baselineShiftCount {
+		if details := detectTemperature(history, ts, 30); details["temperature"] == "" {
+			t.Fatalf("reading %d after step not flagged", i)
+		}
+		history.addAnomaly(ts, temperatureReading(30+float32(i%5)*0.1), []string{"temperature"})
+		ts += 60
+	}
+
+	// 新基线积累到检测所需的条数后，新水平的读数正常，原水平的读数异常
+	for i := range 20 {
+		history.add(ts, temperatureReading(30+float32(i%5)*0.1))
+		ts += 60
+	}
+	if n := len(history.before("temperature", ts)); n < 20 || n >= 50 {
+		t.Fatalf("history has %d points, want only the new baseline", n)
+	}
+	if details := detectTemperature(history, ts, 30.2); details["temperature"] != "" {
+		t.Errorf("baseline did not adapt: %s", details["temperature"])
+	}
+	if details := detectTemperature(history, ts, 20.2); details["temperature"] == "" {
+		t.Error("reading at the old level not flagged")
+	}
+}
+
+func TestRebaseRestoresShiftAfterReload(t *testing.T) {
+	// 重新加载时只有正常读数：阶跃之前的旧水平和阶跃之后的新水平
+	history := &deviceHistory{metrics: make(map[string][]HistoryPoint), streaks: make(map[string][]HistoryPoint)}
+	ts := int64(1700000000)
+	for i := range 50 {
+		history.add(ts, temperatureReading(20+float32(i%5)*0.1))
+		ts += 60
+	}
+	var streak []HistoryPoint
+	for i := range baselineShiftCount {
+		streak = append(streak, HistoryPoint{ts, 30 + float64(i%5)*0.1})
+		ts += 60
+	}
+	for i := range 15 {
+		history.add(ts, temperatureReading(30+float32(i%5)*0.1))
+		ts += 60
+	}
+
+	history.rebase("temperature", streak)
+	points := history.before("temperature", ts)
+	if len(points) != baselineShiftCount+15 {
+		t.Fatalf("got %d points, want %d", len(points), baselineShiftCount+15)
+	}
+	if points[0] != streak[0] {
+		t.Errorf("first point %v, want %v", points[0], streak[0])
+	}
+	if details := detectTemperature(history, ts, 30.2); details["temperature"] != "" {
+		t.Errorf("new level flagged after reload: %s", details["temperature"])
+	}
+}
+
+func TestBaselineIgnoresAlternatingSpikes(t *testing.T) {
+	history := &deviceHistory{metrics: make(map[string][]HistoryPoint), streaks: make(map[string][]HistoryPoint)}
+	ts := int64(1700000000)
+	for i := range 50 {
+		history.add(ts, temperatureReading(20+float32(i%5)*0.1))
+		ts += 60
+	}
+
+	// 方向交替的尖峰不会累计为阶跃
+	for i := range 2 * baselineShiftCount {
+		value := float32(30)
+		if i%2 == 1 {
+			value = 10
+		}
+		history.addAnomaly(ts, temperatureReading(value), []string{"temperature"})
+		ts += 60
+	}
+	if details := detectTemperature(history, ts, 30); details["temperature"] == "" {
+		t.Error("spike accepted into baseline")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"ssat_backend_rebuild/models"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -45,7 +46,9 @@ func (h *DeviceHandler) Retrieve(c *gin.Context) {
 func (h *DeviceHandler) List(c *gin.Context) {
 	h.BaseHandler.List(
 		nil,
-		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return filterByLocation(c, h.DB, query, "uuid")
+		},
 	)(c)
 }
 
@@ -63,7 +66,36 @@ func (h *DeviceHandler) Update(c *gin.Context) {
 				if err != nil {
 					return errors.New("invalid status")
 				}
-				device.Status = statusInt
+				if err := TransitionDeviceStatus(h.DB, device, statusInt, "管理员修改"); err != nil {
+					return err
+				}
+			}
+
+			if err := applyDeviceProfile(h.DB, device, data); err != nil {
+				return err
+			}
+
+			if value, ok := data["capabilities"]; ok {
+				capabilities, err := parseCapabilities(value)
+				if err != nil {
+					return err
+				}
+				device.Capabilities = capabilities
+			}
+
+			if value, ok := data["detectors"]; ok {
+				settings, err := parseDetectorSettings(value)
+				if err != nil {
+					return err
+				}
+				device.Detectors = settings
+			}
+
+			if timeout, ok := data["offline_timeout"].(float64); ok {
+				if timeout < 0 {
+					return errors.New("invalid offline_timeout")
+				}
+				device.OfflineTimeout = int(timeout)
 			}
 
 			if owner_id, ok := data["owner_id"].(string); ok && owner_id != "" {
@@ -73,11 +105,50 @@ func (h *DeviceHandler) Update(c *gin.Context) {
 				}
 				device.OwnerID = &uid
 			}
+
+			// room_uuid 为空字符串时表示移出房间
+			if room_uuid, ok := data["room_uuid"].(string); ok {
+				if room_uuid == "" {
+					device.RoomUUID = nil
+				} else {
+					uid, err := uuid.Parse(room_uuid)
+					if err != nil {
+						return errors.New("invalid room_uuid")
+					}
+					if err := h.DB.First(&models.Room{}, "uuid = ?", uid).Error; err != nil {
+						return errors.New("room not found")
+					}
+					device.RoomUUID = &uid
+				}
+				device.Room = nil
+			}
 			return nil
 		},
 	)(c)
 }
 
+// 管理员将设备设为维护中或解除维护
+func (h *DeviceHandler) SetMaintenance(c *gin.Context) {
+	h.BaseHandler.Update(
+		[]string{},
+		nil,
+		func(c *gin.Context, query *gorm.DB, device *models.Device, data map[string]any) error {
+			enabled, ok := data["enabled"].(bool)
+			if !ok {
+				return errors.New("enabled is required")
+			}
+			if enabled {
+				return TransitionDeviceStatus(h.DB, device, models.DeviceStatusMaintenance, "进入维护")
+			}
+			if device.Status != models.DeviceStatusMaintenance {
+				return errors.New("设备不在维护中")
+			}
+			// 解除维护后等待下一次上报再判定状态
+			return TransitionDeviceStatus(h.DB, device, models.DeviceStatusUnknown, "解除维护")
+		},
+	)(c)
+}
+
 func (h *DeviceHandler) Destroy(c *gin.Context) {
 	h.BaseHandler.Destroy(
 		nil,
@@ -118,6 +189,19 @@ func (h *DeviceHandler) SetNickname(c *gin.Context) {
 	)(c)
 }
 
+// 拥有者设置设备的场景、半球和时区
+func (h *DeviceHandler) SetProfile(c *gin.Context) {
+	h.BaseHandler.Update(
+		[]string{"scene", "hemisphere", "timezone"},
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Where("uuid = ? AND owner_id = ?", c.Param("uuid"), c.MustGet("CurrentUser").(*models.User).UUID)
+		},
+		func(c *gin.Context, query *gorm.DB, device *models.Device, data map[string]any) error {
+			return applyDeviceProfile(h.DB, device, data)
+		},
+	)(c)
+}
+
 func (h *DeviceHandler) Unbind(c *gin.Context) {
 	h.BaseHandler.Update(
 		[]string{},
@@ -130,14 +214,19 @@ func (h *DeviceHandler) Unbind(c *gin.Context) {
 			device.OwnerID = nil
 			device.Owner = nil
 			device.Nickname = ""
-			return nil
+
+			// 解绑后取消该设备尚未处理的转移请求
+			now := time.Now()
+			return h.DB.Model(&models.DeviceTransfer{}).
+				Where("device_uuid = ? AND status = ?", device.UUID, 0).
+				Updates(map[string]any{"status": 3, "finished_at": now}).Error
 		},
 	)(c)
 }
 
 func (h *DeviceHandler) MyDevices(c *gin.Context) {
 	h.BaseHandler.List(
-		[]string{"uuid", "device_id", "status", "last_received", "nickname"},
+		[]string{"uuid", "device_id", "status", "last_received", "nickname", "room_uuid", "scene"},
 		func(c *gin.Context, query *gorm.DB) *gorm.DB {
 			if c.Query("status") != "" {
 				status, err := strconv.Atoi(c.Query("status"))
@@ -147,6 +236,7 @@ func (h *DeviceHandler) MyDevices(c *gin.Context) {
 				query = query.Where("status = ?", status)
 			}
 
+			query = filterByLocation(c, h.DB, query, "uuid")
 			return query.Where("owner_id = ?", c.MustGet("CurrentUser").(*models.User).UUID)
 		},
 	)(c)
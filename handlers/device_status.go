@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"ssat_backend_rebuild/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 允许的设备状态迁移
+var deviceTransitions = map[int][]int{
+	models.DeviceStatusUnknown:     {models.DeviceStatusOnline, models.DeviceStatusOffline, models.DeviceStatusAnomalous, models.DeviceStatusMaintenance},
+	models.DeviceStatusOnline:      {models.DeviceStatusOffline, models.DeviceStatusAnomalous, models.DeviceStatusMaintenance},
+	models.DeviceStatusOffline:     {models.DeviceStatusOnline, models.DeviceStatusAnomalous, models.DeviceStatusMaintenance},
+	models.DeviceStatusAnomalous:   {models.DeviceStatusOnline, models.DeviceStatusOffline, models.DeviceStatusMaintenance},
+	models.DeviceStatusMaintenance: {models.DeviceStatusUnknown, models.DeviceStatusOffline},
+}
+
+func canTransition(from, to int) bool {
+	for _, status := range deviceTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// 切换设备状态并记录事件。
+// 使用带旧状态条件的更新，多个实例同时修改时只有一个会生效，
+// 未生效的一方会把 device.Status 刷新为数据库中的最新值。
+func TransitionDeviceStatus(db *gorm.DB, device *models.Device, to int, reason string) error {
+	from := device.Status
+	if from == to {
+		return nil
+	}
+	if !canTransition(from, to) {
+		return fmt.Errorf("不允许从状态%d切换到状态%d", from, to)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Device{}).
+			Where("uuid = ? AND status = ?", device.UUID, from).
+			Update("status", to)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return tx.Model(&models.Device{}).Select("status").Where("uuid = ?", device.UUID).Scan(&device.Status).Error
+		}
+
+		event := models.DeviceEvent{
+			DeviceUUID: device.UUID,
+			FromStatus: from,
+			ToStatus:   to,
+			Reason:     reason,
+		}
+		if err := tx.Create(&event).Error; err != nil {
+			return err
+		}
+		device.Status = to
+		return nil
+	})
+}
+
+// 后台定时根据 LastReceived 判定设备离线
+type DeviceStatusSweeper struct {
+	DB             *gorm.DB
+	Interval       time.Duration // 扫描间隔
+	DefaultTimeout time.Duration // 设备未单独配置时的离线超时
+}
+
+func (s *DeviceStatusSweeper) Run() {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.Sweep(); err != nil {
+			log.Println("设备状态扫描失败：", err)
+		}
+	}
+}
+
+func (s *DeviceStatusSweeper) Sweep() error {
+	now := time.Now()
+	var devices []models.Device
+	err := s.DB.
+		Where("status IN ?", []int{models.DeviceStatusUnknown, models.DeviceStatusOnline, models.DeviceStatusAnomalous}).
+		Where("last_received IS NOT NULL").
+		Where("TIMESTAMPDIFF(SECOND, last_received, ?) > IF(offline_timeout > 0, offline_timeout, ?)", now, int(s.DefaultTimeout.Seconds())).
+		Find(&devices).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range devices {
+		if err := TransitionDeviceStatus(s.DB, &devices[i], models.DeviceStatusOffline, "超时未上报"); err != nil {
+			log.Printf("设备%s离线状态更新失败：%v", devices[i].DeviceID, err)
+		}
+	}
+	return nil
+}
+
+type DeviceEventHandler struct {
+	BaseHandler[models.DeviceEvent]
+}
+
+// 按Params过滤事件
+func filterDeviceEvents(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if before, err := time.Parse(time.RFC3339, c.Query("before")); err == nil {
+		query = query.Where("created_at < ?", before)
+	}
+	if after, err := time.Parse(time.RFC3339, c.Query("after")); err == nil {
+		query = query.Where("created_at > ?", after)
+	}
+	return query
+}
+
+func (h *DeviceEventHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			query = query.Where("device_uuid = ?", c.Param("uuid"))
+			return filterDeviceEvents(c, query)
+		},
+	)(c)
+}
+
+func (h *DeviceEventHandler) MyList(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			devices := h.DB.Model(&models.Device{}).Select("uuid").
+				Where("uuid = ? AND owner_id = ?", c.Param("uuid"), c.MustGet("CurrentUser").(*models.User).UUID)
+			query = query.Where("device_uuid IN (?)", devices)
+			return filterDeviceEvents(c, query)
+		},
+	)(c)
+}
@@ -0,0 +1,518 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/patrickmn/go-cache"
+	"gorm.io/gorm"
+)
+
+type FirmwareHandler struct {
+	Dir string // 固件存储目录
+	BaseHandler[models.Firmware]
+}
+
+type CampaignHandler struct {
+	BaseHandler[models.FirmwareCampaign]
+}
+
+// ===== 推送逻辑 =====
+
+// 每次上传都会检查推送任务，进行中的推送任务和房间所属的分组短时间缓存，修改推送任务时清除
+var campaignCache = cache.New(30*time.Second, time.Minute)
+
+// 进行中的推送任务，按创建时间倒序
+func activeCampaigns(db *gorm.DB) ([]models.FirmwareCampaign, error) {
+	if value, ok := campaignCache.Get("active"); ok {
+		return value.([]models.FirmwareCampaign), nil
+	}
+	var campaigns []models.FirmwareCampaign
+	if err := db.Preload("Firmware").Where("status = ?", 0).Order("created_at DESC").Find(&campaigns).Error; err != nil {
+		return nil, err
+	}
+	campaignCache.SetDefault("active", campaigns)
+	return campaigns, nil
+}
+
+// 设备所在的房间、场所和组织
+type deviceGroups struct {
+	room, site, organization *uuid.UUID
+}
+
+func loadDeviceGroups(db *gorm.DB, device *models.Device) deviceGroups {
+	groups := deviceGroups{room: device.RoomUUID}
+	if device.RoomUUID == nil {
+		return groups
+	}
+	key := "room:" + device.RoomUUID.String()
+	if value, ok := campaignCache.Get(key); ok {
+		return value.(deviceGroups)
+	}
+	room := &models.Room{}
+	if err := db.First(room, "uuid = ?", device.RoomUUID).Error; err == nil && room.SiteUUID != nil {
+		groups.site = room.SiteUUID
+		site := &models.Site{}
+		if err := db.First(site, "uuid = ?", room.SiteUUID).Error; err == nil {
+			groups.organization = site.OrganizationUUID
+		}
+	}
+	campaignCache.SetDefault(key, groups)
+	return groups
+}
+
+// 判断设备是否属于推送任务的目标分组
+func (g deviceGroups) inTarget(campaign *models.FirmwareCampaign) bool {
+	if campaign.TargetType == "all" {
+		return true
+	}
+	if campaign.TargetUUID == nil {
+		return false
+	}
+	target := map[string]*uuid.UUID{"room": g.room, "site": g.site, "organization": g.organization}[campaign.TargetType]
+	return target != nil && *target == *campaign.TargetUUID
+}
+
+// 设备是否落在分阶段推送的比例内，同一任务下结果固定
+func deviceInRollout(device *models.Device, campaign *models.FirmwareCampaign) bool {
+	h := fnv.New32a()
+	h.Write([]byte(device.UUID.String() + campaign.UUID.String()))
+	return int(h.Sum32()%100) < campaign.Percentage
+}
+
+// 根据设备上报的固件版本更新升级状态，并返回需要推送给设备的固件
+func OfferFirmware(db *gorm.DB, device *models.Device, version string, installError string) (gin.H, error) {
+	versionChanged := version != "" && version != device.FirmwareVersion
+	if versionChanged {
+		if err := db.Model(device).Update("firmware_version", version).Error; err != nil {
+			return nil, err
+		}
+		device.FirmwareVersion = version
+	}
+
+	// 版本变化或上报失败时才需要更新进行中的升级记录
+	var updates []models.DeviceFirmwareUpdate
+	if versionChanged || installError != "" {
+		if err := db.Where("device_uuid = ? AND status IN ?", device.UUID, []uint8{0, 1}).Find(&updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	for i := range updates {
+		switch {
+		case updates[i].ToVersion == device.FirmwareVersion:
+			updates[i].Status = 2
+		case installError != "":
+			updates[i].Status = 3
+			updates[i].Error = installError
+		default:
+			continue
+		}
+		if err := db.Save(&updates[i]).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	campaigns, err := activeCampaigns(db)
+	if err != nil {
+		return nil, err
+	}
+	var groups *deviceGroups
+	for i := range campaigns {
+		campaign := &campaigns[i]
+		if campaign.Firmware == nil || campaign.Firmware.Version == device.FirmwareVersion || !deviceInRollout(device, campaign) {
+			continue
+		}
+		if groups == nil {
+			loaded := loadDeviceGroups(db, device)
+			groups = &loaded
+		}
+		if !groups.inTarget(campaign) {
+			continue
+		}
+
+		update := &models.DeviceFirmwareUpdate{}
+		err := db.Where(models.DeviceFirmwareUpdate{DeviceUUID: device.UUID, CampaignUUID: campaign.UUID}).
+			Attrs(models.DeviceFirmwareUpdate{FromVersion: device.FirmwareVersion, ToVersion: campaign.Firmware.Version}).
+			FirstOrCreate(update).Error
+		if err != nil {
+			return nil, err
+		}
+		// 已安装、失败或中止的设备不再重复推送
+		if update.Status > 1 {
+			continue
+		}
+
+		return gin.H{
+			"campaign_uuid": campaign.UUID,
+			"firmware_uuid": campaign.Firmware.UUID,
+			"version":       campaign.Firmware.Version,
+			"size":          campaign.Firmware.Size,
+			"sha256":        campaign.Firmware.SHA256,
+			"signature":     campaign.Firmware.Signature,
+			"url":           fmt.Sprintf("/devices/firmwares/%s/download", campaign.Firmware.UUID),
+		}, nil
+	}
+	return nil, nil
+}
+
+// ===== 固件文件 =====
+
+// 上传固件，使用 multipart/form-data
+func (h *FirmwareHandler) Create(c *gin.Context) {
+	version := c.PostForm("version")
+	file, err := c.FormFile("file")
+	if version == "" || err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	var exists int64
+	h.DB.Model(&models.Firmware{}).Where("version = ?", version).Count(&exists)
+	if exists > 0 {
+		utils.Respond(c, nil, utils.ErrorCode{
+			Code:     4,
+			HttpCode: 400,
+			Message:  "固件版本已存在",
+		})
+		return
+	}
+
+	firmware := &models.Firmware{
+		Version:   version,
+		Signature: c.PostForm("signature"),
+		Note:      c.PostForm("note"),
+	}
+	firmware.UUID = uuid.New()
+
+	// 写入文件的同时计算 SHA-256
+	if err := os.MkdirAll(h.Dir, 0o755); err != nil {
+		log.Println("创建固件目录失败：", err)
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	firmware.FilePath = filepath.Join(h.Dir, firmware.UUID.String()+".bin")
+
+	src, err := file.Open()
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+	defer src.Close()
+	dst, err := os.Create(firmware.FilePath)
+	if err != nil {
+		log.Println("保存固件失败：", err)
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	defer dst.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		os.Remove(firmware.FilePath)
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	firmware.Size = size
+	firmware.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	// 上传方提供了校验值时，需要与实际文件一致
+	if expected := c.PostForm("sha256"); expected != "" && expected != firmware.SHA256 {
+		os.Remove(firmware.FilePath)
+		utils.Respond(c, nil, utils.ErrorCode{
+			Code:     4,
+			HttpCode: 400,
+			Message:  "固件校验值不匹配",
+		})
+		return
+	}
+
+	if err := h.DB.Create(firmware).Error; err != nil {
+		os.Remove(firmware.FilePath)
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, firmware, utils.ErrCreated)
+}
+
+func (h *FirmwareHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		nil,
+	)(c)
+}
+
+func (h *FirmwareHandler) Retrieve(c *gin.Context) {
+	h.BaseHandler.Retrieve(
+		nil,
+		nil,
+	)(c)
+}
+
+func (h *FirmwareHandler) Destroy(c *gin.Context) {
+	firmware := &models.Firmware{}
+	if err := h.DB.First(firmware, "uuid = ?", c.Param("uuid")).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	var campaigns int64
+	h.DB.Model(&models.FirmwareCampaign{}).Where("firmware_uuid = ?", firmware.UUID).Count(&campaigns)
+	if campaigns > 0 {
+		utils.Respond(c, nil, utils.ErrorCode{
+			Code:     4,
+			HttpCode: 400,
+			Message:  "固件已被推送任务使用",
+		})
+		return
+	}
+
+	if err := h.DB.Delete(firmware).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	os.Remove(firmware.FilePath)
+	utils.Respond(c, gin.H{"message": "删除成功"}, utils.ErrOK)
+}
+
+type FirmwareDownloadQuery struct {
+	DeviceID  string `form:"device_id" binding:"required"`
+	Timestamp int64  `form:"timestamp" binding:"required"`
+	Signature string `form:"signature" binding:"required"` // md5(device_id:timestamp:firmware_uuid:secret)
+}
+
+// 设备下载固件
+func (h *FirmwareHandler) Download(c *gin.Context) {
+	var req FirmwareDownloadQuery
+	if err := c.ShouldBindQuery(&req); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	device, ok := authenticateDevice(c, h.DB, req.DeviceID, req.Timestamp, req.Signature, c.Param("uuid"))
+	if !ok {
+		return
+	}
+
+	firmware := &models.Firmware{}
+	if err := h.DB.First(firmware, "uuid = ?", c.Param("uuid")).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+
+	// 只允许下载推送给该设备且未中止的固件
+	activeCampaigns := h.DB.Model(&models.FirmwareCampaign{}).Select("uuid").
+		Where("firmware_uuid = ? AND status = ?", firmware.UUID, 0)
+	result := h.DB.Model(&models.DeviceFirmwareUpdate{}).
+		Where("device_uuid = ? AND campaign_uuid IN (?) AND status IN ?", device.UUID, activeCampaigns, []uint8{0, 1}).
+		Update("status", 1)
+	if result.Error != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	if result.RowsAffected == 0 {
+		utils.Respond(c, nil, utils.ErrForbidden)
+		return
+	}
+
+	c.Set("Status", &utils.ErrOK)
+	c.FileAttachment(firmware.FilePath, fmt.Sprintf("firmware-%s.bin", firmware.Version))
+}
+
+// ===== 推送任务 =====
+
+// 解析推送目标
+func parseCampaignTarget(db *gorm.DB, campaign *models.FirmwareCampaign, data map[string]any) error {
+	targetType, _ := data["target_type"].(string)
+	if targetType == "" {
+		targetType = "all"
+	}
+
+	targetModels := map[string]any{
+		"organization": &models.Organization{},
+		"site":         &models.Site{},
+		"room":         &models.Room{},
+	}
+	campaign.TargetType = targetType
+	campaign.TargetUUID = nil
+	if targetType == "all" {
+		return nil
+	}
+
+	model, ok := targetModels[targetType]
+	if !ok {
+		return errors.New("invalid target_type")
+	}
+	targetUUID, err := parseParentUUID(db, model, data, "target_uuid")
+	if err != nil {
+		return err
+	}
+	campaign.TargetUUID = targetUUID
+	return nil
+}
+
+func parsePercentage(data map[string]any) (int, bool, error) {
+	value, ok := data["percentage"]
+	if !ok {
+		return 0, false, nil
+	}
+	percentage, ok := value.(float64)
+	if !ok || percentage < 0 || percentage > 100 {
+		return 0, true, errors.New("invalid percentage")
+	}
+	return int(percentage), true, nil
+}
+
+func (h *CampaignHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, campaign *models.FirmwareCampaign, data map[string]any) error {
+			firmwareUUID, err := parseParentUUID(h.DB, &models.Firmware{}, data, "firmware_uuid")
+			if err != nil {
+				return err
+			}
+			campaign.FirmwareUUID = firmwareUUID
+
+			if err := parseCampaignTarget(h.DB, campaign, data); err != nil {
+				return err
+			}
+
+			percentage, ok, err := parsePercentage(data)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				percentage = 100
+			}
+			campaign.Percentage = percentage
+			campaign.Status = 0
+			return nil
+		},
+	)(c)
+	campaignCache.Delete("active")
+}
+
+func (h *CampaignHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			if status := c.Query("status"); status != "" {
+				if s, err := strconv.ParseUint(status, 10, 8); err == nil {
+					query = query.Where("status = ?", s)
+				}
+			}
+			return query.Preload("Firmware")
+		},
+	)(c)
+}
+
+func (h *CampaignHandler) Retrieve(c *gin.Context) {
+	h.BaseHandler.Retrieve(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Preload("Firmware").Where("uuid = ?", c.Param("uuid"))
+		},
+	)(c)
+}
+
+// 调整推送比例
+func (h *CampaignHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, campaign *models.FirmwareCampaign, data map[string]any) error {
+			percentage, ok, err := parsePercentage(data)
+			if err != nil {
+				return err
+			}
+			if ok {
+				campaign.Percentage = percentage
+			}
+			return nil
+		},
+	)(c)
+	campaignCache.Delete("active")
+}
+
+// 暂停推送，进行中的设备升级一并中止
+func (h *CampaignHandler) Halt(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, campaign *models.FirmwareCampaign, data map[string]any) error {
+			if campaign.Status != 0 {
+				return errors.New("推送任务未在进行中")
+			}
+			campaign.Status = 1
+			return h.DB.Model(&models.DeviceFirmwareUpdate{}).
+				Where("campaign_uuid = ? AND status IN ?", campaign.UUID, []uint8{0, 1}).
+				Update("status", 4).Error
+		},
+	)(c)
+	campaignCache.Delete("active")
+}
+
+// 恢复已暂停的推送，中止的设备会被重新推送
+func (h *CampaignHandler) Resume(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, campaign *models.FirmwareCampaign, data map[string]any) error {
+			if campaign.Status != 1 {
+				return errors.New("推送任务未暂停")
+			}
+			campaign.Status = 0
+			return h.DB.Model(&models.DeviceFirmwareUpdate{}).
+				Where("campaign_uuid = ? AND status = ?", campaign.UUID, 4).
+				Update("status", 0).Error
+		},
+	)(c)
+	campaignCache.Delete("active")
+}
+
+// 查看推送任务下各设备的升级状态
+func (h *CampaignHandler) Updates(c *gin.Context) {
+	query := h.DB.Model(&models.DeviceFirmwareUpdate{}).Where("campaign_uuid = ?", c.Param("uuid"))
+	if status := c.Query("status"); status != "" {
+		if s, err := strconv.ParseUint(status, 10, 8); err == nil {
+			query = query.Where("status = ?", s)
+		}
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	// 各状态的设备数量
+	var summary []struct {
+		Status uint8 `json:"status"`
+		Count  int64 `json:"count"`
+	}
+	if err := h.DB.Model(&models.DeviceFirmwareUpdate{}).Where("campaign_uuid = ?", c.Param("uuid")).
+		Select("status, COUNT(*) AS count").Group("status").Scan(&summary).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	offset, limit := h.getPaginationParams(c)
+	var updates []models.DeviceFirmwareUpdate
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&updates).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, gin.H{"count": total, "summary": summary, "items": updates}, utils.ErrOK)
+}
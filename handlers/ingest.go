@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 单条读数的处理结果
+type IngestResult struct {
+	Scene      string         // 使用的场景
+	Season     string         // 使用的季节
+	Duplicate  bool           // 相同时间戳的读数已存在
+	Anomaly    *AnomalyResult // 数据异常时不为空，读数存入隔离区
+	Aggregated bool           // 异常读数同时计入统计数据
+	AQI        *AQIResult     // 正常读数的空气质量指数
+}
+
+// 读数中没有任何指标
+var errEmptyReading = errors.New("empty reading")
+
+// 校准、异常检测并保存一条读数。
+// scene 和 season 为设备上报的值，仅用于记录与服务端不一致的情况
+func (h *DataHandler) ingestReading(ctx context.Context, device *models.Device, timestamp int64, raw models.DataEntry, scene, season string) (*IngestResult, error) {
+	// 未上报的内置指标不会按 0 处理，没有任何指标的读数直接拒绝
+	if len(raw.Keys()) == 0 {
+		return nil, errEmptyReading
+	}
+	result := &IngestResult{
+		Scene:  device.Scene,
+		Season: DeriveSeason(time.Unix(timestamp, 0), device),
+	}
+	if (scene != "" && scene != result.Scene) || (season != "" && season != result.Season) {
+		log.Printf("设备%s上报的场景/季节(%s/%s)与服务端(%s/%s)不一致", device.DeviceID, scene, season, result.Scene, result.Season)
+	}
+
+	// 应用校准系数，异常检测和存储都使用校准后的数据
+	calibrated, err := ApplyCalibration(h.DB, device, timestamp, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先检查指标是否有效，再按设备配置的检测器检查
+	anomalyResult := AnomalyResult{IsNormal: true, AnomalyFields: []string{}, AnomalyDetails: make(map[string]string)}
+	validateMetrics(device, &calibrated, &anomalyResult)
+	invalid := !anomalyResult.IsNormal
+	if !invalid {
+		if anomalyResult, err = h.detectAnomalies(ctx, device, timestamp, calibrated, result.Scene, result.Season); err != nil {
+			return nil, err
+		}
+	}
+	if !anomalyResult.IsNormal {
+		result.Anomaly = &anomalyResult
+		if err := h.quarantineReading(ctx, device, timestamp, calibrated, raw, result); err != nil {
+			return nil, err
+		}
+		// 无效的指标不计入统计；超出场景阈值的读数按配置决定是否计入
+		if !invalid {
+			if err := h.recordAnomaly(ctx, device.DeviceID, timestamp, calibrated, anomalyResult.AnomalyFields); err != nil {
+				return nil, err
+			}
+		}
+		if invalid || !h.QuarantineInAggregates {
+			return result, nil
+		}
+		result.Aggregated = true
+	}
+
+	// 按 (device_id, timestamp) 去重，重复上传的读数不会覆盖已有数据
+	mongoData := MongoData{
+		DeviceID:  device.DeviceID,
+		Timestamp: timestamp,
+		Data:      calibrated,
+		RawData:   &raw,
+		Processed: false,
+		Anomalous: result.Anomaly != nil,
+	}
+	filter := bson.M{"device_id": device.DeviceID, "timestamp": timestamp}
+	res, err := h.MongoCollection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": mongoData}, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	result.Duplicate = res.UpsertedCount == 0
+	if !result.Duplicate && result.Anomaly == nil {
+		recordHistory(device.DeviceID, timestamp, calibrated)
+	}
+	if result.Anomaly == nil {
+		result.AQI = computeAQI(calibrated)
+	}
+	return result, nil
+}
+
+// 未处理的数据达到阈值时计算统计数据并写入 SQL 数据库，返回生成的统计数据条数和聚合的读数条数。
+// 每批按时间顺序取最早的 MongoToSQLThreshold 条，补传的历史数据会被拆分为多批统计
+func (h *DataHandler) aggregatePending(ctx context.Context, device *models.Device) (batches int, readings int, err error) {
+	if h.AggregationMode == AggregationModeWindow {
+		return h.aggregateWindows(ctx, device)
+	}
+
+	// 先完成之前已认领但超时未完成的批次
+	store := h.batches()
+	tokens, err := store.StalledBatches(ctx, device.DeviceID, time.Now().Add(-batchClaimLease))
+	if err != nil {
+		return batches, readings, err
+	}
+	for _, token := range tokens {
+		n, err := h.finishBatch(ctx, device, token)
+		if err != nil {
+			return batches, readings, err
+		}
+		if n > 0 {
+			batches++
+			readings += n
+		}
+	}
+
+	for {
+		count, err := store.CountUnclaimed(ctx, device.DeviceID, 0)
+		if err != nil {
+			return batches, readings, err
+		}
+		if count == 0 || count < int64(h.MongoToSQLThreshold) {
+			return batches, readings, nil
+		}
+
+		log.Println("数据超过阈值，开始处理")
+		n, err := h.claimBatch(ctx, device, 0)
+		if err != nil {
+			return batches, readings, err
+		}
+		if n > 0 {
+			batches++
+			readings += n
+		}
+	}
+}
+
+// 按时间顺序认领最早的一批未处理数据并生成统计数据，before 不为 0 时只认领早于该时间戳的数据。
+// 返回聚合的读数条数，并发的聚合已认领全部数据时为 0
+func (h *DataHandler) claimBatch(ctx context.Context, device *models.Device, before int64) (int, error) {
+	// 批次标识同时作为统计数据的 UUID
+	token := uuid.New().String()
+	if err := h.batches().ClaimOldest(ctx, device.DeviceID, before, h.MongoToSQLThreshold, token, time.Now()); err != nil {
+		return 0, err
+	}
+	return h.finishBatch(ctx, device, token)
+}
+
+// 根据已认领的数据写入统计数据并标记为已处理，返回聚合的读数条数。
+// 统计数据的 UUID 即批次标识，已存在时按批次的全部读数重新计算，重复执行不会产生重复的统计数据
+func (h *DataHandler) finishBatch(ctx context.Context, device *models.Device, token string) (int, error) {
+	batchUUID, err := uuid.Parse(token)
+	if err != nil {
+		return 0, err
+	}
+	store := h.batches()
+	for {
+		mongoDataList, err := store.BatchReadings(ctx, token)
+		if err != nil {
+			return 0, err
+		}
+		if len(mongoDataList) == 0 {
+			return 0, nil
+		}
+
+		// 计算数据统计信息
+		summary := SummarizeReadings(mongoDataList)
+		first, last := mongoDataList[0].Timestamp, mongoDataList[0].Timestamp
+		ids := make([]primitive.ObjectID, len(mongoDataList))
+		for i, mongoData := range mongoDataList {
+			first = min(first, mongoData.Timestamp)
+			last = max(last, mongoData.Timestamp)
+			ids[i] = mongoData.ID
+		}
+		windowStart, windowEnd := time.Unix(first, 0), time.Unix(last, 0)
+
+		// 将统计学数据写入 SQL 数据库
+		data := models.Data{
+			MyDevice:    device,
+			Resolution:  models.ResolutionBatch,
+			WindowStart: &windowStart,
+			WindowEnd:   &windowEnd,
+			BaseModel:   models.BaseModel{UUID: batchUUID},
+		}
+		summary.Apply(&data)
+		if err := store.SaveStats(&data); err != nil {
+			return 0, err
+		}
+
+		// 只标记参与计算的读数为已处理
+		if err := store.MarkProcessed(ctx, ids); err != nil {
+			return 0, err
+		}
+
+		// 认领尚未完成时批次中会有新加入的读数，按完整的批次重新计算
+		total, err := store.CountBatch(ctx, token)
+		if err != nil {
+			return 0, err
+		}
+		if total == int64(len(mongoDataList)) {
+			return len(mongoDataList), nil
+		}
+	}
+}
+
+// 触发聚合：启用后台聚合时入队，否则在当前请求中同步执行
+func (h *DataHandler) scheduleAggregation(ctx context.Context, device *models.Device) error {
+	if h.Aggregator != nil {
+		h.Aggregator.Enqueue(device, 0)
+		return nil
+	}
+	_, _, err := h.aggregatePending(ctx, device)
+	return err
+}
+
+// 收到数据后更新设备的最后接收时间和在线状态
+func (h *DataHandler) markReceived(device *models.Device) error {
+	// 离线判定由 DeviceStatusSweeper 负责
+	now := time.Now()
+	if err := h.DB.Model(device).Update("last_received", now).Error; err != nil {
+		return err
+	}
+	device.LastReceived = &now
+
+	// 更新设备的状态，维护中的设备保持不变
+	if device.Status == models.DeviceStatusMaintenance {
+		return nil
+	}
+	return TransitionDeviceStatus(h.DB, device, models.DeviceStatusOnline, "收到数据")
+}
+
+// 数据异常时更新设备状态，维护中的设备保持不变
+func (h *DataHandler) markAnomalous(device *models.Device) error {
+	if device.Status == models.DeviceStatusMaintenance {
+		return nil
+	}
+	return TransitionDeviceStatus(h.DB, device, models.DeviceStatusAnomalous, "数据异常")
+}
+
+type BatchReading struct {
+	Timestamp int64             `json:"timestamp" binding:"required"`
+	Data      *models.DataEntry `json:"data" binding:"required"`
+	Season    string            `json:"season"` // 季节，仅作参考
+	Scene     string            `json:"scene"`  // 场景，仅作参考
+}
+
+type DataBatchUploadRequest struct {
+	DeviceID  string         `json:"device_id" binding:"required"`
+	Timestamp int64          `json:"timestamp" binding:"required"` // 发送时间，一分钟内有效
+	Readings  []BatchReading `json:"readings" binding:"required,min=1,dive"`
+	Signature string         `json:"signature" binding:"required"` // md5(device_id:timestamp:sha256(各条读数的规范形式):secret)
+}
+
+// 批量上传中单条读数的结果
+type BatchItemResult struct {
+	Index     int    `json:"index"`
+	Timestamp int64  `json:"timestamp"`
+	Status    string `json:"status"` // accepted/duplicate/expired/future/anomaly
+	Detail    any    `json:"detail,omitempty"`
+}
+
+// 设备离线期间缓存的读数，恢复连接后批量补传
+func (h *DataHandler) UploadBatch(c *gin.Context) {
+	var reqBody DataBatchUploadRequest
+	if err := bindDeviceRequest(c, &reqBody); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	batchMax := h.BatchUploadMax
+	if batchMax <= 0 {
+		batchMax = 500
+	}
+	if len(reqBody.Readings) > batchMax {
+		utils.Respond(c, nil, utils.ErrorCode{
+			Code:     4,
+			HttpCode: 400,
+			Message:  fmt.Sprintf("单次最多上传%d条数据", batchMax),
+		})
+		return
+	}
+
+	// 验证设备与签名
+	device, ok := authenticateDevice(c, h.DB, reqBody.DeviceID, reqBody.Timestamp, reqBody.Signature, canonicalDigest(reqBody.canonical()))
+	if !ok {
+		return
+	}
+
+	window := h.HistoryWindow
+	if window <= 0 {
+		window = 24 * 3600 // 默认一天
+	}
+	now := time.Now()
+	oldest := now.Add(-time.Duration(window) * time.Second).Unix()
+	// 允许设备时钟有少量偏差
+	newest := now.Add(time.Minute).Unix()
+
+	results := make([]BatchItemResult, len(reqBody.Readings))
+	accepted, anomalous := 0, 0
+	for i, reading := range reqBody.Readings {
+		results[i] = BatchItemResult{Index: i, Timestamp: reading.Timestamp}
+		if reading.Timestamp < oldest {
+			results[i].Status = "expired"
+			continue
+		}
+		if reading.Timestamp > newest {
+			results[i].Status = "future"
+			continue
+		}
+
+		result, err := h.ingestReading(c, device, reading.Timestamp, *reading.Data, reading.Scene, reading.Season)
+		if errors.Is(err, errEmptyReading) {
+			results[i].Status = "invalid"
+			continue
+		}
+		if err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		switch {
+		case result.Anomaly != nil:
+			results[i].Status = "anomaly"
+			results[i].Detail = gin.H{
+				"anomaly_fields":  result.Anomaly.AnomalyFields,
+				"anomaly_details": result.Anomaly.AnomalyDetails,
+				"quarantined":     true,
+			}
+			anomalous++
+		case result.Duplicate:
+			results[i].Status = "duplicate"
+		default:
+			results[i].Status = "accepted"
+			accepted++
+		}
+	}
+
+	if err := h.scheduleAggregation(c, device); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	// 历史数据中的异常只反映在单条结果中，不影响设备当前状态
+	if err := h.markReceived(device); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	utils.Respond(c, gin.H{
+		"accepted":  accepted,
+		"anomalous": anomalous,
+		"results":   results,
+	}, utils.ErrOK)
+}
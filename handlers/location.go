@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"errors"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type OrganizationHandler struct {
+	BaseHandler[models.Organization]
+}
+
+type SiteHandler struct {
+	BaseHandler[models.Site]
+}
+
+type RoomHandler struct {
+	BaseHandler[models.Room]
+}
+
+// 按位置节点过滤，column 为被过滤表中代表设备UUID的列
+func filterByLocation(c *gin.Context, db *gorm.DB, query *gorm.DB, column string) *gorm.DB {
+	rooms := db.Model(&models.Room{}).Select("uuid")
+	filtered := false
+
+	if roomUUID := c.Query("room_uuid"); roomUUID != "" {
+		rooms = rooms.Where("uuid = ?", roomUUID)
+		filtered = true
+	}
+	if floor := c.Query("floor"); floor != "" {
+		rooms = rooms.Where("floor = ?", floor)
+		filtered = true
+	}
+	if siteUUID := c.Query("site_uuid"); siteUUID != "" {
+		rooms = rooms.Where("site_uuid = ?", siteUUID)
+		filtered = true
+	}
+	if orgUUID := c.Query("organization_uuid"); orgUUID != "" {
+		sites := db.Model(&models.Site{}).Select("uuid").Where("organization_uuid = ?", orgUUID)
+		rooms = rooms.Where("site_uuid IN (?)", sites)
+		filtered = true
+	}
+
+	if !filtered {
+		return query
+	}
+	devices := db.Model(&models.Device{}).Select("uuid").Where("room_uuid IN (?)", rooms)
+	return query.Where(column+" IN (?)", devices)
+}
+
+// 解析并校验父节点UUID
+func parseParentUUID(db *gorm.DB, model any, data map[string]any, key string) (*uuid.UUID, error) {
+	str, ok := data[key].(string)
+	if !ok || str == "" {
+		return nil, errors.New(key + " is required")
+	}
+	uid, err := uuid.Parse(str)
+	if err != nil {
+		return nil, errors.New("invalid " + key)
+	}
+	if err := db.First(model, "uuid = ?", uid).Error; err != nil {
+		return nil, utils.ErrNotFound
+	}
+	return &uid, nil
+}
+
+// 存在子节点时拒绝删除
+func destroyIfEmpty(c *gin.Context, db *gorm.DB, child any, column string) bool {
+	var count int64
+	if err := db.Model(child).Where(column+" = ?", c.Param("uuid")).Count(&count).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return false
+	}
+	if count > 0 {
+		utils.Respond(c, nil, utils.ErrorCode{
+			Code:     4,
+			HttpCode: 400,
+			Message:  "请先移除下级节点",
+		})
+		return false
+	}
+	return true
+}
+
+// ===== 组织 =====
+
+func (h *OrganizationHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, org *models.Organization, data map[string]any) error {
+			name, ok := data["name"].(string)
+			if !ok || name == "" {
+				return errors.New("name is required")
+			}
+			org.Name = name
+			org.Description, _ = data["description"].(string)
+			return nil
+		},
+	)(c)
+}
+
+func (h *OrganizationHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		[]string{"uuid", "created_at", "name", "description"},
+		nil,
+	)(c)
+}
+
+func (h *OrganizationHandler) Retrieve(c *gin.Context) {
+	h.BaseHandler.Retrieve(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Preload("Sites.Rooms").Where("uuid = ?", c.Param("uuid"))
+		},
+	)(c)
+}
+
+func (h *OrganizationHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, org *models.Organization, data map[string]any) error {
+			if name, ok := data["name"].(string); ok && name != "" {
+				org.Name = name
+			}
+			if description, ok := data["description"].(string); ok {
+				org.Description = description
+			}
+			return nil
+		},
+	)(c)
+}
+
+func (h *OrganizationHandler) Destroy(c *gin.Context) {
+	if !destroyIfEmpty(c, h.DB, &models.Site{}, "organization_uuid") {
+		return
+	}
+	h.BaseHandler.Destroy(
+		nil,
+	)(c)
+}
+
+// ===== 站点 =====
+
+func (h *SiteHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, site *models.Site, data map[string]any) error {
+			orgUUID, err := parseParentUUID(h.DB, &models.Organization{}, data, "organization_uuid")
+			if err != nil {
+				return err
+			}
+			name, ok := data["name"].(string)
+			if !ok || name == "" {
+				return errors.New("name is required")
+			}
+			site.OrganizationUUID = orgUUID
+			site.Name = name
+			site.Address, _ = data["address"].(string)
+			return nil
+		},
+	)(c)
+}
+
+func (h *SiteHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		[]string{"uuid", "created_at", "organization_uuid", "name", "address"},
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			if orgUUID := c.Query("organization_uuid"); orgUUID != "" {
+				query = query.Where("organization_uuid = ?", orgUUID)
+			}
+			return query
+		},
+	)(c)
+}
+
+func (h *SiteHandler) Retrieve(c *gin.Context) {
+	h.BaseHandler.Retrieve(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Preload("Rooms").Where("uuid = ?", c.Param("uuid"))
+		},
+	)(c)
+}
+
+func (h *SiteHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, site *models.Site, data map[string]any) error {
+			if _, ok := data["organization_uuid"]; ok {
+				orgUUID, err := parseParentUUID(h.DB, &models.Organization{}, data, "organization_uuid")
+				if err != nil {
+					return err
+				}
+				site.OrganizationUUID = orgUUID
+			}
+			if name, ok := data["name"].(string); ok && name != "" {
+				site.Name = name
+			}
+			if address, ok := data["address"].(string); ok {
+				site.Address = address
+			}
+			return nil
+		},
+	)(c)
+}
+
+func (h *SiteHandler) Destroy(c *gin.Context) {
+	if !destroyIfEmpty(c, h.DB, &models.Room{}, "site_uuid") {
+		return
+	}
+	h.BaseHandler.Destroy(
+		nil,
+	)(c)
+}
+
+// ===== 房间 =====
+
+func (h *RoomHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, room *models.Room, data map[string]any) error {
+			siteUUID, err := parseParentUUID(h.DB, &models.Site{}, data, "site_uuid")
+			if err != nil {
+				return err
+			}
+			name, ok := data["name"].(string)
+			if !ok || name == "" {
+				return errors.New("name is required")
+			}
+			room.SiteUUID = siteUUID
+			room.Name = name
+			room.Floor, _ = data["floor"].(string)
+			return nil
+		},
+	)(c)
+}
+
+func (h *RoomHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		[]string{"uuid", "created_at", "site_uuid", "name", "floor"},
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			if siteUUID := c.Query("site_uuid"); siteUUID != "" {
+				query = query.Where("site_uuid = ?", siteUUID)
+			}
+			if floor := c.Query("floor"); floor != "" {
+				query = query.Where("floor = ?", floor)
+			}
+			if orgUUID := c.Query("organization_uuid"); orgUUID != "" {
+				query = query.Where("site_uuid IN (?)", h.DB.Model(&models.Site{}).Select("uuid").Where("organization_uuid = ?", orgUUID))
+			}
+			return query
+		},
+	)(c)
+}
+
+func (h *RoomHandler) Retrieve(c *gin.Context) {
+	h.BaseHandler.Retrieve(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Preload("Devices").Where("uuid = ?", c.Param("uuid"))
+		},
+	)(c)
+}
+
+func (h *RoomHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, room *models.Room, data map[string]any) error {
+			if _, ok := data["site_uuid"]; ok {
+				siteUUID, err := parseParentUUID(h.DB, &models.Site{}, data, "site_uuid")
+				if err != nil {
+					return err
+				}
+				room.SiteUUID = siteUUID
+			}
+			if name, ok := data["name"].(string); ok && name != "" {
+				room.Name = name
+			}
+			if floor, ok := data["floor"].(string); ok {
+				room.Floor = floor
+			}
+			return nil
+		},
+	)(c)
+}
+
+func (h *RoomHandler) Destroy(c *gin.Context) {
+	if !destroyIfEmpty(c, h.DB, &models.Device{}, "room_uuid") {
+		return
+	}
+	h.BaseHandler.Destroy(
+		nil,
+	)(c)
+}
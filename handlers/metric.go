@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"slices"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type MetricHandler struct {
+	BaseHandler[models.Metric]
+}
+
+// 指标注册表缓存，启动时及指标变更后重新加载
+var metricRegistry = struct {
+	sync.RWMutex
+	metrics map[string]models.Metric
+}{metrics: make(map[string]models.Metric)}
+
+// 指标名只允许小写字母、数字和下划线
+var metricKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// 写入缺失的内置指标
+func SeedMetrics(db *gorm.DB) error {
+	for _, metric := range models.BuiltinMetrics {
+		metric.Builtin = true
+		if err := db.Where("`key` = ?", metric.Key).FirstOrCreate(&metric).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从数据库重新加载指标注册表
+func LoadMetrics(db *gorm.DB) error {
+	var metrics []models.Metric
+	if err := db.Find(&metrics).Error; err != nil {
+		return err
+	}
+	registry := make(map[string]models.Metric, len(metrics))
+	for _, metric := range metrics {
+		registry[metric.Key] = metric
+	}
+	metricRegistry.Lock()
+	metricRegistry.metrics = registry
+	metricRegistry.Unlock()
+	return nil
+}
+
+// 查找已登记的指标，注册表尚未加载时内置指标仍然有效
+func LookupMetric(key string) (models.Metric, bool) {
+	metricRegistry.RLock()
+	metric, ok := metricRegistry.metrics[key]
+	metricRegistry.RUnlock()
+	if ok {
+		return metric, true
+	}
+	for _, metric := range models.BuiltinMetrics {
+		if metric.Key == key {
+			return metric, true
+		}
+	}
+	return models.Metric{}, false
+}
+
+// 指标的显示名称，未登记时使用指标名
+func metricName(key string) string {
+	if metric, ok := LookupMetric(key); ok && metric.NameZh != "" {
+		return metric.NameZh
+	}
+	return key
+}
+
+// 统计数据中某项指标的 SQL 表达式，prefix 为 avg、min 等列名前缀。
+// 内置指标为固定列，未上报时为 NULL；扩展指标从 JSON 列中提取
+func metricColumn(prefix, key string) string {
+	if column, ok := models.DataEntryColumns[key]; ok {
+		return fmt.Sprintf("IF(COALESCE(%s_missing, '') LIKE '%%\"%s\"%%', NULL, %s_%s)", prefix, key, prefix, column)
+	}
+	return fmt.Sprintf("JSON_EXTRACT(%s_extra, '$.%s')", prefix, key)
+}
+
+// 设备支持的指标，未声明时为全部内置指标
+func deviceMetrics(device *models.Device) []string {
+	if len(device.Capabilities) > 0 {
+		return device.Capabilities
+	}
+	return models.DataEntryKeys
+}
+
+// 检查读数中的指标是否已登记、是否为设备声明支持的指标以及是否在传感器量程内，
+// 并按指标精度取整。发现问题时记录在 result 中
+func validateMetrics(device *models.Device, entry *models.DataEntry, result *AnomalyResult) {
+	capabilities := deviceMetrics(device)
+	addAnomaly := func(key, detail string) {
+		result.IsNormal = false
+		result.AnomalyFields = append(result.AnomalyFields, key)
+		result.AnomalyDetails[key] = detail
+	}
+
+	for _, key := range entry.Keys() {
+		metric, registered := LookupMetric(key)
+		supported := slices.Contains(capabilities, key)
+		if !registered {
+			addAnomaly(key, "未登记的指标")
+			continue
+		}
+		// 内置指标为固定字段，设备不支持时忽略
+		if !supported {
+			if _, builtin := models.DataEntryColumns[key]; !builtin {
+				addAnomaly(key, "设备未声明支持该指标")
+			}
+			continue
+		}
+
+		value, _ := entry.Get(key)
+		if (metric.ValidMin != nil && float64(value) < *metric.ValidMin) || (metric.ValidMax != nil && float64(value) > *metric.ValidMax) {
+			addAnomaly(key, fmt.Sprintf("数值%.3f超出传感器量程", value))
+			continue
+		}
+		scale := math.Pow10(metric.Precision)
+		entry.Set(key, float32(math.Round(float64(value)*scale)/scale))
+	}
+}
+
+// 解析设备声明支持的指标
+func parseCapabilities(value any) ([]string, error) {
+	list, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("invalid capabilities")
+	}
+	capabilities := make([]string, 0, len(list))
+	for _, item := range list {
+		key, ok := item.(string)
+		if !ok {
+			return nil, errors.New("invalid capabilities")
+		}
+		if _, registered := LookupMetric(key); !registered {
+			return nil, fmt.Errorf("未登记的指标：%s", key)
+		}
+		if !slices.Contains(capabilities, key) {
+			capabilities = append(capabilities, key)
+		}
+	}
+	return capabilities, nil
+}
+
+// 解析指标参数
+func parseMetric(metric *models.Metric, data map[string]any) error {
+	for key, dst := range map[string]*string{"unit": &metric.Unit, "name_zh": &metric.NameZh, "name_en": &metric.NameEn} {
+		if value, ok := data[key].(string); ok {
+			*dst = value
+		}
+	}
+	for key, dst := range map[string]**float64{"valid_min": &metric.ValidMin, "valid_max": &metric.ValidMax, "max_rate": &metric.MaxRate} {
+		value, ok := data[key]
+		if !ok {
+			continue
+		}
+		if value == nil {
+			*dst = nil
+			continue
+		}
+		number, ok := value.(float64)
+		if !ok {
+			return errors.New("invalid " + key)
+		}
+		*dst = &number
+	}
+	if metric.ValidMin != nil && metric.ValidMax != nil && *metric.ValidMin >= *metric.ValidMax {
+		return errors.New("valid_min must be less than valid_max")
+	}
+	if metric.MaxRate != nil && *metric.MaxRate <= 0 {
+		return errors.New("invalid max_rate")
+	}
+	if value, ok := data["precision"]; ok {
+		precision, ok := value.(float64)
+		if !ok || precision < 0 || precision > 6 || precision != float64(int(precision)) {
+			return errors.New("invalid precision")
+		}
+		metric.Precision = int(precision)
+	}
+	return nil
+}
+
+// 指标变更成功后重新加载注册表
+func (h *MetricHandler) reload(c *gin.Context) {
+	if c.Writer.Status() < 300 {
+		if err := LoadMetrics(h.DB); err != nil {
+			log.Println("重新加载指标注册表失败：", err)
+		}
+	}
+}
+
+func (h *MetricHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, metric *models.Metric, data map[string]any) error {
+			key, _ := data["key"].(string)
+			if !metricKeyPattern.MatchString(key) || key == "extra" || key == "aqi" || key == "missing" {
+				return errors.New("invalid key")
+			}
+			var count int64
+			if err := h.DB.Model(&models.Metric{}).Where("`key` = ?", key).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return errors.New("指标已存在")
+			}
+			metric.Key = key
+			metric.Precision = 3
+			return parseMetric(metric, data)
+		},
+	)(c)
+	h.reload(c)
+}
+
+func (h *MetricHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		nil,
+	)(c)
+}
+
+// 指标名不可修改
+func (h *MetricHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, metric *models.Metric, data map[string]any) error {
+			return parseMetric(metric, data)
+		},
+	)(c)
+	h.reload(c)
+}
+
+// 内置指标和仍被设备声明支持的指标不可删除
+func (h *MetricHandler) Destroy(c *gin.Context) {
+	metric := &models.Metric{}
+	if err := h.DB.First(metric, "uuid = ?", c.Param("uuid")).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	if metric.Builtin {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: "内置指标不可删除"})
+		return
+	}
+	var count int64
+	if err := h.DB.Model(&models.Device{}).Where("capabilities LIKE ?", fmt.Sprintf("%%\"%s\"%%", metric.Key)).Count(&count).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	if count > 0 {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: "仍有设备声明支持该指标"})
+		return
+	}
+
+	h.BaseHandler.Destroy(
+		nil,
+	)(c)
+	h.reload(c)
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// MQTT 主题，{id} 为设备的 device_id：
+//
+//	devices/{id}/telemetry          设备上传数据
+//	devices/{id}/telemetry/result   上传结果，与 HTTP 上传的响应体相同
+//	devices/{id}/commands           下发待执行的指令
+//	devices/{id}/commands/ack       设备确认指令执行结果
+const (
+	mqttTopicPrefix    = "devices/"
+	mqttTelemetry      = "telemetry"
+	mqttTelemetryReply = "telemetry/result"
+	mqttCommands       = "commands"
+	mqttCommandAck     = "commands/ack"
+)
+
+// 通过 MQTT 上传的数据，连接已通过设备密钥认证，因此不需要签名
+type MQTTTelemetry struct {
+	Timestamp int64             `json:"timestamp"` // 为空时使用服务端时间
+	Data      *models.DataEntry `json:"data"`
+	Season    string            `json:"season"`
+	Scene     string            `json:"scene"`
+	Reported  *TwinReport       `json:"reported"`
+
+	FirmwareVersion string `json:"firmware_version"`
+	FirmwareError   string `json:"firmware_error"`
+}
+
+type MQTTCommandAck struct {
+	CommandUUID string `json:"command_uuid"`
+	Status      string `json:"status"` // acked/failed
+	Result      string `json:"result"`
+}
+
+// 内嵌的 MQTT 服务，设备以 device_id 为用户名、secret 为密码连接
+type MQTTBroker struct {
+	mqtt.HookBase
+	Server *mqtt.Server
+	Data   *DataHandler
+}
+
+func NewMQTTBroker(data *DataHandler) *MQTTBroker {
+	broker := &MQTTBroker{
+		Server: mqtt.New(&mqtt.Options{InlineClient: true}),
+		Data:   data,
+	}
+	if err := broker.Server.AddHook(broker, nil); err != nil {
+		log.Fatalf("MQTT服务初始化失败: %v", err)
+	}
+	return broker
+}
+
+// 在指定地址监听设备连接
+func (b *MQTTBroker) Start(addr string) error {
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})
+	if err := b.Server.AddListener(listener); err != nil {
+		return err
+	}
+	return b.Server.Serve()
+}
+
+func (b *MQTTBroker) ID() string {
+	return "ssat-device-auth"
+}
+
+func (b *MQTTBroker) Provides(hook byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnPublish,
+	}, []byte{hook})
+}
+
+// 校验设备ID和密钥
+func (b *MQTTBroker) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	device := &models.Device{}
+	if err := b.Data.DB.First(device, "device_id = ?", string(pk.Connect.Username)).Error; err != nil {
+		return false
+	}
+	return device.Secret != "" && subtle.ConstantTimeCompare([]byte(device.Secret), pk.Connect.Password) == 1
+}
+
+// 设备只能访问自己的主题，且只能发布数据和指令确认
+func (b *MQTTBroker) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	prefix := mqttTopicPrefix + string(cl.Properties.Username) + "/"
+	if !strings.HasPrefix(topic, prefix) {
+		return false
+	}
+	if !write {
+		return true
+	}
+	suffix := strings.TrimPrefix(topic, prefix)
+	return suffix == mqttTelemetry || suffix == mqttCommandAck
+}
+
+// 处理设备发布的消息，设备的消息不会转发给其他订阅者
+func (b *MQTTBroker) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	device := &models.Device{}
+	if err := b.Data.DB.First(device, "device_id = ?", string(cl.Properties.Username)).Error; err != nil {
+		return pk, packets.ErrNotAuthorized
+	}
+
+	switch strings.TrimPrefix(pk.TopicName, mqttTopicPrefix+device.DeviceID+"/") {
+	case mqttTelemetry:
+		b.handleTelemetry(device, pk.Payload)
+	case mqttCommandAck:
+		b.handleCommandAck(device, pk.Payload)
+	}
+	return pk, packets.CodeSuccessIgnore
+}
+
+// 向设备发送消息
+func (b *MQTTBroker) publish(device *models.Device, suffix string, payload any) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("MQTT消息序列化失败: %v", err)
+		return
+	}
+	if err := b.Server.Publish(mqttTopicPrefix+device.DeviceID+"/"+suffix, body, false, 1); err != nil {
+		log.Printf("MQTT消息发送失败: %v", err)
+	}
+}
+
+// 回复上传结果，格式与 utils.Respond 相同
+func (b *MQTTBroker) reply(device *models.Device, data any, code utils.ErrorCode) {
+	b.publish(device, mqttTelemetryReply, gin.H{
+		"status":  code.Code,
+		"message": code.Message,
+		"data":    data,
+	})
+}
+
+// 与 DataHandler.Upload 相同的处理流程
+func (b *MQTTBroker) handleTelemetry(device *models.Device, payload []byte) {
+	var telemetry MQTTTelemetry
+	if err := json.Unmarshal(payload, &telemetry); err != nil {
+		b.reply(device, nil, utils.ErrBadRequest)
+		return
+	}
+	if telemetry.Data == nil {
+		b.reply(device, nil, utils.ErrMissingParam)
+		return
+	}
+
+	// 只接受历史数据窗口内的读数
+	window := b.Data.HistoryWindow
+	if window <= 0 {
+		window = 24 * 3600
+	}
+	now := time.Now()
+	if telemetry.Timestamp == 0 {
+		telemetry.Timestamp = now.Unix()
+	}
+	if telemetry.Timestamp < now.Add(-time.Duration(window)*time.Second).Unix() || telemetry.Timestamp > now.Add(time.Minute).Unix() {
+		b.reply(device, nil, utils.ErrExpiredRequest)
+		return
+	}
+
+	ctx := context.Background()
+	result, err := b.Data.ingestReading(ctx, device, telemetry.Timestamp, *telemetry.Data, telemetry.Scene, telemetry.Season)
+	if errors.Is(err, errEmptyReading) {
+		b.reply(device, nil, utils.ErrMissingParam)
+		return
+	}
+	if err != nil {
+		b.reply(device, nil, utils.ErrInternalServer)
+		return
+	}
+	if result.Anomaly != nil {
+		if err := b.Data.markAnomalous(device); err != nil {
+			b.reply(device, nil, utils.ErrInternalServer)
+			return
+		}
+		if result.Aggregated {
+			if err := b.Data.scheduleAggregation(ctx, device); err != nil {
+				b.reply(device, nil, utils.ErrInternalServer)
+				return
+			}
+		}
+		b.reply(device, gin.H{
+			"anomaly_fields":  result.Anomaly.AnomalyFields,
+			"anomaly_details": result.Anomaly.AnomalyDetails,
+			"quarantined":     true,
+		}, utils.ErrDataAnomaly)
+		return
+	}
+
+	if err := b.Data.scheduleAggregation(ctx, device); err != nil {
+		b.reply(device, nil, utils.ErrInternalServer)
+		return
+	}
+	if err := b.Data.markReceived(device); err != nil {
+		b.reply(device, nil, utils.ErrInternalServer)
+		return
+	}
+
+	response := gin.H{"scene": result.Scene, "season": result.Season}
+	if result.AQI != nil {
+		response["aqi"] = result.AQI
+	}
+	twin, err := SyncTwinOnUpload(b.Data.DB, device, telemetry.Reported)
+	if err != nil {
+		b.reply(device, nil, utils.ErrInternalServer)
+		return
+	}
+	if twin != nil {
+		response["twin"] = twin
+	}
+	firmware, err := OfferFirmware(b.Data.DB, device, telemetry.FirmwareVersion, telemetry.FirmwareError)
+	if err != nil {
+		b.reply(device, nil, utils.ErrInternalServer)
+		return
+	}
+	if firmware != nil {
+		response["firmware"] = firmware
+	}
+	b.reply(device, response, utils.ErrOK)
+
+	// 指令通过下行主题单独下发
+	b.PushCommands(device)
+}
+
+func (b *MQTTBroker) handleCommandAck(device *models.Device, payload []byte) {
+	var ack MQTTCommandAck
+	if err := json.Unmarshal(payload, &ack); err != nil || ack.CommandUUID == "" {
+		log.Printf("设备%s的指令确认格式错误", device.DeviceID)
+		return
+	}
+	if ack.Status != "failed" {
+		ack.Status = "acked"
+	}
+	if err := AckCommand(b.Data.DB, device, ack.CommandUUID, ack.Status, ack.Result); err != nil {
+		log.Printf("设备%s确认指令%s失败: %v", device.DeviceID, ack.CommandUUID, err)
+	}
+}
+
+// 将待执行的指令推送到设备的下行主题，设备未订阅时消息会被丢弃，下次上传时重新下发
+func (b *MQTTBroker) PushCommands(device *models.Device) {
+	commands, err := DeliverCommands(b.Data.DB, device)
+	if err != nil {
+		log.Printf("设备%s的指令下发失败: %v", device.DeviceID, err)
+		return
+	}
+	if len(commands) > 0 {
+		b.publish(device, mqttCommands, gin.H{"commands": commands})
+	}
+}
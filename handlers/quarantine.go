@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// 隔离读数的审核状态
+const (
+	QuarantinePending   = 0 // 待审核
+	QuarantineReleased  = 1 // 已放行，并入正常读数
+	QuarantineDiscarded = 2 // 已丢弃
+)
+
+// 异常检测未通过的读数
+type QuarantinedReading struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	DeviceID       string             `json:"device_id" bson:"device_id"`
+	Timestamp      int64              `json:"timestamp" bson:"timestamp"`
+	Data           models.DataEntry   `json:"data" bson:"data"` // 校准后的数据
+	RawData        *models.DataEntry  `json:"raw_data,omitempty" bson:"raw_data,omitempty"`
+	Scene          string             `json:"scene" bson:"scene"`
+	Season         string             `json:"season" bson:"season"`
+	AnomalyFields  []string           `json:"anomaly_fields" bson:"anomaly_fields"`
+	AnomalyDetails map[string]string  `json:"anomaly_details" bson:"anomaly_details"`
+	Aggregated     bool               `json:"aggregated" bson:"aggregated"` // 审核前已计入统计数据
+	Status         int                `json:"status" bson:"status"`
+	CreatedAt      time.Time          `json:"created_at" bson:"created_at"`
+	ReviewedAt     *time.Time         `json:"reviewed_at,omitempty" bson:"reviewed_at,omitempty"`
+	Reviewer       string             `json:"reviewer,omitempty" bson:"reviewer,omitempty"`
+}
+
+// 将异常读数存入隔离区，同一设备同一时间戳只保留一条
+func (h *DataHandler) quarantineReading(ctx context.Context, device *models.Device, timestamp int64, calibrated, raw models.DataEntry, result *IngestResult) error {
+	if h.QuarantineCollection == nil {
+		return nil
+	}
+	reading := QuarantinedReading{
+		DeviceID:       device.DeviceID,
+		Timestamp:      timestamp,
+		Data:           calibrated,
+		RawData:        &raw,
+		Scene:          result.Scene,
+		Season:         result.Season,
+		AnomalyFields:  result.Anomaly.AnomalyFields,
+		AnomalyDetails: result.Anomaly.AnomalyDetails,
+		Aggregated:     h.QuarantineInAggregates,
+		Status:         QuarantinePending,
+		CreatedAt:      time.Now(),
+	}
+	filter := bson.M{"device_id": device.DeviceID, "timestamp": timestamp}
+	_, err := h.QuarantineCollection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": reading}, options.Update().SetUpsert(true))
+	return err
+}
+
+// 查询某台设备一段时间内未被丢弃的隔离读数，用于在曲线上标记
+func (h *DataHandler) flaggedReadings(ctx context.Context, device *models.Device, from, to time.Time, metric string) ([]gin.H, error) {
+	flagged := []gin.H{}
+	if h.QuarantineCollection == nil {
+		return flagged, nil
+	}
+	filter := bson.M{
+		"device_id": device.DeviceID,
+		"status":    bson.M{"$ne": QuarantineDiscarded},
+		"timestamp": bson.M{"$gte": from.Unix(), "$lt": to.Unix()},
+	}
+	cursor, err := h.QuarantineCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var readings []QuarantinedReading
+	if err := cursor.All(ctx, &readings); err != nil {
+		return nil, err
+	}
+	for _, reading := range readings {
+		value, ok := metricValue(reading.Data, metric, false)
+		if !ok {
+			continue
+		}
+		flagged = append(flagged, gin.H{
+			"t":      reading.Timestamp,
+			"value":  value,
+			"status": reading.Status,
+			"detail": reading.AnomalyDetails[metric],
+		})
+	}
+	return flagged, nil
+}
+
+// 管理员查看隔离读数，device_id 为设备 UUID
+func (h *DataHandler) ListQuarantine(c *gin.Context) {
+	filter := bson.M{}
+	if deviceUUID := c.Query("device_id"); deviceUUID != "" {
+		device := &models.Device{}
+		if err := h.DB.First(device, "uuid = ?", deviceUUID).Error; err != nil {
+			utils.Respond(c, nil, utils.ErrNotFound)
+			return
+		}
+		filter["device_id"] = device.DeviceID
+	}
+	status := QuarantinePending
+	if value := c.Query("status"); value != "" {
+		var ok bool
+		if status, ok = map[string]int{"0": QuarantinePending, "1": QuarantineReleased, "2": QuarantineDiscarded}[value]; !ok {
+			utils.Respond(c, nil, utils.ErrBadRequest)
+			return
+		}
+	}
+	filter["status"] = status
+	timeRange := bson.M{}
+	if from, err := time.Parse(time.RFC3339, c.Query("from")); err == nil {
+		timeRange["$gte"] = from.Unix()
+	}
+	if to, err := time.Parse(time.RFC3339, c.Query("to")); err == nil {
+		timeRange["$lt"] = to.Unix()
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	total, err := h.QuarantineCollection.CountDocuments(c, filter)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	offset, limit := h.getPaginationParams(c)
+	cursor, err := h.QuarantineCollection.Find(c, filter, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit)))
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	items := []QuarantinedReading{}
+	if err := cursor.All(c, &items); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, gin.H{"count": total, "items": items}, utils.ErrOK)
+}
+
+type QuarantineReviewRequest struct {
+	IDs      []string `json:"ids"`       // 隔离读数 ID
+	DeviceID string   `json:"device_id"` // 设备 UUID，未指定 ids 时处理该设备全部待审核的读数
+}
+
+// 按请求查询待审核的隔离读数
+func (h *DataHandler) pendingQuarantine(ctx context.Context, req QuarantineReviewRequest) ([]QuarantinedReading, error) {
+	filter := bson.M{"status": QuarantinePending}
+	switch {
+	case len(req.IDs) > 0:
+		ids := make([]primitive.ObjectID, 0, len(req.IDs))
+		for _, value := range req.IDs {
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				return nil, errors.New("invalid id")
+			}
+			ids = append(ids, id)
+		}
+		filter["_id"] = bson.M{"$in": ids}
+	case req.DeviceID != "":
+		device := &models.Device{}
+		if err := h.DB.First(device, "uuid = ?", req.DeviceID).Error; err != nil {
+			return nil, errors.New("device not found")
+		}
+		filter["device_id"] = device.DeviceID
+	default:
+		return nil, errors.New("ids or device_id is required")
+	}
+
+	cursor, err := h.QuarantineCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var readings []QuarantinedReading
+	err = cursor.All(ctx, &readings)
+	return readings, err
+}
+
+// 记录审核结果
+func (h *DataHandler) markReviewed(ctx context.Context, reading *QuarantinedReading, status int, reviewer string) error {
+	_, err := h.QuarantineCollection.UpdateOne(ctx,
+		bson.M{"_id": reading.ID, "status": QuarantinePending},
+		bson.M{"$set": bson.M{"status": status, "reviewed_at": time.Now(), "reviewer": reviewer}})
+	return err
+}
+
+// 重新计算某条统计数据，读数已全部移除时删除该条统计数据
+func (h *DataHandler) refreshBatch(ctx context.Context, device *models.Device, batchID string) error {
+	data := &models.Data{}
+	if err := h.DB.First(data, "uuid = ?", batchID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	cursor, err := h.MongoCollection.Find(ctx, bson.M{"batch_id": batchID})
+	if err != nil {
+		return err
+	}
+	var readings []MongoData
+	if err := cursor.All(ctx, &readings); err != nil {
+		return err
+	}
+	if len(readings) == 0 {
+		err = h.DB.Delete(data).Error
+	} else {
+		summary := SummarizeReadings(readings)
+		summary.Apply(data)
+		err = h.DB.Save(data).Error
+	}
+	if err != nil {
+		return err
+	}
+	return h.rebuildParents(device, data)
+}
+
+// 批量审核隔离读数的公共流程，apply 处理单条读数
+func (h *DataHandler) reviewQuarantine(c *gin.Context, status int, apply func(ctx context.Context, device *models.Device, reading *QuarantinedReading) error) {
+	var req QuarantineReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+	readings, err := h.pendingQuarantine(c, req)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: err.Error()})
+		return
+	}
+	reviewer := c.MustGet("CurrentAdminUser").(*models.Admin).Username
+
+	devices := make(map[string]*models.Device)
+	for i := range readings {
+		reading := &readings[i]
+		device, ok := devices[reading.DeviceID]
+		if !ok {
+			device = &models.Device{}
+			if err := h.DB.First(device, "device_id = ?", reading.DeviceID).Error; err != nil {
+				utils.Respond(c, nil, utils.ErrInternalServer)
+				return
+			}
+			devices[reading.DeviceID] = device
+		}
+		if err := apply(c, device, reading); err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		if err := h.markReviewed(c, reading, status, reviewer); err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+	}
+
+	// 放行的读数按正常流程聚合
+	if status == QuarantineReleased {
+		for _, device := range devices {
+			if err := h.scheduleAggregation(c, device); err != nil {
+				utils.Respond(c, nil, utils.ErrInternalServer)
+				return
+			}
+		}
+	}
+	utils.Respond(c, gin.H{"reviewed": len(readings)}, utils.ErrOK)
+}
+
+// 放行隔离读数：确认为真实数据，并入正常读数参与统计
+func (h *DataHandler) ReleaseQuarantine(c *gin.Context) {
+	h.reviewQuarantine(c, QuarantineReleased, func(ctx context.Context, device *models.Device, reading *QuarantinedReading) error {
+		filter := bson.M{"device_id": reading.DeviceID, "timestamp": reading.Timestamp}
+		mongoData := MongoData{
+			DeviceID:  reading.DeviceID,
+			Timestamp: reading.Timestamp,
+			Data:      reading.Data,
+			RawData:   reading.RawData,
+			Processed: false,
+		}
+		res, err := h.MongoCollection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": mongoData}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		// 确认为真实数据后计入检测基线
+		recordHistory(reading.DeviceID, reading.Timestamp, reading.Data)
+		if res.UpsertedCount > 0 {
+			return nil
+		}
+		// 已计入统计的读数只清除异常标记
+		_, err = h.MongoCollection.UpdateOne(ctx, bson.M{"device_id": reading.DeviceID, "timestamp": reading.Timestamp, "anomalous": true},
+			bson.M{"$unset": bson.M{"anomalous": ""}})
+		return err
+	})
+}
+
+// 丢弃隔离读数，已计入统计的读数从正常读数中删除并重新计算所属统计数据
+func (h *DataHandler) DiscardQuarantine(c *gin.Context) {
+	h.reviewQuarantine(c, QuarantineDiscarded, func(ctx context.Context, device *models.Device, reading *QuarantinedReading) error {
+		if !reading.Aggregated {
+			return nil
+		}
+		var doc MongoData
+		filter := bson.M{"device_id": reading.DeviceID, "timestamp": reading.Timestamp, "anomalous": true}
+		err := h.MongoCollection.FindOneAndDelete(ctx, filter).Decode(&doc)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil || doc.BatchID == "" {
+			return err
+		}
+		return h.refreshBatch(ctx, device, doc.BatchID)
+	})
+}
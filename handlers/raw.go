@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 原始读数查询每页默认条数
+const defaultRawPageSize = 100
+
+// 分页游标为上一页最后一条读数的 "时间戳_ID"
+func parseRawCursor(cursor string) (int64, primitive.ObjectID, error) {
+	parts := strings.SplitN(cursor, "_", 2)
+	if len(parts) != 2 {
+		return 0, primitive.NilObjectID, errors.New("invalid cursor")
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, primitive.NilObjectID, err
+	}
+	id, err := primitive.ObjectIDFromHex(parts[1])
+	return timestamp, id, err
+}
+
+// 按查询参数查询原始读数，devices 为允许查询的设备，为 nil 表示不限。
+// 设备的 DataVisibleFrom 不为空时只返回此后的读数
+func (h *DataHandler) queryRaw(c *gin.Context, devices []models.Device) {
+	filter := bson.M{}
+	if devices != nil {
+		or := make(bson.A, 0, len(devices))
+		for _, device := range devices {
+			condition := bson.M{"device_id": device.DeviceID}
+			if device.DataVisibleFrom != nil {
+				condition["timestamp"] = bson.M{"$gte": device.DataVisibleFrom.Unix()}
+			}
+			or = append(or, condition)
+		}
+		filter["$or"] = or
+	}
+
+	timeRange := bson.M{}
+	if from, err := time.Parse(time.RFC3339, c.Query("from")); err == nil {
+		timeRange["$gte"] = from.Unix()
+	}
+	if to, err := time.Parse(time.RFC3339, c.Query("to")); err == nil {
+		timeRange["$lt"] = to.Unix()
+	}
+	if len(timeRange) > 0 {
+		filter["$and"] = bson.A{bson.M{"timestamp": timeRange}}
+	}
+
+	// 按时间排序，时间相同时按 ID 排序
+	desc := c.Query("order") == "desc"
+	direction, compare := 1, "$gt"
+	if desc {
+		direction, compare = -1, "$lt"
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		timestamp, id, err := parseRawCursor(cursor)
+		if err != nil {
+			utils.Respond(c, nil, utils.ErrBadRequest)
+			return
+		}
+		after := bson.M{"$or": bson.A{
+			bson.M{"timestamp": bson.M{compare: timestamp}},
+			bson.M{"timestamp": timestamp, "_id": bson.M{compare: id}},
+		}}
+		if and, ok := filter["$and"].(bson.A); ok {
+			filter["$and"] = append(and, after)
+		} else {
+			filter["$and"] = bson.A{after}
+		}
+	}
+
+	maxPoints := h.RawMaxPoints
+	if maxPoints <= 0 {
+		maxPoints = 1000
+	}
+	limit := defaultRawPageSize
+	if value, err := strconv.Atoi(c.Query("limit")); err == nil && value > 0 {
+		limit = value
+	}
+	limit = min(limit, maxPoints)
+
+	// 只返回选择的字段，未选择时返回全部指标
+	var fields []string
+	projection := bson.M{"_id": 1, "device_id": 1, "timestamp": 1, "anomalous": 1}
+	if selected := c.Query("fields"); selected != "" {
+		fields = strings.Split(selected, ",")
+		for _, field := range fields {
+			if _, ok := LookupMetric(field); !ok {
+				utils.Respond(c, nil, utils.ErrBadRequest)
+				return
+			}
+			projection["data."+models.DataEntryBSONField(field)] = 1
+		}
+		projection["data.missing"] = 1
+	} else {
+		projection["data"] = 1
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit)).
+		SetProjection(projection)
+	cursor, err := h.MongoCollection.Find(c, filter, findOptions)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	var readings []MongoData
+	if err := cursor.All(c, &readings); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	items := make([]gin.H, 0, len(readings))
+	for _, reading := range readings {
+		keys := fields
+		if keys == nil {
+			keys = reading.Data.Keys()
+		}
+		data := make(gin.H, len(keys))
+		for _, key := range keys {
+			if value, ok := reading.Data.Get(key); ok {
+				data[key] = value
+			}
+		}
+		items = append(items, gin.H{
+			"id":        reading.ID,
+			"device_id": reading.DeviceID,
+			"timestamp": reading.Timestamp,
+			"data":      data,
+			"anomalous": reading.Anomalous,
+		})
+	}
+
+	response := gin.H{"items": items, "next_cursor": nil}
+	if len(readings) == limit {
+		last := readings[len(readings)-1]
+		response["next_cursor"] = fmt.Sprintf("%d_%s", last.Timestamp, last.ID.Hex())
+	}
+	utils.Respond(c, response, utils.ErrOK)
+}
+
+// 管理员查询原始读数，device_id 为设备 UUID，可选
+func (h *DataHandler) Raw(c *gin.Context) {
+	var devices []models.Device
+	if deviceUUID := c.Query("device_id"); deviceUUID != "" {
+		device := models.Device{}
+		if err := h.DB.First(&device, "uuid = ?", deviceUUID).Error; err != nil {
+			utils.Respond(c, nil, utils.ErrNotFound)
+			return
+		}
+		devices = []models.Device{device}
+		// 管理员不受数据可见时间限制
+		devices[0].DataVisibleFrom = nil
+	}
+	h.queryRaw(c, devices)
+}
+
+// 用户查询自己设备的原始读数，device_id 为设备 UUID，必填
+func (h *DataHandler) MyRaw(c *gin.Context) {
+	currentUser := c.MustGet("CurrentUser").(*models.User)
+	deviceUUID := c.Query("device_id")
+	if deviceUUID == "" {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	device := models.Device{}
+	if err := h.DB.First(&device, "uuid = ? AND owner_id = ?", deviceUUID, currentUser.UUID).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	h.queryRaw(c, []models.Device{device})
+}
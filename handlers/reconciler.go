@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 一次补充聚合的结果
+type FlushReport struct {
+	Devices  int `json:"devices"`  // 存在积压数据的设备数
+	Batches  int `json:"batches"`  // 生成或更新的统计数据条数
+	Readings int `json:"readings"` // 聚合的读数条数
+	Failed   int `json:"failed"`   // 聚合失败的设备数
+	Queued   int `json:"queued"`   // 已交给后台聚合任务的设备数，其统计数据不计入 batches 和 readings
+}
+
+// 聚合所有设备中早于 maxAge 的未处理数据，不受 MongoToSQLThreshold 限制。
+// 启用后台聚合时由聚合任务执行，与上传触发的聚合按设备串行
+func (h *DataHandler) FlushPending(ctx context.Context, maxAge time.Duration) (*FlushReport, error) {
+	cutoff := time.Now().Add(-maxAge).Unix()
+	filter := bson.M{
+		"processed": false,
+		"batch_id":  bson.M{"$exists": false},
+		"timestamp": bson.M{"$lt": cutoff},
+	}
+	deviceIDs, err := h.MongoCollection.Distinct(ctx, "device_id", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FlushReport{}
+	for _, deviceID := range deviceIDs {
+		device := &models.Device{}
+		if err := h.DB.First(device, "device_id = ?", deviceID).Error; err != nil {
+			log.Printf("补充聚合找不到设备%v: %v", deviceID, err)
+			continue
+		}
+		report.Devices++
+
+		if h.Aggregator != nil {
+			if h.Aggregator.Enqueue(device, cutoff) {
+				report.Queued++
+			} else {
+				report.Failed++
+			}
+			continue
+		}
+		batches, readings, err := h.flushDevice(ctx, device, cutoff)
+		report.Batches += batches
+		report.Readings += readings
+		if err != nil {
+			report.Failed++
+			log.Printf("设备%s补充聚合失败: %v", device.DeviceID, err)
+		}
+	}
+	return report, nil
+}
+
+// 先按正常规则聚合，再将剩余不足一批的过期数据单独生成统计数据
+func (h *DataHandler) flushDevice(ctx context.Context, device *models.Device, cutoff int64) (batches int, readings int, err error) {
+	batches, readings, err = h.aggregatePending(ctx, device)
+	// 按时间窗口聚合时，已结束的窗口都已在上一步处理
+	if err != nil || h.AggregationMode == AggregationModeWindow {
+		return batches, readings, err
+	}
+
+	store := h.batches()
+	for {
+		count, err := store.CountUnclaimed(ctx, device.DeviceID, cutoff)
+		if err != nil || count == 0 {
+			return batches, readings, err
+		}
+		n, err := h.claimBatch(ctx, device, cutoff)
+		if err != nil {
+			return batches, readings, err
+		}
+		if n > 0 {
+			batches++
+			readings += n
+		}
+	}
+}
+
+// 定期补充聚合长时间未达到阈值的数据
+type DataReconciler struct {
+	Data     *DataHandler
+	Interval time.Duration
+	MaxAge   time.Duration // 未处理数据超过该时长后强制聚合
+}
+
+func (r *DataReconciler) Run() {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := r.Data.FlushPending(context.Background(), r.MaxAge)
+		if err != nil {
+			log.Println("补充聚合失败：", err)
+			continue
+		}
+		if report.Readings > 0 || report.Failed > 0 || report.Queued > 0 {
+			log.Printf("补充聚合完成：%d台设备，%d条读数，%d条统计数据，%d台失败，%d台已入队", report.Devices, report.Readings, report.Batches, report.Failed, report.Queued)
+		}
+	}
+}
+
+type FlushRequest struct {
+	MaxAge *int `json:"max_age"` // 秒，为空时使用配置的默认值，为 0 时聚合全部未处理数据
+}
+
+// 管理员手动触发补充聚合
+func (h *DataHandler) Flush(c *gin.Context) {
+	var req FlushRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+
+	maxAge := h.FlushAge
+	if req.MaxAge != nil {
+		if *req.MaxAge < 0 {
+			utils.Respond(c, nil, utils.ErrBadRequest)
+			return
+		}
+		maxAge = *req.MaxAge
+	}
+
+	report, err := h.FlushPending(c, time.Duration(maxAge)*time.Second)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, report, utils.ErrOK)
+}
@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// 按保留策略清理的统计数据粒度，天统计数据永久保留
+var fineResolutions = []string{models.Resolution5Min, models.ResolutionHour, models.ResolutionBatch}
+
+type RetentionHandler struct {
+	MongoCollection      *mongo.Collection
+	QuarantineCollection *mongo.Collection // 已审核的隔离读数与原始读数一同清理
+	RawDays              int               // 全局原始读数保留天数，0 表示永久保留
+	FineDays             int               // 全局 5 分钟、小时和按条数聚合的统计数据保留天数，0 表示永久保留
+	BaseHandler[models.RetentionPolicy]
+}
+
+// 单个设备的清理结果
+type DeviceRetention struct {
+	DeviceUUID  uuid.UUID `json:"device_uuid"`
+	DeviceID    string    `json:"device_id"`
+	RawDays     int       `json:"raw_days"`
+	FineDays    int       `json:"fine_days"`
+	RawReadings int64     `json:"raw_readings"` // 删除（或将要删除）的原始读数条数
+	FineRows    int64     `json:"fine_rows"`    // 删除（或将要删除）的统计数据条数
+}
+
+type RetentionReport struct {
+	DryRun      bool              `json:"dry_run"`
+	RawReadings int64             `json:"raw_readings"`
+	FineRows    int64             `json:"fine_rows"`
+	Devices     []DeviceRetention `json:"devices"`
+}
+
+// 一次清理使用的保留策略和房间所属的组织，清理开始时一次性加载
+type retentionPolicies struct {
+	devices           map[uuid.UUID]models.RetentionPolicy
+	organizations     map[uuid.UUID]models.RetentionPolicy
+	roomOrganizations map[uuid.UUID]uuid.UUID
+}
+
+func (h *RetentionHandler) loadRetentionPolicies() (*retentionPolicies, error) {
+	var policies []models.RetentionPolicy
+	if err := h.DB.Find(&policies).Error; err != nil {
+		return nil, err
+	}
+	var rooms []struct {
+		UUID             uuid.UUID
+		OrganizationUUID uuid.UUID
+	}
+	if err := h.DB.Model(&models.Room{}).
+		Select("rooms.uuid, sites.organization_uuid").
+		Joins("JOIN sites ON sites.uuid = rooms.site_uuid").
+		Scan(&rooms).Error; err != nil {
+		return nil, err
+	}
+
+	p := &retentionPolicies{
+		devices:           make(map[uuid.UUID]models.RetentionPolicy),
+		organizations:     make(map[uuid.UUID]models.RetentionPolicy),
+		roomOrganizations: make(map[uuid.UUID]uuid.UUID, len(rooms)),
+	}
+	for _, policy := range policies {
+		switch policy.TargetType {
+		case "device":
+			p.devices[policy.TargetUUID] = policy
+		case "organization":
+			p.organizations[policy.TargetUUID] = policy
+		}
+	}
+	for _, room := range rooms {
+		p.roomOrganizations[room.UUID] = room.OrganizationUUID
+	}
+	return p, nil
+}
+
+// 计算设备生效的保留天数：设备策略 > 组织策略 > 全局配置
+func (p *retentionPolicies) effective(device *models.Device, rawDays, fineDays int) (int, int) {
+	var applicable []models.RetentionPolicy
+	if device.RoomUUID != nil {
+		if organization, ok := p.roomOrganizations[*device.RoomUUID]; ok {
+			if policy, ok := p.organizations[organization]; ok {
+				applicable = append(applicable, policy)
+			}
+		}
+	}
+	if policy, ok := p.devices[device.UUID]; ok {
+		applicable = append(applicable, policy)
+	}
+
+	// 先应用组织策略，再由设备策略覆盖
+	for _, policy := range applicable {
+		if policy.RawDays != nil {
+			rawDays = *policy.RawDays
+		}
+		if policy.FineDays != nil {
+			fineDays = *policy.FineDays
+		}
+	}
+	return rawDays, fineDays
+}
+
+// 按保留策略清理过期数据，dryRun 为 true 时只统计不删除。
+// 只清理已聚合的原始读数，未聚合的数据会一直保留
+func (h *RetentionHandler) Purge(ctx context.Context, dryRun bool) (*RetentionReport, error) {
+	var devices []models.Device
+	if err := h.DB.Find(&devices).Error; err != nil {
+		return nil, err
+	}
+
+	policies, err := h.loadRetentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RetentionReport{DryRun: dryRun, Devices: []DeviceRetention{}}
+	now := time.Now()
+	for i := range devices {
+		device := &devices[i]
+		rawDays, fineDays := policies.effective(device, h.RawDays, h.FineDays)
+		result := DeviceRetention{
+			DeviceUUID: device.UUID,
+			DeviceID:   device.DeviceID,
+			RawDays:    rawDays,
+			FineDays:   fineDays,
+		}
+
+		if rawDays > 0 {
+			filter := bson.M{
+				"device_id": device.DeviceID,
+				"processed": true,
+				"timestamp": bson.M{"$lt": now.AddDate(0, 0, -rawDays).Unix()},
+			}
+			if dryRun {
+				result.RawReadings, err = h.MongoCollection.CountDocuments(ctx, filter)
+			} else {
+				var res *mongo.DeleteResult
+				if res, err = h.MongoCollection.DeleteMany(ctx, filter); err == nil {
+					result.RawReadings = res.DeletedCount
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// 待审核的隔离读数一直保留
+			if h.QuarantineCollection != nil && !dryRun {
+				reviewed := bson.M{
+					"device_id": device.DeviceID,
+					"status":    bson.M{"$ne": QuarantinePending},
+					"timestamp": filter["timestamp"],
+				}
+				if _, err := h.QuarantineCollection.DeleteMany(ctx, reviewed); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if fineDays > 0 {
+			// 按设备所在时区整天清理，同一天的下级统计数据要么全部保留，要么全部清理
+			cutoff, _ := windowBounds(now.AddDate(0, 0, -fineDays), models.ResolutionDay, deviceLocation(device))
+			fineRows := func(db *gorm.DB) *gorm.DB {
+				return db.Model(&models.Data{}).
+					Where("my_device_id = ? AND resolution IN ? AND window_end <= ?", device.UUID, fineResolutions, cutoff)
+			}
+			if dryRun {
+				err = fineRows(h.DB).Count(&result.FineRows).Error
+			} else {
+				err = h.DB.Transaction(func(tx *gorm.DB) error {
+					// 标记天统计数据，之后补传的数据并入已有结果，而不是由剩余的下级统计数据重新计算
+					if err := tx.Model(&models.Data{}).
+						Where("my_device_id = ? AND resolution = ? AND window_end <= ?", device.UUID, models.ResolutionDay, cutoff).
+						Update("fine_purged", true).Error; err != nil {
+						return err
+					}
+					res := fineRows(tx).Delete(&models.Data{})
+					result.FineRows = res.RowsAffected
+					return res.Error
+				})
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if result.RawReadings > 0 || result.FineRows > 0 {
+			report.RawReadings += result.RawReadings
+			report.FineRows += result.FineRows
+			report.Devices = append(report.Devices, result)
+		}
+	}
+	return report, nil
+}
+
+// 定期按保留策略清理数据
+type RetentionPurger struct {
+	Retention *RetentionHandler
+	Interval  time.Duration
+}
+
+func (p *RetentionPurger) Run() {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := p.Retention.Purge(context.Background(), false)
+		if err != nil {
+			log.Println("数据清理失败：", err)
+			continue
+		}
+		if report.RawReadings > 0 || report.FineRows > 0 {
+			log.Printf("数据清理完成：%d条原始读数，%d条统计数据", report.RawReadings, report.FineRows)
+		}
+	}
+}
+
+// 解析保留天数，值为 null 时清除
+func parseRetentionDays(data map[string]any, key string, days **int) error {
+	value, ok := data[key]
+	if !ok {
+		return nil
+	}
+	if value == nil {
+		*days = nil
+		return nil
+	}
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != float64(int(number)) {
+		return errors.New("invalid " + key)
+	}
+	v := int(number)
+	*days = &v
+	return nil
+}
+
+func parseRetentionPolicy(policy *models.RetentionPolicy, data map[string]any) error {
+	if err := parseRetentionDays(data, "raw_days", &policy.RawDays); err != nil {
+		return err
+	}
+	if err := parseRetentionDays(data, "fine_days", &policy.FineDays); err != nil {
+		return err
+	}
+	if note, ok := data["note"].(string); ok {
+		policy.Note = note
+	}
+	return nil
+}
+
+func (h *RetentionHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, policy *models.RetentionPolicy, data map[string]any) error {
+			targetModels := map[string]any{
+				"organization": &models.Organization{},
+				"device":       &models.Device{},
+			}
+			targetType, _ := data["target_type"].(string)
+			model, ok := targetModels[targetType]
+			if !ok {
+				return errors.New("invalid target_type")
+			}
+			targetUUID, err := parseParentUUID(h.DB, model, data, "target_uuid")
+			if err != nil {
+				return err
+			}
+
+			var count int64
+			if err := h.DB.Model(&models.RetentionPolicy{}).Where("target_type = ? AND target_uuid = ?", targetType, targetUUID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return errors.New("该对象已存在保留策略")
+			}
+
+			policy.TargetType = targetType
+			policy.TargetUUID = *targetUUID
+			return parseRetentionPolicy(policy, data)
+		},
+	)(c)
+}
+
+func (h *RetentionHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			if targetType := c.Query("target_type"); targetType != "" {
+				query = query.Where("target_type = ?", targetType)
+			}
+			if targetUUID := c.Query("target_uuid"); targetUUID != "" {
+				query = query.Where("target_uuid = ?", targetUUID)
+			}
+			return query
+		},
+	)(c)
+}
+
+func (h *RetentionHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, policy *models.RetentionPolicy, data map[string]any) error {
+			return parseRetentionPolicy(policy, data)
+		},
+	)(c)
+}
+
+func (h *RetentionHandler) Destroy(c *gin.Context) {
+	h.BaseHandler.Destroy(
+		nil,
+	)(c)
+}
+
+// 预览按当前策略将要清理的数据
+func (h *RetentionHandler) Report(c *gin.Context) {
+	report, err := h.Purge(c, true)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, report, utils.ErrOK)
+}
+
+// 立即按当前策略清理数据
+func (h *RetentionHandler) PurgeNow(c *gin.Context) {
+	report, err := h.Purge(c, false)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, report, utils.ErrOK)
+}
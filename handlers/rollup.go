@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"ssat_backend_rebuild/models"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// 聚合方式
+const (
+	AggregationModeCount  = "count"  // 每 MongoToSQLThreshold 条读数生成一条统计数据
+	AggregationModeWindow = "window" // 按固定时间窗口生成 5 分钟、小时、天三种粒度的统计数据
+)
+
+// 每种粒度的上一级粒度
+var parentResolution = map[string]string{
+	models.Resolution5Min: models.ResolutionHour,
+	models.ResolutionHour: models.ResolutionDay,
+}
+
+// 计算时间所在窗口的起止时间，小时和天按设备所在时区对齐
+func windowBounds(t time.Time, resolution string, loc *time.Location) (start, end time.Time) {
+	t = t.In(loc)
+	switch resolution {
+	case models.Resolution5Min:
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()-t.Minute()%5, 0, 0, loc)
+		end = start.Add(5 * time.Minute)
+	case models.ResolutionHour:
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		end = start.Add(time.Hour)
+	default:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 0, 1)
+	}
+	return start, end
+}
+
+// 查找设备某一窗口的统计数据，不存在时返回未保存的新记录
+func findWindow(db *gorm.DB, device *models.Device, resolution string, start, end time.Time) (*models.Data, error) {
+	data := &models.Data{}
+	err := db.Where("my_device_id = ? AND resolution = ? AND window_start = ?", device.UUID, resolution, start).First(data).Error
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	return &models.Data{
+		MyDeviceID:  device.UUID.String(),
+		Resolution:  resolution,
+		WindowStart: &start,
+		WindowEnd:   &end,
+		BaseModel:   models.BaseModel{UUID: uuid.New()},
+	}, nil
+}
+
+// 按时间窗口聚合已结束窗口内的未处理数据，并更新受影响的小时和天统计数据
+func (h *DataHandler) aggregateWindows(ctx context.Context, device *models.Device) (batches int, readings int, err error) {
+	loc := deviceLocation(device)
+	affected := make(map[time.Time]bool)
+
+	// 先完成之前已认领但超时未完成的窗口
+	tokens, err := h.MongoCollection.Distinct(ctx, "batch_id", stalledBatchFilter(device.DeviceID, time.Now().Add(-batchClaimLease)))
+	if err != nil {
+		return batches, readings, err
+	}
+	for _, value := range tokens {
+		token, ok := value.(string)
+		if !ok {
+			log.Printf("设备%s的读数批次标识类型错误: %v", device.DeviceID, value)
+			continue
+		}
+		var doc MongoData
+		if err := h.MongoCollection.FindOne(ctx, bson.M{"batch_id": token}).Decode(&doc); err != nil {
+			return batches, readings, err
+		}
+		start, _ := windowBounds(time.Unix(doc.Timestamp, 0), models.Resolution5Min, loc)
+		n, err := h.finishWindow(ctx, device, start, token)
+		if err != nil {
+			return batches, readings, err
+		}
+		batches++
+		readings += n
+		affected[start] = true
+	}
+
+	// 只处理已结束的窗口，当前窗口等待结束后再聚合
+	current, _ := windowBounds(time.Now(), models.Resolution5Min, loc)
+	filter := bson.M{
+		"device_id": device.DeviceID,
+		"processed": false,
+		"batch_id":  bson.M{"$exists": false},
+		"timestamp": bson.M{"$lt": current.Unix()},
+	}
+	cursor, err := h.MongoCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"_id": 1, "timestamp": 1}))
+	if err != nil {
+		return batches, readings, err
+	}
+	var pending []MongoData
+	if err := cursor.All(ctx, &pending); err != nil {
+		return batches, readings, err
+	}
+
+	// 按窗口分组
+	groups := make(map[time.Time][]primitive.ObjectID)
+	var starts []time.Time
+	for _, doc := range pending {
+		start, _ := windowBounds(time.Unix(doc.Timestamp, 0), models.Resolution5Min, loc)
+		if _, ok := groups[start]; !ok {
+			starts = append(starts, start)
+		}
+		groups[start] = append(groups[start], doc.ID)
+	}
+
+	for _, start := range starts {
+		_, end := windowBounds(start, models.Resolution5Min, loc)
+		window, err := findWindow(h.DB, device, models.Resolution5Min, start, end)
+		if err != nil {
+			return batches, readings, err
+		}
+
+		// 以统计数据的 UUID 作为批次标识认领数据，补传的数据会并入已有窗口
+		token := window.UUID.String()
+		claim := bson.M{"_id": bson.M{"$in": groups[start]}, "batch_id": bson.M{"$exists": false}}
+		if _, err := h.MongoCollection.UpdateMany(ctx, claim, bson.M{"$set": bson.M{"batch_id": token, "claimed_at": time.Now().Unix()}}); err != nil {
+			return batches, readings, err
+		}
+		n, err := h.finishWindow(ctx, device, start, token)
+		if err != nil {
+			return batches, readings, err
+		}
+		batches++
+		readings += n
+		affected[start] = true
+	}
+
+	// 由细粒度数据逐级重新计算小时和天统计数据
+	for resolution := models.Resolution5Min; parentResolution[resolution] != ""; resolution = parentResolution[resolution] {
+		parents := make(map[time.Time]bool)
+		for start := range affected {
+			parentStart, _ := windowBounds(start, parentResolution[resolution], loc)
+			parents[parentStart] = true
+		}
+		for start := range parents {
+			if err := h.rebuildRollup(device, parentResolution[resolution], start, loc); err != nil {
+				return batches, readings, err
+			}
+		}
+		affected = parents
+	}
+	return batches, readings, nil
+}
+
+// 根据窗口内全部已认领的数据重新计算 5 分钟统计数据并标记为已处理，重复执行结果不变
+func (h *DataHandler) finishWindow(ctx context.Context, device *models.Device, start time.Time, token string) (int, error) {
+	loc := deviceLocation(device)
+	_, end := windowBounds(start, models.Resolution5Min, loc)
+	window, err := findWindow(h.DB, device, models.Resolution5Min, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	// 中断后恢复时窗口可能已由其他批次创建，将数据并入已有窗口
+	if window.UUID.String() != token {
+		if _, err := h.MongoCollection.UpdateMany(ctx, bson.M{"batch_id": token}, bson.M{"$set": bson.M{"batch_id": window.UUID.String()}}); err != nil {
+			return 0, err
+		}
+	}
+
+	store := h.batches()
+	for {
+		mongoDataList, err := store.BatchReadings(ctx, window.UUID.String())
+		if err != nil {
+			return 0, err
+		}
+		summary := SummarizeReadings(mongoDataList)
+		summary.Apply(window)
+		if err := h.DB.Save(window).Error; err != nil {
+			return 0, err
+		}
+
+		// 只标记参与计算的读数为已处理，认领尚未完成时按完整的窗口重新计算
+		ids := make([]primitive.ObjectID, len(mongoDataList))
+		for i, mongoData := range mongoDataList {
+			ids[i] = mongoData.ID
+		}
+		if err := store.MarkProcessed(ctx, ids); err != nil {
+			return 0, err
+		}
+		total, err := store.CountBatch(ctx, window.UUID.String())
+		if err != nil {
+			return 0, err
+		}
+		if total == int64(len(mongoDataList)) {
+			return len(mongoDataList), nil
+		}
+	}
+}
+
+// 由下一级粒度的统计数据重新计算某个小时或天的统计数据
+func (h *DataHandler) rebuildRollup(device *models.Device, resolution string, start time.Time, loc *time.Location) error {
+	_, end := windowBounds(start, resolution, loc)
+	child := models.Resolution5Min
+	if resolution == models.ResolutionDay {
+		child = models.ResolutionHour
+	}
+
+	var children []models.Data
+	if err := h.DB.Where("my_device_id = ? AND resolution = ? AND window_start >= ? AND window_start < ?", device.UUID, child, start, end).
+		Find(&children).Error; err != nil {
+		return err
+	}
+
+	rollup, err := findWindow(h.DB, device, resolution, start, end)
+	if err != nil {
+		return err
+	}
+	summary := rollupSummary(rollup, children)
+	summary.Apply(rollup)
+	if !rollup.FinePurged {
+		return h.DB.Save(rollup).Error
+	}
+
+	// 已并入的下级统计数据随即删除，之后补传的数据只会并入一次
+	return h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(rollup).Error; err != nil {
+			return err
+		}
+		return tx.Where("my_device_id = ? AND resolution IN ? AND window_start >= ? AND window_start < ?",
+			device.UUID, []string{models.Resolution5Min, models.ResolutionHour}, start, end).
+			Delete(&models.Data{}).Error
+	})
+}
+
+// 上级统计数据的汇总结果。下级统计数据已被清理的天统计数据不能重新计算，将补传产生的下级统计数据并入已有结果
+func rollupSummary(rollup *models.Data, children []models.Data) StatsSummary {
+	if !rollup.FinePurged {
+		return SummarizeRows(children)
+	}
+	return SummarizeRows(append([]models.Data{*rollup}, children...))
+}
+
+// 重新计算某条 5 分钟统计数据所属的小时和天统计数据
+func (h *DataHandler) rebuildParents(device *models.Device, data *models.Data) error {
+	if data.Resolution != models.Resolution5Min || data.WindowStart == nil {
+		return nil
+	}
+	loc := deviceLocation(device)
+	hour, _ := windowBounds(*data.WindowStart, models.ResolutionHour, loc)
+	if err := h.rebuildRollup(device, models.ResolutionHour, hour, loc); err != nil {
+		return err
+	}
+	day, _ := windowBounds(*data.WindowStart, models.ResolutionDay, loc)
+	return h.rebuildRollup(device, models.ResolutionDay, day, loc)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"math"
+	"ssat_backend_rebuild/models"
+	"testing"
+)
+
+func TestPurgedDayMergesLateChild(t *testing.T) {
+	day := rowOf(readingsOf(10, 10, 10, 10))
+	late := rowOf(readingsOf(20))
+
+	// 下级统计数据保留时由下级统计数据重新计算
+	if summary := rollupSummary(&day, []models.Data{late}); summary.Count != 1 {
+		t.Errorf("rebuilt count %d, want 1", summary.Count)
+	}
+
+	// 下级统计数据已清理时补传的数据并入已有结果，不覆盖永久保留的天统计数据
+	day.FinePurged = true
+	summary := rollupSummary(&day, []models.Data{late})
+	if summary.Count != 5 {
+		t.Errorf("merged count %d, want 5", summary.Count)
+	}
+	if avg, _ := summary.Avg.Get("pm2_5"); math.Abs(float64(avg)-12) > 1e-4 {
+		t.Errorf("merged avg %v, want 12", avg)
+	}
+	if hi, _ := summary.Max.Get("pm2_5"); hi != 20 {
+		t.Errorf("merged max %v, want 20", hi)
+	}
+	if lo, _ := summary.Min.Get("pm2_5"); lo != 10 {
+		t.Errorf("merged min %v, want 10", lo)
+	}
+}
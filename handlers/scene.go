@@ -0,0 +1,541 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 设备所在时区，未配置或无法识别时使用服务器时区
+func deviceLocation(device *models.Device) *time.Location {
+	if device.Timezone != "" {
+		if loc, err := time.LoadLocation(device.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// 季节，按北半球 3-5 月为春季、6-8 月为夏季、9-11 月为秋季、12-2 月为冬季
+var Seasons = []string{"spring", "summer", "autumn", "winter"}
+
+// 根据日期和设备所在半球推算季节，南半球与北半球相差半年
+func DeriveSeason(t time.Time, device *models.Device) string {
+	month := int(t.In(deviceLocation(device)).Month())
+	if device.Hemisphere == "south" {
+		month += 6
+	}
+	switch month % 12 {
+	case 3, 4, 5:
+		return "spring"
+	case 6, 7, 8:
+		return "summer"
+	case 9, 10, 11:
+		return "autumn"
+	}
+	return "winter"
+}
+
+// 校验并设置设备的场景与地理信息
+func applyDeviceProfile(db *gorm.DB, device *models.Device, data map[string]any) error {
+	if scene, ok := data["scene"].(string); ok {
+		if _, exists := lookupScene(scene); !exists {
+			return errors.New("invalid scene")
+		}
+		if scene != device.Scene {
+			device.Scene = scene
+			if err := syncTwinScene(db, device); err != nil {
+				return err
+			}
+		}
+	}
+	if hemisphere, ok := data["hemisphere"].(string); ok {
+		if hemisphere != "north" && hemisphere != "south" {
+			return errors.New("invalid hemisphere")
+		}
+		device.Hemisphere = hemisphere
+	}
+	if timezone, ok := data["timezone"].(string); ok {
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "" {
+			return errors.New("invalid timezone")
+		}
+		device.Timezone = timezone
+	}
+	return nil
+}
+
+// 场景变更后同步到设备孪生的期望配置，让设备得知新的场景
+func syncTwinScene(db *gorm.DB, device *models.Device) error {
+	twin, err := getOrCreateTwin(db, device.UUID)
+	if err != nil {
+		return err
+	}
+	if twin.Desired.Scene != nil && *twin.Desired.Scene == device.Scene {
+		return nil
+	}
+	scene := device.Scene
+	twin.Desired.Scene = &scene
+	twin.DesiredVersion++
+	return db.Model(twin).Select("desired", "desired_version").Updates(twin).Error
+}
+
+// 初始的场景阈值，数据库中没有场景时写入
+var defaultScenes = SceneConfig{
+	"family": {
+		"winter": SeasonData{
+			"temperature": {16, 22},
+			"humidity":    {30, 50},
+			"fresh_air":   {0.5, 1.0},
+			"ozone":       {0.019, 0.031},
+			"nitro_dio":   {0.017, 0.032},
+			"methanal":    {0.021, 0.085},
+			"pm2_5":       {15.214, 40.032},
+			"carb_momo":   {0.601, 4.054},
+			"bacteria":    {120, 800},
+			"radon":       {1.245, 3.519},
+		},
+		"summer": SeasonData{
+			"temperature": {24, 28},
+			"humidity":    {40, 70},
+			"fresh_air":   {1.0, 1.5},
+			"ozone":       {0.028, 0.054},
+			"nitro_dio":   {0.021, 0.051},
+			"methanal":    {0.032, 0.112},
+			"pm2_5":       {10.012, 45.564},
+			"carb_momo":   {0.512, 3.521},
+			"bacteria":    {100, 600},
+			"radon":       {1.065, 3.041},
+		},
+	},
+	"lab": {
+		"winter": SeasonData{
+			"temperature": {15, 20},
+			"humidity":    {40, 55},
+			"fresh_air":   {2.0, 3.0},
+			"ozone":       {0.005, 0.015},
+			"nitro_dio":   {0.005, 0.015},
+			"methanal":    {0.014, 0.049},
+			"pm2_5":       {6.140, 15.001},
+			"carb_momo":   {0.122, 1.575},
+			"bacteria":    {60, 400},
+			"radon":       {0.654, 1.525},
+		},
+		"summer": SeasonData{
+			"temperature": {20, 24},
+			"humidity":    {45, 60},
+			"fresh_air":   {2.5, 4.0},
+			"ozone":       {0.018, 0.028},
+			"nitro_dio":   {0.017, 0.028},
+			"methanal":    {0.014, 0.055},
+			"pm2_5":       {5.235, 18.002},
+			"carb_momo":   {0.185, 1.810},
+			"bacteria":    {50, 350},
+			"radon":       {0.540, 1.800},
+		},
+	},
+	"greenhouse": {
+		"winter": SeasonData{
+			"temperature": {15, 25},
+			"humidity":    {45, 75},
+			"fresh_air":   {1.0, 2.0},
+			"ozone":       {0.015, 0.034},
+			"nitro_dio":   {0.019, 0.031},
+			"methanal":    {0.010, 0.041},
+			"pm2_5":       {12.201, 35.203},
+			"carb_momo":   {0.201, 2.530},
+			"bacteria":    {120, 700},
+			"radon":       {0.650, 2.510},
+		},
+		"summer": SeasonData{
+			"temperature": {20, 30},
+			"humidity":    {50, 80},
+			"fresh_air":   {1.5, 3.0},
+			"ozone":       {0.011, 0.041},
+			"nitro_dio":   {0.019, 0.041},
+			"methanal":    {0.015, 0.052},
+			"pm2_5":       {10.325, 38.914},
+			"carb_momo":   {0.284, 2.857},
+			"bacteria":    {100, 750},
+			"radon":       {0.549, 2.875},
+		},
+	},
+}
+
+type SceneHandler struct {
+	BaseHandler[models.Scene]
+}
+
+// 场景阈值缓存，启动时及场景变更后重新加载
+var sceneCache = struct {
+	sync.RWMutex
+	scenes SceneConfig
+}{scenes: defaultScenes}
+
+// 查找场景的阈值
+func lookupScene(name string) (map[string]SeasonData, bool) {
+	sceneCache.RLock()
+	defer sceneCache.RUnlock()
+	scene, ok := sceneCache.scenes[name]
+	return scene, ok
+}
+
+// 数据库中没有场景时写入初始阈值。春秋两季的阈值不是实测或标准值，而是取冬夏两季阈值的中间值，部署后应按实际情况调整
+func SeedScenes(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&models.Scene{}).Count(&count).Error; err != nil || count > 0 {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for name, seasons := range defaultScenes {
+			scene := &models.Scene{Name: name, DisplayName: name, Version: 1}
+			if err := tx.Create(scene).Error; err != nil {
+				return err
+			}
+			profile := make(map[string]SeasonData, len(Seasons))
+			for season, data := range seasons {
+				profile[season] = data
+			}
+			for _, season := range []string{"spring", "autumn"} {
+				profile[season] = make(SeasonData)
+				for key, winter := range seasons["winter"] {
+					summer := seasons["summer"][key]
+					profile[season][key] = DataRange{
+						Min: float32(math.Round(float64(winter.Min+summer.Min)/2*1000) / 1000),
+						Max: float32(math.Round(float64(winter.Max+summer.Max)/2*1000) / 1000),
+					}
+				}
+			}
+			if err := createThresholds(tx, scene, profile); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 从数据库重新加载各场景当前版本的阈值
+func LoadScenes(db *gorm.DB) error {
+	var scenes []models.Scene
+	if err := db.Find(&scenes).Error; err != nil {
+		return err
+	}
+	config := make(SceneConfig, len(scenes))
+	for _, scene := range scenes {
+		thresholds, err := sceneThresholds(db, &scene, scene.Version)
+		if err != nil {
+			return err
+		}
+		config[scene.Name] = thresholds
+	}
+	sceneCache.Lock()
+	sceneCache.scenes = config
+	sceneCache.Unlock()
+	return nil
+}
+
+// 查询场景某一版本的阈值
+func sceneThresholds(db *gorm.DB, scene *models.Scene, version int) (map[string]SeasonData, error) {
+	var rows []models.SceneThreshold
+	if err := db.Where("scene_uuid = ? AND version = ?", scene.UUID, version).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	thresholds := make(map[string]SeasonData)
+	for _, row := range rows {
+		if thresholds[row.Season] == nil {
+			thresholds[row.Season] = make(SeasonData)
+		}
+		thresholds[row.Season][row.Metric] = DataRange{Min: float32(row.Min), Max: float32(row.Max)}
+	}
+	return thresholds, nil
+}
+
+// 以场景的当前版本号写入一组阈值
+func createThresholds(tx *gorm.DB, scene *models.Scene, profile map[string]SeasonData) error {
+	var rows []models.SceneThreshold
+	for season, data := range profile {
+		for metric, dataRange := range data {
+			rows = append(rows, models.SceneThreshold{
+				SceneUUID: scene.UUID,
+				Version:   scene.Version,
+				Season:    season,
+				Metric:    metric,
+				Min:       float64(dataRange.Min),
+				Max:       float64(dataRange.Max),
+			})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.Create(&rows).Error
+}
+
+// 解析阈值，格式为 {季节: {指标: {"min": 下限, "max": 上限}}}
+func parseThresholds(value any) (map[string]SeasonData, error) {
+	seasons, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid thresholds")
+	}
+	profile := make(map[string]SeasonData, len(seasons))
+	for season, value := range seasons {
+		if !slices.Contains(Seasons, season) {
+			return nil, fmt.Errorf("未知季节：%s", season)
+		}
+		metrics, ok := value.(map[string]any)
+		if !ok {
+			return nil, errors.New("invalid thresholds")
+		}
+		profile[season] = make(SeasonData, len(metrics))
+		for metric, value := range metrics {
+			if _, registered := LookupMetric(metric); !registered {
+				return nil, fmt.Errorf("未登记的指标：%s", metric)
+			}
+			bounds, _ := value.(map[string]any)
+			lo, okMin := bounds["min"].(float64)
+			hi, okMax := bounds["max"].(float64)
+			if !okMin || !okMax {
+				return nil, fmt.Errorf("%s/%s 缺少 min 或 max", season, metric)
+			}
+			if lo >= hi {
+				return nil, fmt.Errorf("%s/%s 的 min 必须小于 max", season, metric)
+			}
+			profile[season][metric] = DataRange{Min: float32(lo), Max: float32(hi)}
+		}
+	}
+	// 每个季节都需要配置阈值，否则该季节的读数不会做场景阈值检测
+	for _, season := range Seasons {
+		if _, ok := profile[season]; !ok {
+			return nil, fmt.Errorf("缺少季节：%s", season)
+		}
+	}
+	return profile, nil
+}
+
+// 场景某个季节的阈值。旧版本的场景可能缺少部分季节，依次使用相邻季节和相对季节的阈值
+func seasonThresholds(scene map[string]SeasonData, season string) SeasonData {
+	if data, ok := scene[season]; ok {
+		return data
+	}
+	i := slices.Index(Seasons, season)
+	if i < 0 {
+		return nil
+	}
+	n := len(Seasons)
+	for _, offset := range []int{n - 1, 1, 2} {
+		if data, ok := scene[Seasons[(i+offset)%n]]; ok {
+			return data
+		}
+	}
+	return nil
+}
+
+// 场景变更成功后重新加载缓存
+func (h *SceneHandler) reload(c *gin.Context) {
+	if c.Writer.Status() < 300 {
+		if err := LoadScenes(h.DB); err != nil {
+			log.Println("重新加载场景失败：", err)
+		}
+	}
+}
+
+func parseSceneInfo(scene *models.Scene, data map[string]any) {
+	if displayName, ok := data["display_name"].(string); ok {
+		scene.DisplayName = displayName
+	}
+	if description, ok := data["description"].(string); ok {
+		scene.Description = description
+	}
+}
+
+// 创建场景，可同时提供初始阈值
+func (h *SceneHandler) Create(c *gin.Context) {
+	var data map[string]any
+	if err := c.ShouldBindJSON(&data); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+	name, _ := data["name"].(string)
+	if !metricKeyPattern.MatchString(name) {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: "invalid name"})
+		return
+	}
+	var count int64
+	if err := h.DB.Model(&models.Scene{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	if count > 0 {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: "场景已存在"})
+		return
+	}
+
+	scene := &models.Scene{Name: name, DisplayName: name}
+	parseSceneInfo(scene, data)
+	value, ok := data["thresholds"]
+	if !ok {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+	profile, err := parseThresholds(value)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: err.Error()})
+		return
+	}
+	scene.Version = 1
+
+	// 场景与初始阈值在同一事务中创建
+	if err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(scene).Error; err != nil {
+			return err
+		}
+		return createThresholds(tx, scene, profile)
+	}); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, scene, utils.ErrCreated)
+	h.reload(c)
+}
+
+func (h *SceneHandler) List(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		nil,
+	)(c)
+}
+
+// 场景详情及阈值，version 为空时返回当前版本
+func (h *SceneHandler) Retrieve(c *gin.Context) {
+	scene := &models.Scene{}
+	if err := h.DB.First(scene, "uuid = ?", c.Param("uuid")).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	version := scene.Version
+	if value := c.Query("version"); value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 1 || v > scene.Version {
+			utils.Respond(c, nil, utils.ErrBadRequest)
+			return
+		}
+		version = v
+	}
+	thresholds, err := sceneThresholds(h.DB, scene, version)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, gin.H{"scene": scene, "version": version, "thresholds": thresholds}, utils.ErrOK)
+}
+
+// 修改场景名称和说明，场景标识不可修改
+func (h *SceneHandler) Update(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		nil,
+		func(c *gin.Context, query *gorm.DB, scene *models.Scene, data map[string]any) error {
+			parseSceneInfo(scene, data)
+			return nil
+		},
+	)(c)
+}
+
+// 提交一组完整的阈值，生成新版本并立即生效
+func (h *SceneHandler) UpdateThresholds(c *gin.Context) {
+	var req struct {
+		Thresholds any `json:"thresholds" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+	profile, err := parseThresholds(req.Thresholds)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: err.Error()})
+		return
+	}
+
+	scene := &models.Scene{}
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		// 锁定场景行，避免并发修改生成相同的版本号
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(scene, "uuid = ?", c.Param("uuid")).Error; err != nil {
+			return err
+		}
+		scene.Version++
+		if err := tx.Model(scene).Update("version", scene.Version).Error; err != nil {
+			return err
+		}
+		return createThresholds(tx, scene, profile)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, gin.H{"scene": scene, "thresholds": profile}, utils.ErrOK)
+	h.reload(c)
+}
+
+// 场景的阈值版本列表
+func (h *SceneHandler) Versions(c *gin.Context) {
+	var versions []struct {
+		Version   int       `json:"version"`
+		Count     int       `json:"count"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := h.DB.Model(&models.SceneThreshold{}).
+		Select("version, COUNT(*) AS count, MIN(created_at) AS created_at").
+		Where("scene_uuid = ?", c.Param("uuid")).
+		Group("version").Order("version DESC").
+		Scan(&versions).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, gin.H{"items": versions}, utils.ErrOK)
+}
+
+// 删除场景，仍有设备使用时不可删除。历史阈值保留
+func (h *SceneHandler) Destroy(c *gin.Context) {
+	scene := &models.Scene{}
+	if err := h.DB.First(scene, "uuid = ?", c.Param("uuid")).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	var count int64
+	if err := h.DB.Model(&models.Device{}).Where("scene = ?", scene.Name).Count(&count).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	if count > 0 {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: "仍有设备使用该场景"})
+		return
+	}
+
+	h.BaseHandler.Destroy(
+		nil,
+	)(c)
+	h.reload(c)
+}
+
+// 从数据库重新加载场景阈值，用于多实例部署时同步其他实例的修改
+func (h *SceneHandler) Reload(c *gin.Context) {
+	if err := LoadScenes(h.DB); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, gin.H{"message": "已重新加载"}, utils.ErrOK)
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import "testing"
+
+func TestSeasonThresholdsFallback(t *testing.T) {
+	scene := map[string]SeasonData{
+		"summer": {"temperature": {Min: 24, Max: 28}},
+		"winter": {"temperature": {Min: 18, Max: 22}},
+	}
+	for season, want := range map[string]float32{"summer": 24, "autumn": 24, "winter": 18, "spring": 18} {
+		data := seasonThresholds(scene, season)
+		if data == nil || data["temperature"].Min != want {
+			t.Errorf("%s: got %v, want min %v", season, data, want)
+		}
+	}
+	if data := seasonThresholds(scene, "monsoon"); data != nil {
+		t.Errorf("unknown season: got %v", data)
+	}
+}
+
+func TestParseThresholdsRequiresAllSeasons(t *testing.T) {
+	bounds := map[string]any{"temperature": map[string]any{"min": 16.0, "max": 26.0}}
+	partial := map[string]any{"spring": bounds, "summer": bounds}
+	if _, err := parseThresholds(partial); err == nil {
+		t.Error("partial thresholds accepted")
+	}
+	full := map[string]any{"spring": bounds, "summer": bounds, "autumn": bounds, "winter": map[string]any{}}
+	if _, err := parseThresholds(full); err != nil {
+		t.Error(err)
+	}
+}
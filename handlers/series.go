@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"math"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 曲线默认最多返回的点数
+const defaultSeriesPoints = 500
+
+// 曲线上的一个点，没有数据的时间段各值为 null
+type SeriesPoint struct {
+	Time int64    `json:"t"` // 时间段起点（Unix 时间戳）
+	Avg  *float64 `json:"avg"`
+	Min  *float64 `json:"min"`
+	Max  *float64 `json:"max"`
+}
+
+// 时间段内的累计值
+type seriesBucket struct {
+	sum, weight float64
+	min, max    float64
+}
+
+func (b *seriesBucket) add(avg, lo, hi, weight float64) {
+	if b.weight == 0 {
+		b.min, b.max = lo, hi
+	} else {
+		b.min = math.Min(b.min, lo)
+		b.max = math.Max(b.max, hi)
+	}
+	b.sum += avg * weight
+	b.weight += weight
+}
+
+// 解析时间间隔，支持 5m、1h 等格式或秒数
+func parseInterval(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= time.Second {
+		return d, true
+	}
+	return 0, false
+}
+
+// 根据时间间隔选择数据来源：原始读数或某一粒度的统计数据
+func seriesSource(interval time.Duration) string {
+	switch {
+	case interval >= 24*time.Hour:
+		return models.ResolutionDay
+	case interval >= time.Hour:
+		return models.ResolutionHour
+	case interval >= 5*time.Minute:
+		return models.Resolution5Min
+	}
+	return "raw"
+}
+
+// Largest-Triangle-Three-Buckets 降采样，保留曲线形状的同时将点数降到 threshold
+func lttb(points []SeriesPoint, threshold int) []SeriesPoint {
+	if threshold >= len(points) || threshold < 3 {
+		return points
+	}
+	sampled := make([]SeriesPoint, 0, threshold)
+	sampled = append(sampled, points[0])
+	every := float64(len(points)-2) / float64(threshold-2)
+	a := 0
+	for i := 0; i < threshold-2; i++ {
+		// 下一个桶的平均点
+		avgStart := int(float64(i+1)*every) + 1
+		avgEnd := min(int(float64(i+2)*every)+1, len(points))
+		var avgX, avgY float64
+		for _, p := range points[avgStart:avgEnd] {
+			avgX += float64(p.Time)
+			avgY += *p.Avg
+		}
+		avgX /= float64(avgEnd - avgStart)
+		avgY /= float64(avgEnd - avgStart)
+
+		// 当前桶中与上一个选中点、下一个桶平均点构成三角形面积最大的点
+		rangeStart := int(float64(i)*every) + 1
+		rangeEnd := int(float64(i+1)*every) + 1
+		ax, ay := float64(points[a].Time), *points[a].Avg
+		maxArea, next := -1.0, rangeStart
+		for j := rangeStart; j < rangeEnd; j++ {
+			area := math.Abs((ax-avgX)*(*points[j].Avg-ay) - (ax-float64(points[j].Time))*(avgY-ay))
+			if area > maxArea {
+				maxArea, next = area, j
+			}
+		}
+		sampled = append(sampled, points[next])
+		a = next
+	}
+	return append(sampled, points[len(points)-1])
+}
+
+// 对有数据的点降采样，并在原本不相邻的点之间插入空值表示缺失
+func downsample(points []SeriesPoint, interval time.Duration, maxPoints int) []SeriesPoint {
+	if len(points) <= maxPoints {
+		return points
+	}
+	var filled []SeriesPoint
+	for _, p := range points {
+		if p.Avg != nil {
+			filled = append(filled, p)
+		}
+	}
+
+	build := func(threshold int) []SeriesPoint {
+		sampled := lttb(filled, threshold)
+		result := make([]SeriesPoint, 0, len(sampled))
+		for i, p := range sampled {
+			if i > 0 && hasGap(points, sampled[i-1].Time, p.Time, interval) {
+				result = append(result, SeriesPoint{Time: sampled[i-1].Time + int64(interval.Seconds())})
+			}
+			result = append(result, p)
+		}
+		return result
+	}
+	result := build(maxPoints)
+	// 空值点也计入点数上限
+	if excess := len(result) - maxPoints; excess > 0 {
+		result = build(maxPoints - excess)
+	}
+	return result
+}
+
+// 两个时间点之间是否存在没有数据的时间段
+func hasGap(points []SeriesPoint, from, to int64, interval time.Duration) bool {
+	start := points[0].Time
+	step := int64(interval.Seconds())
+	for i := (from-start)/step + 1; i < (to-start)/step; i++ {
+		if points[i].Avg == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 按时间段返回某项指标的平均值、最小值和最大值，用于绘制曲线。metric 为 aqi 时返回空气质量指数
+func (h *DataHandler) Series(c *gin.Context) {
+	deviceUUID := c.Query("device_id")
+	metric := c.DefaultQuery("metric", "pm2_5")
+	if deviceUUID == "" {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+	if _, ok := LookupMetric(metric); !ok && metric != "aqi" {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+
+	// 管理员可查询任意设备，用户只能查询自己的设备
+	device := &models.Device{}
+	query := h.DB.Where("uuid = ?", deviceUUID)
+	_, isAdmin := c.Get("CurrentAdminUser")
+	if !isAdmin {
+		query = query.Where("owner_id = ?", c.MustGet("CurrentUser").(*models.User).UUID)
+	}
+	if err := query.First(device).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+
+	to := time.Now()
+	if t, err := time.Parse(time.RFC3339, c.Query("to")); err == nil {
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if t, err := time.Parse(time.RFC3339, c.Query("from")); err == nil {
+		from = t
+	}
+	if !from.Before(to) {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+
+	maxPoints := defaultSeriesPoints
+	if value, err := strconv.Atoi(c.Query("max_points")); err == nil && value >= 3 {
+		maxPoints = value
+	}
+
+	// 未指定间隔时按最大点数自动计算
+	interval, ok := parseInterval(c.Query("interval"))
+	if !ok {
+		interval = to.Sub(from) / time.Duration(maxPoints)
+	}
+	interval = max(interval.Round(time.Second), time.Second)
+	from = from.Truncate(interval)
+	count := int(to.Sub(from)/interval) + 1
+	if count > 100*maxPoints {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+	buckets := make([]seriesBucket, count)
+	index := func(t time.Time) int {
+		return int(t.Sub(from) / interval)
+	}
+
+	// 用户只能看到可见时间之后的数据
+	visibleFrom := from
+	if !isAdmin && device.DataVisibleFrom != nil && device.DataVisibleFrom.After(visibleFrom) {
+		visibleFrom = *device.DataVisibleFrom
+	}
+
+	// 优先使用统计数据，没有对应粒度时使用按条数聚合的数据，仍没有时使用原始读数
+	source := seriesSource(interval)
+	found := false
+	for _, resolution := range []string{source, models.ResolutionBatch} {
+		if resolution == "raw" {
+			break
+		}
+		var rows []models.Data
+		if err := h.DB.Where("my_device_id = ? AND resolution = ? AND window_start >= ? AND window_start < ?", device.UUID, resolution, visibleFrom, to).
+			Find(&rows).Error; err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		for _, row := range rows {
+			i := index(*row.WindowStart)
+			if i < 0 || i >= count {
+				continue
+			}
+			// 统计数据只保存各污染物的平均值和极值，平均值为平均浓度对应的指数而不是指数的平均值；
+			// 各污染物的极值不一定出现在同一时刻，由其计算的指数只是时段内指数的下界和上界
+			daily := row.Resolution == models.ResolutionDay
+			avg, ok := metricValue(row.Avg, metric, daily)
+			if !ok {
+				continue
+			}
+			lo, _ := metricValue(row.Min, metric, daily)
+			hi, _ := metricValue(row.Max, metric, daily)
+			buckets[i].add(float64(avg), float64(lo), float64(hi), float64(max(row.Count, 1)))
+			found = true
+		}
+		if found {
+			break
+		}
+	}
+	if !found {
+		filter := bson.M{"device_id": device.DeviceID, "timestamp": bson.M{"$gte": visibleFrom.Unix(), "$lt": to.Unix()}}
+		projection := bson.M{"timestamp": 1, "data." + models.DataEntryBSONField(metric): 1, "data.missing": 1}
+		if metric == "aqi" {
+			projection = bson.M{"timestamp": 1, "data": 1}
+		}
+		cursor, err := h.MongoCollection.Find(c, filter, options.Find().SetProjection(projection))
+		if err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		var readings []MongoData
+		if err := cursor.All(c, &readings); err != nil {
+			utils.Respond(c, nil, utils.ErrInternalServer)
+			return
+		}
+		for _, reading := range readings {
+			i := index(time.Unix(reading.Timestamp, 0))
+			if i < 0 || i >= count {
+				continue
+			}
+			value, ok := metricValue(reading.Data, metric, false)
+			if !ok {
+				continue
+			}
+			buckets[i].add(float64(value), float64(value), float64(value), 1)
+		}
+		source = "raw"
+	}
+
+	points := make([]SeriesPoint, count)
+	for i, bucket := range buckets {
+		points[i].Time = from.Add(time.Duration(i) * interval).Unix()
+		if bucket.weight > 0 {
+			avg, lo, hi := bucket.sum/bucket.weight, bucket.min, bucket.max
+			points[i].Avg, points[i].Min, points[i].Max = &avg, &lo, &hi
+		}
+	}
+
+	// 隔离区中的异常读数单独标记
+	flagged, err := h.flaggedReadings(c, device, visibleFrom, to, metric)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+
+	utils.Respond(c, gin.H{
+		"metric":   metric,
+		"source":   source,
+		"interval": int64(interval.Seconds()),
+		"points":   downsample(points, interval, maxPoints),
+		"flagged":  flagged,
+	}, utils.ErrOK)
+}
@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gorm.io/gorm"
+)
+
+// 使用 Welford 在线算法累计单个字段的统计量，部分结果之间可以合并
+type RunningStats struct {
+	Count    int64
+	Mean     float64
+	M2       float64 // 与均值之差的平方和
+	Min, Max float64
+}
+
+func (s *RunningStats) Add(x float64) {
+	if s.Count == 0 {
+		s.Min, s.Max = x, x
+	} else {
+		s.Min = math.Min(s.Min, x)
+		s.Max = math.Max(s.Max, x)
+	}
+	s.Count++
+	delta := x - s.Mean
+	s.Mean += delta / float64(s.Count)
+	s.M2 += delta * (x - s.Mean)
+}
+
+// 合并另一组统计量（Chan 等人的并行算法）
+func (s *RunningStats) Merge(o RunningStats) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 {
+		*s = o
+		return
+	}
+	count := s.Count + o.Count
+	delta := o.Mean - s.Mean
+	s.Mean += delta * float64(o.Count) / float64(count)
+	s.M2 += o.M2 + delta*delta*float64(s.Count)*float64(o.Count)/float64(count)
+	s.Min = math.Min(s.Min, o.Min)
+	s.Max = math.Max(s.Max, o.Max)
+	s.Count = count
+}
+
+// 总体方差
+func (s *RunningStats) Variance() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.M2 / float64(s.Count)
+}
+
+// 一组读数或统计数据的汇总结果
+type StatsSummary struct {
+	Count                                int
+	Max, Min, Avg, Var, Std, Median, P95 models.DataEntry
+	Quantiles                            map[string][]float32 // 各指标在 sketchLevels 处的分位数
+}
+
+// 不含任何指标的汇总结果，只有统计过的指标有值
+func newStatsSummary() StatsSummary {
+	return StatsSummary{
+		Max: models.EmptyDataEntry(), Min: models.EmptyDataEntry(), Avg: models.EmptyDataEntry(),
+		Var: models.EmptyDataEntry(), Std: models.EmptyDataEntry(),
+		Median: models.EmptyDataEntry(), P95: models.EmptyDataEntry(),
+		Quantiles: make(map[string][]float32),
+	}
+}
+
+// 写入统计数据
+func (s *StatsSummary) Apply(data *models.Data) {
+	data.Count = s.Count
+	data.Max, data.Min, data.Avg, data.Var = s.Max, s.Min, s.Avg, s.Var
+	data.Std, data.Median, data.P95 = s.Std, s.Median, s.P95
+	data.Quantiles = s.Quantiles
+	applyAQI(data)
+}
+
+func (s *StatsSummary) set(key string, stats *RunningStats) {
+	s.Max.Set(key, float32(stats.Max))
+	s.Min.Set(key, float32(stats.Min))
+	s.Avg.Set(key, float32(stats.Mean))
+	s.Var.Set(key, float32(stats.Variance()))
+	s.Std.Set(key, float32(math.Sqrt(stats.Variance())))
+}
+
+// 已排序数据的分位数，使用线性插值
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (sorted[lower+1]-sorted[lower])*(rank-float64(lower))
+}
+
+// 分位数草图记录的分位点。每条统计数据保存各指标在这些分位点处的值，
+// 合并时将每条数据视为分段线性的分布函数，按条数加权混合后求逆得到合并后的分位数
+var sketchLevels = []float64{0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 0.95, 0.99, 1}
+
+// 一条统计数据中某项指标的分段线性分布函数
+type quantileSketch struct {
+	values []float64 // 单调不减
+	levels []float64
+	weight float64
+}
+
+// 分布函数在 x 处的值
+func (q quantileSketch) cdf(x float64) float64 {
+	i := sort.Search(len(q.values), func(i int) bool { return q.values[i] > x })
+	if i == 0 {
+		return 0
+	}
+	if i == len(q.values) {
+		return 1
+	}
+	lo, hi := q.values[i-1], q.values[i]
+	return q.levels[i-1] + (q.levels[i]-q.levels[i-1])*(x-lo)/(hi-lo)
+}
+
+// 按权重混合多个分布函数，返回分位点 p 处的值
+func mergeQuantile(sketches []quantileSketch, p float64) float64 {
+	if len(sketches) == 0 {
+		return 0
+	}
+	lo, hi := sketches[0].values[0], sketches[0].values[len(sketches[0].values)-1]
+	var total float64
+	for _, q := range sketches {
+		lo = math.Min(lo, q.values[0])
+		hi = math.Max(hi, q.values[len(q.values)-1])
+		total += q.weight
+	}
+	for range 64 {
+		mid := (lo + hi) / 2
+		var cumulative float64
+		for _, q := range sketches {
+			cumulative += q.weight * q.cdf(mid)
+		}
+		if cumulative >= p*total {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
+
+// 统计数据中某项指标的分布函数，没有草图的旧数据由最小值、中位数、P95 和最大值近似
+func rowSketch(row *models.Data, key string) quantileSketch {
+	if values := row.Quantiles[key]; len(values) == len(sketchLevels) {
+		sketch := quantileSketch{values: make([]float64, len(values)), levels: sketchLevels, weight: float64(row.Count)}
+		for i, v := range values {
+			sketch.values[i] = float64(v)
+		}
+		return sketch
+	}
+	lo, _ := row.Min.Get(key)
+	median, _ := row.Median.Get(key)
+	p95, _ := row.P95.Get(key)
+	hi, _ := row.Max.Get(key)
+	// 未补算中位数和 P95 的数据这两项为 0，限制在极值之间
+	median = min(max(median, lo), hi)
+	p95 = min(max(p95, median), hi)
+	return quantileSketch{
+		values: []float64{float64(lo), float64(median), float64(p95), float64(hi)},
+		levels: []float64{0, 0.5, 0.95, 1},
+		weight: float64(row.Count),
+	}
+}
+
+// 一组读数中出现的全部指标：内置指标在前，扩展指标按名称排序
+func entryKeys(entries []*models.DataEntry) []string {
+	union := models.EmptyDataEntry()
+	for _, entry := range entries {
+		for _, key := range entry.Keys() {
+			union.Set(key, 0)
+		}
+	}
+	return union.Keys()
+}
+
+// 由原始读数计算统计数据，中位数和 P95 为精确值。每项指标只统计包含该指标的读数
+func SummarizeReadings(readings []MongoData) StatsSummary {
+	summary := newStatsSummary()
+	summary.Count = len(readings)
+	entries := make([]*models.DataEntry, len(readings))
+	for i := range readings {
+		entries[i] = &readings[i].Data
+	}
+	values := make([]float64, 0, len(readings))
+	for _, key := range entryKeys(entries) {
+		stats := RunningStats{}
+		values = values[:0]
+		for _, entry := range entries {
+			if value, ok := entry.Get(key); ok {
+				values = append(values, float64(value))
+				stats.Add(float64(value))
+			}
+		}
+		summary.set(key, &stats)
+
+		sort.Float64s(values)
+		summary.Median.Set(key, float32(percentile(values, 0.5)))
+		summary.P95.Set(key, float32(percentile(values, 0.95)))
+		quantiles := make([]float32, len(sketchLevels))
+		for i, level := range sketchLevels {
+			quantiles[i] = float32(percentile(values, level))
+		}
+		summary.Quantiles[key] = quantiles
+	}
+	return summary
+}
+
+// 合并多条统计数据。均值、方差和极值为精确值，中位数和 P95 由各条数据的分位数草图合并得到，为估算值
+func SummarizeRows(rows []models.Data) StatsSummary {
+	summary := newStatsSummary()
+	for _, row := range rows {
+		summary.Count += row.Count
+	}
+	entries := make([]*models.DataEntry, len(rows))
+	for i := range rows {
+		entries[i] = &rows[i].Avg
+	}
+	sketches := make([]quantileSketch, 0, len(rows))
+	for _, key := range entryKeys(entries) {
+		stats := RunningStats{}
+		sketches = sketches[:0]
+		for i := range rows {
+			row := &rows[i]
+			avg, ok := row.Avg.Get(key)
+			if row.Count == 0 || !ok {
+				continue
+			}
+			variance, _ := row.Var.Get(key)
+			lo, _ := row.Min.Get(key)
+			hi, _ := row.Max.Get(key)
+			stats.Merge(RunningStats{
+				Count: int64(row.Count),
+				Mean:  float64(avg),
+				M2:    float64(variance) * float64(row.Count),
+				Min:   float64(lo),
+				Max:   float64(hi),
+			})
+
+			sketches = append(sketches, rowSketch(row, key))
+		}
+		summary.set(key, &stats)
+		quantiles := make([]float32, len(sketchLevels))
+		for i, level := range sketchLevels {
+			quantiles[i] = float32(mergeQuantile(sketches, level))
+		}
+		summary.Quantiles[key] = quantiles
+		summary.Median.Set(key, float32(mergeQuantile(sketches, 0.5)))
+		summary.P95.Set(key, float32(mergeQuantile(sketches, 0.95)))
+	}
+	return summary
+}
+
+type BackfillReport struct {
+	Updated int `json:"updated"` // 已重新计算的统计数据条数
+	Skipped int `json:"skipped"` // 原始读数已清理、无法重新计算的条数
+}
+
+// 由原始读数重新计算已有统计数据的全部统计量，小时和天统计数据随之重新合并
+func (h *DataHandler) BackfillStats(ctx context.Context, deviceUUID string) (*BackfillReport, error) {
+	report := &BackfillReport{}
+	devices := make(map[string]*models.Device)
+	query := h.DB.Where("resolution IN ?", []string{models.ResolutionBatch, models.Resolution5Min})
+	if deviceUUID != "" {
+		query = query.Where("my_device_id = ?", deviceUUID)
+	}
+
+	var rows []models.Data
+	err := query.FindInBatches(&rows, 100, func(tx *gorm.DB, batch int) error {
+		for i := range rows {
+			data := &rows[i]
+			cursor, err := h.MongoCollection.Find(ctx, bson.M{"batch_id": data.UUID.String()})
+			if err != nil {
+				return err
+			}
+			var readings []MongoData
+			if err := cursor.All(ctx, &readings); err != nil {
+				return err
+			}
+			if len(readings) == 0 {
+				report.Skipped++
+				continue
+			}
+
+			summary := SummarizeReadings(readings)
+			summary.Apply(data)
+			if err := h.DB.Save(data).Error; err != nil {
+				return err
+			}
+			report.Updated++
+
+			device, ok := devices[data.MyDeviceID]
+			if !ok {
+				device = &models.Device{}
+				if err := h.DB.First(device, "uuid = ?", data.MyDeviceID).Error; err != nil {
+					return err
+				}
+				devices[data.MyDeviceID] = device
+			}
+			if err := h.rebuildParents(device, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return report, err
+	}
+
+	// 旧版本生成的统计数据没有批次标识，按设备和时间范围匹配原始读数
+	if err := h.backfillLegacyStats(ctx, deviceUUID, report); err != nil {
+		return report, err
+	}
+
+	// 原始读数已清理的统计数据只能由平均值补算空气质量指数
+	query = h.DB.Where("aqi IS NULL")
+	if deviceUUID != "" {
+		query = query.Where("my_device_id = ?", deviceUUID)
+	}
+	err = query.FindInBatches(&rows, 100, func(tx *gorm.DB, batch int) error {
+		for i := range rows {
+			applyAQI(&rows[i])
+			if rows[i].AQI == nil {
+				continue
+			}
+			if err := h.DB.Model(&rows[i]).Select("aqi", "aqi_level", "aqi_category", "primary_pollutant").Updates(&rows[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	return report, err
+}
+
+// 补算旧版本生成的统计数据（resolution 为空）。旧版本按条数聚合且不记录批次标识，
+// 每条统计数据包含同一设备上一条统计数据写入之后、本条写入之前上报并已处理的读数。
+// 补算后为读数记录批次标识，并写入时间窗口
+func (h *DataHandler) backfillLegacyStats(ctx context.Context, deviceUUID string, report *BackfillReport) error {
+	var deviceUUIDs []string
+	query := h.DB.Model(&models.Data{}).Where("resolution = ?", "")
+	if deviceUUID != "" {
+		query = query.Where("my_device_id = ?", deviceUUID)
+	}
+	if err := query.Distinct().Pluck("my_device_id", &deviceUUIDs).Error; err != nil {
+		return err
+	}
+
+	for _, id := range deviceUUIDs {
+		device := &models.Device{}
+		if err := h.DB.First(device, "uuid = ?", id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return err
+		}
+
+		rows, err := h.DB.Model(&models.Data{}).Where("my_device_id = ? AND resolution = ?", id, "").Order("created_at").Rows()
+		if err != nil {
+			return err
+		}
+		var previous int64
+		for rows.Next() {
+			data := &models.Data{}
+			if err := h.DB.ScanRows(rows, data); err != nil {
+				rows.Close()
+				return err
+			}
+			from, to := previous, data.CreatedAt.Unix()
+			previous = to
+
+			cursor, err := h.MongoCollection.Find(ctx, bson.M{
+				"device_id": device.DeviceID,
+				"processed": true,
+				"batch_id":  bson.M{"$exists": false},
+				"timestamp": bson.M{"$gt": from, "$lte": to},
+			})
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			var readings []MongoData
+			if err := cursor.All(ctx, &readings); err != nil {
+				rows.Close()
+				return err
+			}
+			if len(readings) == 0 {
+				report.Skipped++
+				continue
+			}
+
+			summary := SummarizeReadings(readings)
+			summary.Apply(data)
+			first, last := readings[0].Timestamp, readings[0].Timestamp
+			ids := make([]primitive.ObjectID, len(readings))
+			for i, reading := range readings {
+				first = min(first, reading.Timestamp)
+				last = max(last, reading.Timestamp)
+				ids[i] = reading.ID
+			}
+			windowStart, windowEnd := time.Unix(first, 0), time.Unix(last, 0)
+			data.WindowStart, data.WindowEnd = &windowStart, &windowEnd
+			if err := h.DB.Save(data).Error; err != nil {
+				rows.Close()
+				return err
+			}
+			if _, err := h.MongoCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"batch_id": data.UUID.String()}}); err != nil {
+				rows.Close()
+				return err
+			}
+			report.Updated++
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type BackfillStatsRequest struct {
+	DeviceID string `json:"device_id"` // 设备 UUID，为空时处理全部设备
+}
+
+// 管理员手动为已有统计数据补算标准差、中位数、P95 等统计量
+func (h *DataHandler) BackfillStatsNow(c *gin.Context) {
+	var req BackfillStatsRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.Respond(c, nil, utils.ErrBadRequest)
+		return
+	}
+
+	report, err := h.BackfillStats(c, req.DeviceID)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, report, utils.ErrOK)
+}
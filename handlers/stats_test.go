@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"math"
+	"ssat_backend_rebuild/models"
+	"testing"
+)
+
+func readingsOf(values ...float64) []MongoData {
+	readings := make([]MongoData, len(values))
+	for i, v := range values {
+		readings[i].Data = models.EmptyDataEntry()
+		readings[i].Data.Set("pm2_5", float32(v))
+	}
+	return readings
+}
+
+func rowOf(readings []MongoData) models.Data {
+	var row models.Data
+	summary := SummarizeReadings(readings)
+	summary.Apply(&row)
+	return row
+}
+
+func TestSummarizeRowsMergesTail(t *testing.T) {
+	// 一半读数在 0~99，另一半在 1000~1099，合并后的 P95 位于高值段
+	var low, high, all []float64
+	for i := range 100 {
+		low = append(low, float64(i))
+		high = append(high, float64(1000+i))
+	}
+	all = append(append(all, low...), high...)
+	rows := []models.Data{rowOf(readingsOf(low...)), rowOf(readingsOf(high...))}
+	exact := rowOf(readingsOf(all...))
+
+	merged := SummarizeRows(rows)
+	got, _ := merged.P95.Get("pm2_5")
+	want, _ := exact.P95.Get("pm2_5")
+	if math.Abs(float64(got-want)) > 10 {
+		t.Errorf("p95 = %v, exact %v", got, want)
+	}
+	// 中位数落在两段之间
+	if median, _ := merged.Median.Get("pm2_5"); median < 99 || median > 1000 {
+		t.Errorf("median = %v", median)
+	}
+}
+
+func TestSummarizeRowsRemerges(t *testing.T) {
+	// 由合并结果再次合并（小时合并为天）与直接合并结果一致
+	var rows []models.Data
+	for h := range 4 {
+		var values []float64
+		for i := range 50 {
+			values = append(values, float64(h*10+i%37))
+		}
+		rows = append(rows, rowOf(readingsOf(values...)))
+	}
+	direct := SummarizeRows(rows)
+
+	var halves []models.Data
+	for _, part := range [][]models.Data{rows[:2], rows[2:]} {
+		var row models.Data
+		summary := SummarizeRows(part)
+		summary.Apply(&row)
+		halves = append(halves, row)
+	}
+	nested := SummarizeRows(halves)
+
+	got, _ := nested.P95.Get("pm2_5")
+	want, _ := direct.P95.Get("pm2_5")
+	if math.Abs(float64(got-want)) > 1 {
+		t.Errorf("nested p95 = %v, direct %v", got, want)
+	}
+	if nested.Count != 200 {
+		t.Errorf("count = %d, want 200", nested.Count)
+	}
+}
+
+func TestSummarizeRowsWithoutSketch(t *testing.T) {
+	// 旧数据没有分位数草图时由极值、中位数和 P95 近似
+	row := rowOf(readingsOf(1, 2, 3, 4, 5, 6, 7, 8, 9, 10))
+	row.Quantiles = nil
+	merged := SummarizeRows([]models.Data{row})
+	got, _ := merged.P95.Get("pm2_5")
+	want, _ := row.P95.Get("pm2_5")
+	if math.Abs(float64(got-want)) > 0.01 {
+		t.Errorf("p95 = %v, want %v", got, want)
+	}
+}
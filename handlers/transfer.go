@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"errors"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type TransferHandler struct {
+	Expires int // 转移请求有效期（秒）
+	BaseHandler[models.DeviceTransfer]
+}
+
+// 将超时未处理的转移请求标记为已过期
+func (h *TransferHandler) expirePending() {
+	now := time.Now()
+	h.DB.Model(&models.DeviceTransfer{}).
+		Where("status = ? AND expires_at < ?", 0, now).
+		Updates(map[string]any{"status": 4, "finished_at": now})
+}
+
+// 按Params过滤转移记录
+func filterTransfers(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if status := c.Query("status"); status != "" {
+		if s, err := strconv.ParseUint(status, 10, 8); err == nil {
+			query = query.Where("status = ?", s)
+		}
+	}
+	if deviceUUID := c.Query("device_uuid"); deviceUUID != "" {
+		query = query.Where("device_uuid = ?", deviceUUID)
+	}
+	return query
+}
+
+// 原拥有者发起转移请求
+func (h *TransferHandler) Create(c *gin.Context) {
+	h.BaseHandler.Create(
+		nil,
+		func(c *gin.Context, query *gorm.DB, transfer *models.DeviceTransfer, data map[string]any) error {
+			currentUser := c.MustGet("CurrentUser").(*models.User)
+
+			device := &models.Device{}
+			if err := h.DB.First(device, "uuid = ? AND owner_id = ?", c.Param("uuid"), currentUser.UUID).Error; err != nil {
+				return errors.New("设备未绑定为当前用户")
+			}
+
+			toUserStr, ok := data["to_user_id"].(string)
+			if !ok || toUserStr == "" {
+				return errors.New("to_user_id is required")
+			}
+			toUserID, err := uuid.Parse(toUserStr)
+			if err != nil {
+				return errors.New("invalid to_user_id")
+			}
+			if toUserID == currentUser.UUID {
+				return errors.New("不能将设备转移给自己")
+			}
+			if err := h.DB.First(&models.User{}, "uuid = ?", toUserID).Error; err != nil {
+				return utils.ErrUserNotFound
+			}
+
+			// 同一设备同时只允许存在一个待接收的转移请求
+			h.expirePending()
+			var pending int64
+			if err := h.DB.Model(&models.DeviceTransfer{}).Where("device_uuid = ? AND status = ?", device.UUID, 0).Count(&pending).Error; err != nil {
+				return err
+			}
+			if pending > 0 {
+				return errors.New("该设备已有待接收的转移请求")
+			}
+
+			expires := h.Expires
+			if expires <= 0 {
+				expires = 72 * 3600 // 默认三天
+			}
+
+			carryData, _ := data["carry_data"].(bool)
+			transfer.DeviceUUID = &device.UUID
+			transfer.FromUserID = &currentUser.UUID
+			transfer.ToUserID = &toUserID
+			transfer.CarryData = carryData
+			transfer.Status = 0
+			transfer.ExpiresAt = time.Now().Add(time.Duration(expires) * time.Second)
+			return nil
+		},
+	)(c)
+}
+
+// 管理员查看全部转移记录
+func (h *TransferHandler) List(c *gin.Context) {
+	h.expirePending()
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			if userID := c.Query("user_id"); userID != "" {
+				query = query.Where("from_user_id = ? OR to_user_id = ?", userID, userID)
+			}
+			return filterTransfers(c, query)
+		},
+	)(c)
+}
+
+// 用户查看自己发起或收到的转移记录
+func (h *TransferHandler) MyTransfers(c *gin.Context) {
+	h.expirePending()
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			currentUser := c.MustGet("CurrentUser").(*models.User)
+			switch c.Query("role") {
+			case "sent":
+				query = query.Where("from_user_id = ?", currentUser.UUID)
+			case "received":
+				query = query.Where("to_user_id = ?", currentUser.UUID)
+			default:
+				query = query.Where("from_user_id = ? OR to_user_id = ?", currentUser.UUID, currentUser.UUID)
+			}
+			return filterTransfers(c, query).Preload("Device")
+		},
+	)(c)
+}
+
+// 检查转移请求是否仍可处理，过期的请求会被顺带标记
+func (h *TransferHandler) checkPending(transfer *models.DeviceTransfer) error {
+	if transfer.Status != 0 {
+		return utils.ErrTransferFinished
+	}
+	if time.Now().After(transfer.ExpiresAt) {
+		now := time.Now()
+		h.DB.Model(transfer).Updates(map[string]any{"status": 4, "finished_at": now})
+		return utils.ErrTransferExpired
+	}
+	return nil
+}
+
+// 接收者接受转移请求
+func (h *TransferHandler) Accept(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Where("uuid = ? AND to_user_id = ?", c.Param("uuid"), c.MustGet("CurrentUser").(*models.User).UUID)
+		},
+		func(c *gin.Context, query *gorm.DB, transfer *models.DeviceTransfer, data map[string]any) error {
+			if err := h.checkPending(transfer); err != nil {
+				return err
+			}
+
+			now := time.Now()
+			return h.DB.Transaction(func(tx *gorm.DB) error {
+				// 新拥有者需要重新设置昵称
+				updates := map[string]any{"owner_id": transfer.ToUserID, "nickname": ""}
+				if !transfer.CarryData {
+					// 不携带历史数据时，新拥有者只能看到转移之后的数据
+					updates["data_visible_from"] = now
+				}
+				result := tx.Model(&models.Device{}).
+					Where("uuid = ? AND owner_id = ?", transfer.DeviceUUID, transfer.FromUserID).
+					Updates(updates)
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected == 0 {
+					return errors.New("设备拥有者已变更")
+				}
+
+				transfer.Status = 1
+				transfer.FinishedAt = &now
+				return tx.Save(transfer).Error
+			})
+		},
+	)(c)
+}
+
+// 接收者拒绝转移请求
+func (h *TransferHandler) Reject(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Where("uuid = ? AND to_user_id = ?", c.Param("uuid"), c.MustGet("CurrentUser").(*models.User).UUID)
+		},
+		func(c *gin.Context, query *gorm.DB, transfer *models.DeviceTransfer, data map[string]any) error {
+			if err := h.checkPending(transfer); err != nil {
+				return err
+			}
+			now := time.Now()
+			transfer.Status = 2
+			transfer.FinishedAt = &now
+			return nil
+		},
+	)(c)
+}
+
+// 原拥有者取消转移请求
+func (h *TransferHandler) Cancel(c *gin.Context) {
+	h.BaseHandler.Update(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Where("uuid = ? AND from_user_id = ?", c.Param("uuid"), c.MustGet("CurrentUser").(*models.User).UUID)
+		},
+		func(c *gin.Context, query *gorm.DB, transfer *models.DeviceTransfer, data map[string]any) error {
+			if err := h.checkPending(transfer); err != nil {
+				return err
+			}
+			now := time.Now()
+			transfer.Status = 3
+			transfer.FinishedAt = &now
+			return nil
+		},
+	)(c)
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"errors"
+	"ssat_backend_rebuild/models"
+	"ssat_backend_rebuild/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type TwinHandler struct {
+	BaseHandler[models.DeviceTwin]
+}
+
+// 设备上传时携带的已应用配置
+type TwinReport struct {
+	Version int               `json:"version"` // 设备已应用的期望配置版本
+	Config  models.TwinConfig `json:"config"`
+}
+
+// 获取设备孪生，不存在时创建
+func getOrCreateTwin(db *gorm.DB, deviceUUID uuid.UUID) (*models.DeviceTwin, error) {
+	twin := &models.DeviceTwin{}
+	err := db.Where(models.DeviceTwin{DeviceUUID: deviceUUID}).FirstOrCreate(twin).Error
+	return twin, err
+}
+
+// 计算期望配置与上报配置的差异
+func twinDelta(twin *models.DeviceTwin) (delta models.TwinConfig, changed bool) {
+	desired, reported := twin.Desired, twin.Reported
+	if desired.SamplingInterval != nil && (reported.SamplingInterval == nil || *reported.SamplingInterval != *desired.SamplingInterval) {
+		delta.SamplingInterval = desired.SamplingInterval
+		changed = true
+	}
+	if desired.UploadThreshold != nil && (reported.UploadThreshold == nil || *reported.UploadThreshold != *desired.UploadThreshold) {
+		delta.UploadThreshold = desired.UploadThreshold
+		changed = true
+	}
+	if desired.Scene != nil && (reported.Scene == nil || *reported.Scene != *desired.Scene) {
+		delta.Scene = desired.Scene
+		changed = true
+	}
+	return delta, changed
+}
+
+// 记录设备上报的配置，并返回需要下发给设备的差异
+func SyncTwinOnUpload(db *gorm.DB, device *models.Device, report *TwinReport) (gin.H, error) {
+	twin := &models.DeviceTwin{}
+	if report != nil {
+		var err error
+		if twin, err = getOrCreateTwin(db, device.UUID); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		twin.Reported = report.Config
+		twin.ReportedVersion = report.Version
+		twin.ReportedAt = &now
+		if err := db.Model(twin).Select("reported", "reported_version", "reported_at").Updates(twin).Error; err != nil {
+			return nil, err
+		}
+	} else if err := db.First(twin, "device_uuid = ?", device.UUID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	delta, changed := twinDelta(twin)
+	if !changed && twin.ReportedVersion >= twin.DesiredVersion {
+		return nil, nil
+	}
+	return gin.H{"version": twin.DesiredVersion, "delta": delta}, nil
+}
+
+// 根据请求体修改期望配置，值为 null 的字段会被清除
+func updateDesired(db *gorm.DB, twin *models.DeviceTwin, data map[string]any) error {
+	desired, ok := data["desired"].(map[string]any)
+	if !ok {
+		return errors.New("desired is required")
+	}
+
+	positiveInt := func(key string) (*int, error) {
+		if desired[key] == nil {
+			return nil, nil
+		}
+		value, ok := desired[key].(float64)
+		if !ok || value <= 0 || value != float64(int(value)) {
+			return nil, errors.New("invalid " + key)
+		}
+		v := int(value)
+		return &v, nil
+	}
+
+	if _, ok := desired["sampling_interval"]; ok {
+		v, err := positiveInt("sampling_interval")
+		if err != nil {
+			return err
+		}
+		twin.Desired.SamplingInterval = v
+	}
+	if _, ok := desired["upload_threshold"]; ok {
+		v, err := positiveInt("upload_threshold")
+		if err != nil {
+			return err
+		}
+		twin.Desired.UploadThreshold = v
+	}
+	if value, ok := desired["scene"]; ok {
+		if value == nil {
+			twin.Desired.Scene = nil
+		} else {
+			scene, ok := value.(string)
+			if _, exists := lookupScene(scene); !ok || !exists {
+				return errors.New("invalid scene")
+			}
+			twin.Desired.Scene = &scene
+
+			// 设备的场景以设备记录为准，两者保持一致
+			if err := db.Model(&models.Device{}).Where("uuid = ?", twin.DeviceUUID).Update("scene", scene).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	twin.DesiredVersion++
+	return nil
+}
+
+// 确保设备孪生存在，返回 false 时已写入响应
+func (h *TwinHandler) ensureTwin(c *gin.Context, deviceQuery *gorm.DB) bool {
+	device := &models.Device{}
+	if err := deviceQuery.First(device).Error; err != nil {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return false
+	}
+	if _, err := getOrCreateTwin(h.DB, device.UUID); err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return false
+	}
+	return true
+}
+
+func (h *TwinHandler) Retrieve(c *gin.Context) {
+	if !h.ensureTwin(c, h.DB.Where("uuid = ?", c.Param("uuid"))) {
+		return
+	}
+	h.BaseHandler.Retrieve(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Where("device_uuid = ?", c.Param("uuid"))
+		},
+	)(c)
+}
+
+func (h *TwinHandler) RetrieveMyTwin(c *gin.Context) {
+	currentUser := c.MustGet("CurrentUser").(*models.User)
+	if !h.ensureTwin(c, h.DB.Where("uuid = ? AND owner_id = ?", c.Param("uuid"), currentUser.UUID)) {
+		return
+	}
+	h.BaseHandler.Retrieve(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Where("device_uuid = ?", c.Param("uuid"))
+		},
+	)(c)
+}
+
+func (h *TwinHandler) Update(c *gin.Context) {
+	if !h.ensureTwin(c, h.DB.Where("uuid = ?", c.Param("uuid"))) {
+		return
+	}
+	h.updateTwin(c)
+}
+
+func (h *TwinHandler) UpdateMyTwin(c *gin.Context) {
+	currentUser := c.MustGet("CurrentUser").(*models.User)
+	if !h.ensureTwin(c, h.DB.Where("uuid = ? AND owner_id = ?", c.Param("uuid"), currentUser.UUID)) {
+		return
+	}
+	h.updateTwin(c)
+}
+
+// 修改期望配置
+func (h *TwinHandler) updateTwin(c *gin.Context) {
+	data, err := h.parseRequestData(c)
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrMissingParam)
+		return
+	}
+
+	twin := &models.DeviceTwin{}
+	var invalid error
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		// 锁定孪生行，避免并发修改互相覆盖期望配置或生成相同的版本号
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(twin, "device_uuid = ?", c.Param("uuid")).Error; err != nil {
+			return err
+		}
+		if invalid = updateDesired(tx, twin, data); invalid != nil {
+			return invalid
+		}
+		return tx.Save(twin).Error
+	})
+	if invalid != nil {
+		utils.Respond(c, nil, utils.ErrorCode{Code: 4, HttpCode: 400, Message: invalid.Error()})
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.Respond(c, nil, utils.ErrNotFound)
+		return
+	}
+	if err != nil {
+		utils.Respond(c, nil, utils.ErrInternalServer)
+		return
+	}
+	utils.Respond(c, twin, utils.ErrOK)
+}
+
+// 列出上报配置落后于期望配置的设备
+func (h *TwinHandler) OutOfSync(c *gin.Context) {
+	h.BaseHandler.List(
+		nil,
+		func(c *gin.Context, query *gorm.DB) *gorm.DB {
+			return query.Where("reported_version < desired_version")
+		},
+	)(c)
+}
@@ -20,6 +20,9 @@ func main() {
 	// 设置路由
 	setup.SetupRoutes(router, db, dbMongo, myConfig)
 
+	// 启动后台任务
+	setup.SetupWorkers(db, myConfig)
+
 	// 启动服务器
 	if err := router.Run(myConfig.ServerAddr); err != nil {
 		log.Fatal("服务器启动失败: ", err)
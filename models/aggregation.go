@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 设备数据聚合的进度，由后台聚合任务维护
+type AggregationProgress struct {
+	DeviceUUID    uuid.UUID  `json:"device_uuid" gorm:"type:char(36);uniqueIndex;not null"`
+	LastRunAt     *time.Time `json:"last_run_at" gorm:"null"`     // 最近一次执行时间
+	LastSuccessAt *time.Time `json:"last_success_at" gorm:"null"` // 最近一次成功时间
+	Batches       int64      `json:"batches" gorm:"default:0"`    // 累计生成的统计数据条数
+	Readings      int64      `json:"readings" gorm:"default:0"`   // 累计聚合的读数条数
+	Failures      int        `json:"failures" gorm:"default:0"`   // 连续失败次数，成功后清零
+	LastError     string     `json:"last_error" gorm:"type:text"`
+	ModifiedAt    *time.Time `json:"modified_at" gorm:"autoUpdateTime"`
+	BaseModel
+}
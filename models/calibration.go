@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 传感器校准系数，校准值 = 原始值 * Gain + Offset
+type Calibration struct {
+	DeviceUUID uuid.UUID  `json:"device_uuid" gorm:"type:char(36);index;not null"`
+	Field      string     `json:"field" gorm:"type:varchar(32);not null"` // DataEntry 中的字段名，如 pm2_5
+	Offset     float64    `json:"offset" gorm:"default:0"`
+	Gain       float64    `json:"gain" gorm:"default:1"`
+	ValidFrom  time.Time  `json:"valid_from" gorm:"not null"` // 生效时间
+	ValidTo    *time.Time `json:"valid_to" gorm:"null"`       // 失效时间，为空表示长期有效
+	BaseModel
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 下发给设备的指令
+type DeviceCommand struct {
+	DeviceUUID  uuid.UUID      `json:"device_uuid" gorm:"type:char(36);index;uniqueIndex:idx_command_seq;not null"`
+	Name        string         `json:"name" gorm:"type:varchar(32);not null"`           // 指令名称，如 reboot
+	Params      map[string]any `json:"params" gorm:"type:text;serializer:json"`         // 指令参数
+	Seq         int64          `json:"seq" gorm:"not null;uniqueIndex:idx_command_seq"` // 同一设备内递增的序号，设备按序执行
+	Status      uint8          `json:"status" gorm:"type:tinyint(1);default:0"`         // 0: 待下发，1: 已下发，2: 已确认，3: 执行失败，4: 已过期
+	ExpiresAt   time.Time      `json:"expires_at" gorm:"not null"`
+	DeliveredAt *time.Time     `json:"delivered_at" gorm:"null"`
+	AckedAt     *time.Time     `json:"acked_at" gorm:"null"`
+	Result      string         `json:"result" gorm:"type:text"` // 设备回报的执行结果
+	BaseModel
+}
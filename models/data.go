@@ -1,24 +1,207 @@
 package models
 
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// 一组读数。内置的十项指标为固定字段，其余在指标注册表中登记的指标存放在 Extra 中。
+// 未上报的内置指标记录在 Missing 中，读取时视为不存在；Missing 为空表示内置指标均有值（兼容旧数据）
 type DataEntry struct {
-	Temperature float32 `json:"temperature" binding:"required"   gorm:"type:float;default:0"`
-	Humidity    float32 `json:"humidity"    binding:"required"   gorm:"type:float;default:0"`
-	FreshAir    float32 `json:"fresh_air"   binding:"required"   gorm:"type:float;default:0"`
-	Ozone       float32 `json:"ozone"       binding:"required"   gorm:"type:float;default:0"`
-	NitroDio    float32 `json:"nitro_dio"   binding:"required"   gorm:"type:float;default:0"`
-	Methanal    float32 `json:"methanal"    binding:"required"   gorm:"type:float;default:0"`
-	Pm25        float32 `json:"pm2_5"       binding:"required"   gorm:"type:float;default:0"`
-	CarbMomo    float32 `json:"carb_momo"   binding:"required"   gorm:"type:float;default:0"`
-	Bacteria    float32 `json:"bacteria"    binding:"required"   gorm:"type:float;default:0"`
-	Radon       float32 `json:"radon"       binding:"required"   gorm:"type:float;default:0"`
+	Temperature float32            `json:"temperature" gorm:"type:float;default:0"`
+	Humidity    float32            `json:"humidity"    gorm:"type:float;default:0"`
+	FreshAir    float32            `json:"fresh_air"   gorm:"type:float;default:0"`
+	Ozone       float32            `json:"ozone"       gorm:"type:float;default:0"`
+	NitroDio    float32            `json:"nitro_dio"   gorm:"type:float;default:0"`
+	Methanal    float32            `json:"methanal"    gorm:"type:float;default:0"`
+	Pm25        float32            `json:"pm2_5"       gorm:"type:float;default:0"`
+	CarbMomo    float32            `json:"carb_momo"   gorm:"type:float;default:0"`
+	Bacteria    float32            `json:"bacteria"    gorm:"type:float;default:0"`
+	Radon       float32            `json:"radon"       gorm:"type:float;default:0"`
+	Extra       map[string]float32 `json:"-" bson:",inline" gorm:"type:text;serializer:json"`           // 扩展指标，JSON 中与内置指标平铺
+	Missing     []string           `json:"-" bson:"missing,omitempty" gorm:"type:text;serializer:json"` // 未上报的内置指标
+}
+
+// 不含任何指标的读数，逐项 Set 后只有写入过的内置指标有值
+func EmptyDataEntry() DataEntry {
+	return DataEntry{Missing: append([]string(nil), DataEntryKeys...)}
+}
+
+// 内置指标的字段名，按固定顺序排列
+var DataEntryKeys = []string{
+	"temperature", "humidity", "fresh_air", "ozone", "nitro_dio",
+	"methanal", "pm2_5", "carb_momo", "bacteria", "radon",
+}
+
+// 按 JSON 字段名获取内置指标的字段指针
+func (e *DataEntry) field(key string) *float32 {
+	switch key {
+	case "temperature":
+		return &e.Temperature
+	case "humidity":
+		return &e.Humidity
+	case "fresh_air":
+		return &e.FreshAir
+	case "ozone":
+		return &e.Ozone
+	case "nitro_dio":
+		return &e.NitroDio
+	case "methanal":
+		return &e.Methanal
+	case "pm2_5":
+		return &e.Pm25
+	case "carb_momo":
+		return &e.CarbMomo
+	case "bacteria":
+		return &e.Bacteria
+	case "radon":
+		return &e.Radon
+	}
+	return nil
+}
+
+// 按指标名读取数值，指标不存在或内置指标未上报时返回 false
+func (e *DataEntry) Get(key string) (float32, bool) {
+	if f := e.field(key); f != nil {
+		if slices.Contains(e.Missing, key) {
+			return 0, false
+		}
+		return *f, true
+	}
+	value, ok := e.Extra[key]
+	return value, ok
+}
+
+// 按指标名写入数值，非内置指标写入 Extra
+func (e *DataEntry) Set(key string, value float32) {
+	if f := e.field(key); f != nil {
+		*f = value
+		// 复制后再修改，避免影响共用同一切片的副本
+		if slices.Contains(e.Missing, key) {
+			e.Missing = slices.DeleteFunc(slices.Clone(e.Missing), func(k string) bool { return k == key })
+		}
+		return
+	}
+	if e.Extra == nil {
+		e.Extra = make(map[string]float32)
+	}
+	e.Extra[key] = value
+}
+
+// 全部指标名：已上报的内置指标在前，扩展指标按名称排序
+func (e *DataEntry) Keys() []string {
+	keys := make([]string, 0, len(DataEntryKeys)+len(e.Extra))
+	for _, key := range DataEntryKeys {
+		if !slices.Contains(e.Missing, key) {
+			keys = append(keys, key)
+		}
+	}
+	extra := make([]string, 0, len(e.Extra))
+	for key := range e.Extra {
+		extra = append(extra, key)
+	}
+	sort.Strings(extra)
+	return append(keys, extra...)
+}
+
+// 转为平铺的指标名到数值的映射
+func (e DataEntry) toMap() map[string]float32 {
+	values := make(map[string]float32, len(DataEntryKeys)+len(e.Extra))
+	for _, key := range e.Keys() {
+		values[key], _ = e.Get(key)
+	}
+	return values
 }
 
+func (e *DataEntry) fromMap(values map[string]float32) {
+	*e = EmptyDataEntry()
+	for key, value := range values {
+		e.Set(key, value)
+	}
+}
+
+func (e DataEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.toMap())
+}
+
+func (e *DataEntry) UnmarshalJSON(b []byte) error {
+	var values map[string]float32
+	if err := json.Unmarshal(b, &values); err != nil {
+		return err
+	}
+	e.fromMap(values)
+	return nil
+}
+
+func (e *DataEntry) UnmarshalCBOR(b []byte) error {
+	var values map[string]float32
+	if err := cbor.Unmarshal(b, &values); err != nil {
+		return err
+	}
+	e.fromMap(values)
+	return nil
+}
+
+// 内置指标在 MongoDB 文档中的字段名（驱动默认使用小写的结构体字段名），扩展指标与指标名相同
+var dataEntryBSON = map[string]string{
+	"fresh_air": "freshair",
+	"nitro_dio": "nitrodio",
+	"pm2_5":     "pm25",
+	"carb_momo": "carbmomo",
+}
+
+func DataEntryBSONField(key string) string {
+	if field, ok := dataEntryBSON[key]; ok {
+		return field
+	}
+	return key
+}
+
+// 内置指标的 JSON 名与数据库列名后缀的对应关系
+var DataEntryColumns = map[string]string{
+	"temperature": "temperature",
+	"humidity":    "humidity",
+	"fresh_air":   "fresh_air",
+	"ozone":       "ozone",
+	"nitro_dio":   "nitro_dio",
+	"methanal":    "methanal",
+	"pm2_5":       "pm25",
+	"carb_momo":   "carb_momo",
+	"bacteria":    "bacteria",
+	"radon":       "radon",
+}
+
+// 统计数据的时间粒度，空字符串表示按条数聚合的批次
+const (
+	ResolutionBatch = ""
+	Resolution5Min  = "5m"
+	ResolutionHour  = "1h"
+	ResolutionDay   = "1d"
+)
+
 type Data struct {
-	MyDeviceID string    `json:"device_id" gorm:"type:char(16)"`
-	MyDevice   *Device   `json:"my_device" gorm:"foreignKey:MyDeviceID"`
-	Avg        DataEntry `json:"avg" gorm:"embedded;embeddedPrefix:avg_"`
-	Var        DataEntry `json:"var" gorm:"embedded;embeddedPrefix:var_"`
-	Min        DataEntry `json:"min" gorm:"embedded;embeddedPrefix:min_"`
-	Max        DataEntry `json:"max" gorm:"embedded;embeddedPrefix:max_"`
+	MyDeviceID       string               `json:"device_id" gorm:"type:char(36);uniqueIndex:idx_data_window"`
+	MyDevice         *Device              `json:"my_device" gorm:"foreignKey:MyDeviceID"`
+	Resolution       string               `json:"resolution" gorm:"type:varchar(8);default:'';uniqueIndex:idx_data_window"`
+	WindowStart      *time.Time           `json:"window_start" gorm:"null;uniqueIndex:idx_data_window"` // 时间窗口起点（含）；按条数聚合时为第一条读数的时间
+	WindowEnd        *time.Time           `json:"window_end" gorm:"null"`                               // 时间窗口终点（不含）；按条数聚合时为最后一条读数的时间
+	Count            int                  `json:"count" gorm:"default:0"`                               // 参与统计的读数条数
+	Avg              DataEntry            `json:"avg" gorm:"embedded;embeddedPrefix:avg_"`
+	Var              DataEntry            `json:"var" gorm:"embedded;embeddedPrefix:var_"`
+	Min              DataEntry            `json:"min" gorm:"embedded;embeddedPrefix:min_"`
+	Max              DataEntry            `json:"max" gorm:"embedded;embeddedPrefix:max_"`
+	Std              DataEntry            `json:"std" gorm:"embedded;embeddedPrefix:std_"`       // 标准差
+	Median           DataEntry            `json:"median" gorm:"embedded;embeddedPrefix:median_"` // 中位数，小时和天统计数据为估算值
+	P95              DataEntry            `json:"p95" gorm:"embedded;embeddedPrefix:p95_"`       // 95 分位数，小时和天统计数据为估算值
+	Quantiles        map[string][]float32 `json:"-" gorm:"type:text;serializer:json"`            // 各指标在固定分位点处的值，用于合并小时和天统计数据的分位数
+	AQI              *int                 `json:"aqi" gorm:"null"`                               // 由平均值计算的空气质量指数，没有可计算的污染物时为空
+	AQILevel         int                  `json:"aqi_level" gorm:"default:0"`                    // 空气质量指数级别
+	AQICategory      string               `json:"aqi_category" gorm:"type:varchar(16)"`          // 空气质量指数类别，如 优、良
+	PrimaryPollutant string               `json:"primary_pollutant" gorm:"type:varchar(64)"`     // 首要污染物，多个时以逗号分隔
+	FinePurged       bool                 `json:"-" gorm:"default:false"`                        // 天统计数据的下级统计数据已按保留策略清理，补传的数据并入已有结果
 	BaseModel
 }
@@ -6,14 +6,61 @@ import (
 	"github.com/google/uuid"
 )
 
+// 设备状态
+const (
+	DeviceStatusUnknown     = 0 // 从未上报或状态未知
+	DeviceStatusOnline      = 1 // 在线
+	DeviceStatusOffline     = 2 // 离线
+	DeviceStatusAnomalous   = 3 // 数据异常
+	DeviceStatusMaintenance = 4 // 维护中
+)
+
 type Device struct {
-	DeviceID     string     `json:"device_id" gorm:"type:char(16);uniqueIndex;not null"`
-	Nickname     string     `json:"nickname" gorm:"type:varchar(64);not null"`
-	Secret       string     `json:"-" gorm:"type:char(255)"`
-	Status       int        `json:"status" gorm:"type:int;default:0"`
-	LastReceived *time.Time `json:"last_received" gorm:"null"`
-	OwnerID      *uuid.UUID `json:"owner_id" gorm:"type:char(36);null"`
-	Owner        *User      `json:"owner" gorm:"foreignKey:OwnerID"`
-	Data         *[]Data    `json:"data" gorm:"foreignKey:MyDeviceID"`
+	DeviceID        string            `json:"device_id" gorm:"type:char(16);uniqueIndex;not null"`
+	Nickname        string            `json:"nickname" gorm:"type:varchar(64);not null"`
+	Secret          string            `json:"-" gorm:"type:char(255)"`
+	Status          int               `json:"status" gorm:"type:int;default:0"`
+	OfflineTimeout  int               `json:"offline_timeout" gorm:"type:int;default:0"` // 超过该时长（秒）未上报视为离线，0 表示使用全局配置
+	LastReceived    *time.Time        `json:"last_received" gorm:"null"`
+	OwnerID         *uuid.UUID        `json:"owner_id" gorm:"type:char(36);null"`
+	Owner           *User             `json:"owner" gorm:"foreignKey:OwnerID"`
+	DataVisibleFrom *time.Time        `json:"data_visible_from" gorm:"null"` // 拥有者可见数据的起始时间，为空表示全部可见
+	RoomUUID        *uuid.UUID        `json:"room_uuid" gorm:"type:char(36);null"`
+	FirmwareVersion string            `json:"firmware_version" gorm:"type:varchar(32)"`                 // 设备上报的固件版本
+	Scene           string            `json:"scene" gorm:"type:varchar(32);default:'family'"`           // 场景，决定异常检测使用的阈值
+	Hemisphere      string            `json:"hemisphere" gorm:"type:varchar(8);default:'north'"`        // 所在半球，north 或 south，用于推算季节
+	Timezone        string            `json:"timezone" gorm:"type:varchar(64);default:'Asia/Shanghai'"` // 所在时区，IANA 名称
+	Capabilities    []string          `json:"capabilities" gorm:"type:text;serializer:json"`            // 设备支持的指标，为空表示全部内置指标
+	Detectors       []DetectorSetting `json:"detectors" gorm:"type:text;serializer:json"`               // 使用的异常检测器，为空表示只按场景阈值检测
+	Room            *Room             `json:"room" gorm:"foreignKey:RoomUUID"`
+	Data            *[]Data           `json:"data" gorm:"foreignKey:MyDeviceID"`
+	BaseModel
+}
+
+// 设备使用的异常检测器及灵敏度
+type DetectorSetting struct {
+	Name        string  `json:"name"`        // 检测器名称，如 range、zscore
+	Sensitivity float64 `json:"sensitivity"` // 检测阈值，含义因检测器而异，0 表示使用默认值
+}
+
+// 设备状态变更记录
+type DeviceEvent struct {
+	DeviceUUID uuid.UUID `json:"device_uuid" gorm:"type:char(36);index;not null"`
+	FromStatus int       `json:"from_status" gorm:"type:int"`
+	ToStatus   int       `json:"to_status" gorm:"type:int"`
+	Reason     string    `json:"reason" gorm:"type:varchar(128)"`
+	BaseModel
+}
+
+// 异常检测基线的阶跃记录：连续同方向的异常读数替换了该指标的基线，重新加载设备历史时据此恢复
+type DetectorBaseline struct {
+	DeviceID string          `json:"device_id" gorm:"type:char(16);uniqueIndex:idx_detector_baseline;not null"`
+	Metric   string          `json:"metric" gorm:"type:varchar(32);uniqueIndex:idx_detector_baseline;not null"`
+	Points   []BaselinePoint `json:"points" gorm:"type:text;serializer:json"` // 替换基线的异常读数，按时间升序
 	BaseModel
 }
+
+type BaselinePoint struct {
+	Time  int64   `json:"time"`
+	Value float64 `json:"value"`
+}
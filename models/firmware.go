@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 固件文件
+type Firmware struct {
+	Version   string `json:"version" gorm:"type:varchar(32);uniqueIndex;not null"`
+	FilePath  string `json:"-" gorm:"type:varchar(255);not null"` // 本地存储路径
+	Size      int64  `json:"size" gorm:"not null"`
+	SHA256    string `json:"sha256" gorm:"type:char(64);not null"`
+	Signature string `json:"signature" gorm:"type:text"` // 构建方对固件的签名，设备安装前校验
+	Note      string `json:"note" gorm:"type:text"`
+	BaseModel
+}
+
+// 固件推送任务
+type FirmwareCampaign struct {
+	FirmwareUUID *uuid.UUID `json:"firmware_uuid" gorm:"type:char(36);not null"`
+	Firmware     *Firmware  `json:"firmware" gorm:"foreignKey:FirmwareUUID"`
+	TargetType   string     `json:"target_type" gorm:"type:varchar(16);not null"` // all, organization, site, room
+	TargetUUID   *uuid.UUID `json:"target_uuid" gorm:"type:char(36);null"`
+	Percentage   int        `json:"percentage" gorm:"type:int;default:0"`    // 分阶段推送的设备比例（0-100）
+	Status       uint8      `json:"status" gorm:"type:tinyint(1);default:0"` // 0: 推送中，1: 已暂停，2: 已结束
+	ModifiedAt   *time.Time `json:"modified_at" gorm:"autoUpdateTime"`
+	BaseModel
+}
+
+// 单台设备的升级状态
+type DeviceFirmwareUpdate struct {
+	DeviceUUID   uuid.UUID  `json:"device_uuid" gorm:"type:char(36);uniqueIndex:idx_device_campaign;not null"`
+	CampaignUUID uuid.UUID  `json:"campaign_uuid" gorm:"type:char(36);uniqueIndex:idx_device_campaign;not null"`
+	FromVersion  string     `json:"from_version" gorm:"type:varchar(32)"`
+	ToVersion    string     `json:"to_version" gorm:"type:varchar(32);not null"`
+	Status       uint8      `json:"status" gorm:"type:tinyint(1);default:0"` // 0: 已推送，1: 下载中，2: 已安装，3: 失败，4: 已中止
+	Error        string     `json:"error" gorm:"type:text"`                  // 设备回报的失败原因
+	ModifiedAt   *time.Time `json:"modified_at" gorm:"autoUpdateTime"`
+	BaseModel
+}
@@ -0,0 +1,29 @@
+package models
+
+import "github.com/google/uuid"
+
+// 组织 > 站点 > 房间 三级位置结构
+type Organization struct {
+	Name        string `json:"name" gorm:"type:varchar(128);not null"`
+	Description string `json:"description" gorm:"type:text"`
+	Sites       []Site `json:"sites" gorm:"foreignKey:OrganizationUUID"`
+	BaseModel
+}
+
+type Site struct {
+	OrganizationUUID *uuid.UUID    `json:"organization_uuid" gorm:"type:char(36);not null"`
+	Organization     *Organization `json:"-" gorm:"foreignKey:OrganizationUUID"`
+	Name             string        `json:"name" gorm:"type:varchar(128);not null"`
+	Address          string        `json:"address" gorm:"type:varchar(255)"`
+	Rooms            []Room        `json:"rooms" gorm:"foreignKey:SiteUUID"`
+	BaseModel
+}
+
+type Room struct {
+	SiteUUID *uuid.UUID `json:"site_uuid" gorm:"type:char(36);not null"`
+	Site     *Site      `json:"-" gorm:"foreignKey:SiteUUID"`
+	Name     string     `json:"name" gorm:"type:varchar(128);not null"`
+	Floor    string     `json:"floor" gorm:"type:varchar(32)"` // 所在楼层
+	Devices  []Device   `json:"devices" gorm:"foreignKey:RoomUUID"`
+	BaseModel
+}
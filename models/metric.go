@@ -0,0 +1,33 @@
+package models
+
+// 指标定义。内置指标对应 DataEntry 的固定字段，其余指标存放在 DataEntry.Extra 中
+type Metric struct {
+	Key       string   `json:"key" gorm:"type:varchar(32);uniqueIndex;not null"` // 指标名，如 pm2_5
+	Unit      string   `json:"unit" gorm:"type:varchar(16)"`
+	NameZh    string   `json:"name_zh" gorm:"type:varchar(64)"`
+	NameEn    string   `json:"name_en" gorm:"type:varchar(64)"`
+	ValidMin  *float64 `json:"valid_min" gorm:"null"`               // 传感器可测量的物理下限，为空表示不限
+	ValidMax  *float64 `json:"valid_max" gorm:"null"`               // 传感器可测量的物理上限，为空表示不限
+	Precision int      `json:"precision" gorm:"type:int;default:3"` // 保存时保留的小数位数
+	MaxRate   *float64 `json:"max_rate" gorm:"null"`                // 每分钟最大合理变化量，供变化率检测使用，为空表示不检查
+	Builtin   bool     `json:"builtin" gorm:"default:false"`        // 内置指标不可删除
+	BaseModel
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// 内置指标，启动时写入指标注册表
+var BuiltinMetrics = []Metric{
+	{Key: "temperature", Unit: "℃", NameZh: "温度", NameEn: "Temperature", ValidMin: floatPtr(-40), ValidMax: floatPtr(85), Precision: 2, MaxRate: floatPtr(2)},
+	{Key: "humidity", Unit: "%", NameZh: "湿度", NameEn: "Humidity", ValidMin: floatPtr(0), ValidMax: floatPtr(100), Precision: 2, MaxRate: floatPtr(10)},
+	{Key: "fresh_air", Unit: "次/h", NameZh: "新风", NameEn: "Fresh air", ValidMin: floatPtr(0), Precision: 3},
+	{Key: "ozone", Unit: "mg/m³", NameZh: "臭氧", NameEn: "Ozone", ValidMin: floatPtr(0), Precision: 3},
+	{Key: "nitro_dio", Unit: "mg/m³", NameZh: "二氧化氮", NameEn: "Nitrogen dioxide", ValidMin: floatPtr(0), Precision: 3},
+	{Key: "methanal", Unit: "mg/m³", NameZh: "甲醛", NameEn: "Formaldehyde", ValidMin: floatPtr(0), Precision: 3},
+	{Key: "pm2_5", Unit: "μg/m³", NameZh: "PM2.5", NameEn: "PM2.5", ValidMin: floatPtr(0), ValidMax: floatPtr(1000), Precision: 3},
+	{Key: "carb_momo", Unit: "mg/m³", NameZh: "一氧化碳", NameEn: "Carbon monoxide", ValidMin: floatPtr(0), Precision: 3},
+	{Key: "bacteria", Unit: "CFU/m³", NameZh: "细菌", NameEn: "Bacteria", ValidMin: floatPtr(0), Precision: 0},
+	{Key: "radon", Unit: "pCi/L", NameZh: "氡气", NameEn: "Radon", ValidMin: floatPtr(0), Precision: 3},
+}
@@ -0,0 +1,7 @@
+package models
+
+// 已执行的数据迁移，每个迁移只执行一次
+type SchemaMigration struct {
+	Name string `json:"name" gorm:"type:varchar(64);uniqueIndex;not null"`
+	BaseModel
+}
@@ -0,0 +1,13 @@
+package models
+
+import "github.com/google/uuid"
+
+// 数据保留策略，覆盖全局配置。设备的策略优先于所属组织的策略，字段为空时沿用上一级
+type RetentionPolicy struct {
+	TargetType string    `json:"target_type" gorm:"type:varchar(16);not null;uniqueIndex:idx_retention_target"` // organization/device
+	TargetUUID uuid.UUID `json:"target_uuid" gorm:"type:char(36);not null;uniqueIndex:idx_retention_target"`
+	RawDays    *int      `json:"raw_days" gorm:"null"`  // 原始读数保留天数，0 表示永久保留
+	FineDays   *int      `json:"fine_days" gorm:"null"` // 5 分钟、小时和按条数聚合的统计数据保留天数，0 表示永久保留
+	Note       string    `json:"note" gorm:"type:varchar(255)"`
+	BaseModel
+}
@@ -0,0 +1,23 @@
+package models
+
+import "github.com/google/uuid"
+
+// 异常检测使用的场景，如家庭、实验室
+type Scene struct {
+	Name        string `json:"name" gorm:"type:varchar(32);uniqueIndex;not null"` // 场景标识，设备通过该标识引用场景
+	DisplayName string `json:"display_name" gorm:"type:varchar(64)"`
+	Description string `json:"description" gorm:"type:text"`
+	Version     int    `json:"version" gorm:"type:int;default:0"` // 当前生效的阈值版本
+	BaseModel
+}
+
+// 场景在某一季节下某项指标的正常范围。每次修改阈值生成一个新版本，旧版本保留用于追溯
+type SceneThreshold struct {
+	SceneUUID uuid.UUID `json:"scene_uuid" gorm:"type:char(36);index:idx_scene_version;not null"`
+	Version   int       `json:"version" gorm:"type:int;index:idx_scene_version"`
+	Season    string    `json:"season" gorm:"type:varchar(16);not null"`
+	Metric    string    `json:"metric" gorm:"type:varchar(32);not null"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	BaseModel
+}
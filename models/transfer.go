@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DeviceTransfer struct {
+	DeviceUUID *uuid.UUID `json:"device_uuid" gorm:"type:char(36);not null"`
+	Device     *Device    `json:"device" gorm:"foreignKey:DeviceUUID"`
+	FromUserID *uuid.UUID `json:"from_user_id" gorm:"type:char(36);not null"` // 原拥有者
+	ToUserID   *uuid.UUID `json:"to_user_id" gorm:"type:char(36);not null"`   // 接收者
+	CarryData  bool       `json:"carry_data" gorm:"default:false"`            // 是否向新拥有者开放历史数据
+	Status     uint8      `json:"status" gorm:"type:tinyint(1);default:0"`    // 0: 待接收，1: 已接收，2: 已拒绝，3: 已取消，4: 已过期
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	FinishedAt *time.Time `json:"finished_at" gorm:"null"`
+	BaseModel
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 可远程下发给设备的配置项，字段为空表示未设置
+type TwinConfig struct {
+	SamplingInterval *int    `json:"sampling_interval,omitempty"` // 采样间隔（秒）
+	UploadThreshold  *int    `json:"upload_threshold,omitempty"`  // 本地缓存多少条数据后上传
+	Scene            *string `json:"scene,omitempty"`             // 场景
+}
+
+// 设备孪生：期望配置由管理员或拥有者修改，上报配置由设备上传时携带
+type DeviceTwin struct {
+	DeviceUUID      uuid.UUID  `json:"device_uuid" gorm:"type:char(36);uniqueIndex;not null"`
+	Desired         TwinConfig `json:"desired" gorm:"type:text;serializer:json"`
+	DesiredVersion  int        `json:"desired_version" gorm:"type:int;default:0"`
+	Reported        TwinConfig `json:"reported" gorm:"type:text;serializer:json"`
+	ReportedVersion int        `json:"reported_version" gorm:"type:int;default:0"` // 设备已应用的期望配置版本
+	ReportedAt      *time.Time `json:"reported_at" gorm:"null"`
+	ModifiedAt      *time.Time `json:"modified_at" gorm:"autoUpdateTime"`
+	BaseModel
+}
@@ -37,16 +37,41 @@ type AdminEntry struct {
 	Password string `json:"password"`
 }
 
+type MQTTConfig struct {
+	Enabled bool   `json:"enabled"`
+	Addr    string `json:"addr"`
+}
+
 type Config struct {
-	SQLConfig           SQLConfig    `json:"mysql"`
-	MongoConfig         MongoConfig  `json:"mongodb"`
-	JWTConfig           JWTConfig    `json:"jwt"`
-	WechatConfig        WechatConfig `json:"wechat"`
-	AdminsConfig        []AdminEntry `json:"admins"`
-	MongoToSQLThreshold int          `json:"mongo_to_sql_threshold"`
-	AiApiUrl            string       `json:"ai_api_url"`
-	AiApiKey            string       `json:"ai_api_key"`
-	ServerAddr          string       `json:"server_addr"`
+	SQLConfig              SQLConfig    `json:"mysql"`
+	MongoConfig            MongoConfig  `json:"mongodb"`
+	JWTConfig              JWTConfig    `json:"jwt"`
+	WechatConfig           WechatConfig `json:"wechat"`
+	AdminsConfig           []AdminEntry `json:"admins"`
+	MQTTConfig             MQTTConfig   `json:"mqtt"`
+	MongoToSQLThreshold    int          `json:"mongo_to_sql_threshold"`
+	AiApiUrl               string       `json:"ai_api_url"`
+	AiApiKey               string       `json:"ai_api_key"`
+	ServerAddr             string       `json:"server_addr"`
+	DeviceTransferExpires  int          `json:"device_transfer_expires"`  // 设备转移请求有效期（秒）
+	DeviceOfflineTimeout   int          `json:"device_offline_timeout"`   // 默认离线判定超时（秒）
+	DeviceSweepInterval    int          `json:"device_sweep_interval"`    // 设备状态扫描间隔（秒）
+	CommandTTL             int          `json:"command_ttl"`              // 设备指令默认有效期（秒）
+	FirmwareDir            string       `json:"firmware_dir"`             // 固件文件存储目录
+	BatchHistoryWindow     int          `json:"batch_history_window"`     // 批量上传可接受的历史数据时间范围（秒）
+	BatchUploadMax         int          `json:"batch_upload_max"`         // 批量上传单次最多条数
+	AggregationWorkers     int          `json:"aggregation_workers"`      // 后台聚合 worker 数量，为 0 时在上传请求中同步聚合
+	AggregationQueueSize   int          `json:"aggregation_queue_size"`   // 每个聚合 worker 的队列长度
+	AggregationRetries     int          `json:"aggregation_retries"`      // 聚合失败后的最大重试次数
+	AggregationMode        string       `json:"aggregation_mode"`         // 聚合方式：count 按条数（默认），window 按时间窗口
+	PendingFlushAge        int          `json:"pending_flush_age"`        // 未处理数据超过该时长（秒）后强制聚合
+	PendingFlushInterval   int          `json:"pending_flush_interval"`   // 补充聚合的执行间隔（秒）
+	RawMaxPoints           int          `json:"raw_max_points"`           // 原始读数查询单次最多返回条数
+	RetentionRawDays       int          `json:"retention_raw_days"`       // 原始读数保留天数，0 表示永久保留
+	RetentionFineDays      int          `json:"retention_fine_days"`      // 5 分钟、小时和按条数聚合的统计数据保留天数，0 表示永久保留
+	RetentionInterval      int          `json:"retention_interval"`       // 数据清理的执行间隔（秒）
+	QuarantineInAggregates bool         `json:"quarantine_in_aggregates"` // 超出场景阈值的异常读数在审核前是否计入统计
+	AQITable               string       `json:"aqi_table"`                // 空气质量指数分段表，默认 hj633
 }
 
 func LoadConfig() Config {
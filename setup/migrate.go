@@ -0,0 +1,123 @@
+package setup
+
+import (
+	"log"
+	"ssat_backend_rebuild/models"
+
+	"gorm.io/gorm"
+)
+
+// 数据迁移。BeforeSchema 为 true 时在表结构迁移之前执行，用于清理会导致新索引创建失败的数据
+type migration struct {
+	Name         string
+	BeforeSchema bool
+	Run          func(tx *gorm.DB) error
+}
+
+// 按顺序执行的数据迁移，已执行的迁移记录在 schema_migrations 表中，只会执行一次
+var migrations = []migration{
+	{
+		// 设备状态 0 原表示离线，现表示未知，离线改为 2。上报过数据的设备视为离线
+		Name: "device_status_offline",
+		Run: func(tx *gorm.DB) error {
+			return tx.Model(&models.Device{}).
+				Where("status = ? AND last_received IS NOT NULL", models.DeviceStatusUnknown).
+				Update("status", models.DeviceStatusOffline).Error
+		},
+	},
+	{
+		// 并发下发指令时可能产生重复的序号，创建 (device_uuid, seq) 唯一索引前按创建时间重新编号
+		Name:         "device_command_unique_seq",
+		BeforeSchema: true,
+		Run: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasTable(&models.DeviceCommand{}) {
+				return nil
+			}
+			var devices []string
+			if err := tx.Model(&models.DeviceCommand{}).Distinct("device_uuid").
+				Group("device_uuid, seq").Having("COUNT(*) > 1").Pluck("device_uuid", &devices).Error; err != nil {
+				return err
+			}
+			for _, device := range devices {
+				var commands []models.DeviceCommand
+				if err := tx.Where("device_uuid = ?", device).Order("seq, created_at").Find(&commands).Error; err != nil {
+					return err
+				}
+				for i := range commands {
+					if err := tx.Model(&commands[i]).Update("seq", i+1).Error; err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// 统计数据的 my_device_id 原为 char(16)，设备 UUID 被截断。加宽后按前缀恢复完整的 UUID
+		Name: "data_device_id_char36",
+		Run: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AlterColumn(&models.Data{}, "MyDeviceID"); err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE data JOIN devices ON devices.uuid LIKE CONCAT(data.my_device_id, '%') " +
+				"SET data.my_device_id = devices.uuid WHERE CHAR_LENGTH(data.my_device_id) = 16").Error
+		},
+	},
+	{
+		// 内置指标新增了变化率上限，已有数据库中的内置指标由 SeedMetrics 跳过，在此补写
+		Name: "builtin_metric_max_rate",
+		Run: func(tx *gorm.DB) error {
+			for _, metric := range models.BuiltinMetrics {
+				if metric.MaxRate == nil {
+					continue
+				}
+				if err := tx.Model(&models.Metric{}).
+					Where("`key` = ? AND builtin = ? AND max_rate IS NULL", metric.Key, true).
+					Update("max_rate", *metric.MaxRate).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// 已清理过小时统计数据的天统计数据标记为 fine_purged，补传的数据并入已有结果
+		Name: "data_day_fine_purged",
+		Run: func(tx *gorm.DB) error {
+			return tx.Exec("UPDATE data SET fine_purged = TRUE WHERE resolution = ? AND count > 0 AND NOT EXISTS ("+
+				"SELECT 1 FROM (SELECT my_device_id, window_start FROM data WHERE resolution = ?) AS hours "+
+				"WHERE hours.my_device_id = data.my_device_id AND hours.window_start >= data.window_start AND hours.window_start < data.window_end)",
+				models.ResolutionDay, models.ResolutionHour).Error
+		},
+	},
+}
+
+// 执行尚未执行过的数据迁移
+func runMigrations(db *gorm.DB, beforeSchema bool) error {
+	if err := db.AutoMigrate(&models.SchemaMigration{}); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.BeforeSchema != beforeSchema {
+			continue
+		}
+		var count int64
+		if err := db.Model(&models.SchemaMigration{}).Where("name = ?", m.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Run(tx); err != nil {
+				return err
+			}
+			return tx.Create(&models.SchemaMigration{Name: m.Name}).Error
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("已执行数据迁移: %s", m.Name)
+	}
+	return nil
+}
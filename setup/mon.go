@@ -6,6 +6,7 @@ import (
 	"log"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -26,5 +27,43 @@ func SetupMongo(config MongoConfig) *mongo.Collection {
 		return nil
 	}
 
-	return client.Database(config.DBName).Collection(config.Collection)
+	collection := client.Database(config.DBName).Collection(config.Collection)
+
+	// 同一设备同一时间戳只保留一条读数，批量补传依赖该索引去重，原始读数查询也按此排序
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "device_id", Value: 1}, {Key: "timestamp", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "processed", Value: 1}}},
+		{Keys: bson.D{{Key: "batch_id", Value: 1}}},
+	}
+	for _, index := range indexes {
+		if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+			log.Printf("MongoDB索引创建失败: %v", err)
+		}
+	}
+
+	return collection
+}
+
+// 异常读数的隔离区，与读数集合位于同一数据库
+func SetupQuarantine(collection *mongo.Collection) *mongo.Collection {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	quarantine := collection.Database().Collection(collection.Name() + "_quarantine")
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "device_id", Value: 1}, {Key: "timestamp", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "timestamp", Value: -1}}},
+	}
+	for _, index := range indexes {
+		if _, err := quarantine.Indexes().CreateOne(ctx, index); err != nil {
+			log.Printf("MongoDB索引创建失败: %v", err)
+		}
+	}
+	return quarantine
 }
@@ -0,0 +1,26 @@
+package setup
+
+import (
+	"log"
+	"ssat_backend_rebuild/handlers"
+)
+
+// 启动内嵌的 MQTT 服务，未启用时返回 nil
+func SetupMQTT(config MQTTConfig, dataHandler *handlers.DataHandler) *handlers.MQTTBroker {
+	if !config.Enabled {
+		return nil
+	}
+	addr := config.Addr
+	if addr == "" {
+		addr = ":1883"
+	}
+
+	broker := handlers.NewMQTTBroker(dataHandler)
+	go func() {
+		if err := broker.Start(addr); err != nil {
+			log.Fatalf("MQTT服务启动失败: %v", err)
+		}
+	}()
+	log.Printf("MQTT服务监听于%s", addr)
+	return broker
+}
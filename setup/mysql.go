@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"ssat_backend_rebuild/handlers"
 	"ssat_backend_rebuild/models"
 	"time"
 
@@ -82,11 +83,19 @@ func SetupSQL(config SQLConfig, admins []AdminEntry) *gorm.DB {
 	}
 
 	fmt.Println("数据库连接成功!")
-	err = db.AutoMigrate(&models.Device{}, &models.Admin{}, &models.User{}, &models.Data{}, &models.Log{}, &models.Announcement{}, &models.Ticket{}, &models.TicketChat{})
+	if err := runMigrations(db, true); err != nil {
+		log.Fatalf("数据迁移失败: %v", err)
+		return nil
+	}
+	err = db.AutoMigrate(&models.Device{}, &models.Admin{}, &models.User{}, &models.Data{}, &models.Log{}, &models.Announcement{}, &models.Ticket{}, &models.TicketChat{}, &models.DeviceTransfer{}, &models.Organization{}, &models.Site{}, &models.Room{}, &models.DeviceEvent{}, &models.DeviceTwin{}, &models.DeviceCommand{}, &models.Firmware{}, &models.FirmwareCampaign{}, &models.DeviceFirmwareUpdate{}, &models.Calibration{}, &models.AggregationProgress{}, &models.RetentionPolicy{}, &models.Metric{}, &models.Scene{}, &models.SceneThreshold{}, &models.DetectorBaseline{})
 	if err != nil {
 		log.Fatalf("数据库迁移失败: %v", err)
 		return nil
 	}
+	if err := runMigrations(db, false); err != nil {
+		log.Fatalf("数据迁移失败: %v", err)
+		return nil
+	}
 
 	for _, admin := range admins {
 		var exist models.Admin
@@ -103,5 +112,25 @@ func SetupSQL(config SQLConfig, admins []AdminEntry) *gorm.DB {
 		}
 	}
 
+	// 初始化指标注册表
+	if err := handlers.SeedMetrics(db); err != nil {
+		log.Fatalf("初始化指标失败: %v", err)
+		return nil
+	}
+	if err := handlers.LoadMetrics(db); err != nil {
+		log.Fatalf("加载指标失败: %v", err)
+		return nil
+	}
+
+	// 初始化场景阈值
+	if err := handlers.SeedScenes(db); err != nil {
+		log.Fatalf("初始化场景失败: %v", err)
+		return nil
+	}
+	if err := handlers.LoadScenes(db); err != nil {
+		log.Fatalf("加载场景失败: %v", err)
+		return nil
+	}
+
 	return db
 }
@@ -19,11 +19,43 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, dbMongo *mongo.Collection, con
 		BaseHandler: handlers.BaseHandler[models.User]{DB: db},
 	}
 	dataHandler := &handlers.DataHandler{
-		MongoCollection:     dbMongo,
-		MongoToSQLThreshold: config.MongoToSQLThreshold,
-		AiApiUrl:            config.AiApiUrl,
-		AiApiKey:            config.AiApiKey,
-		BaseHandler:         handlers.BaseHandler[models.Data]{DB: db},
+		MongoCollection:        dbMongo,
+		QuarantineCollection:   SetupQuarantine(dbMongo),
+		QuarantineInAggregates: config.QuarantineInAggregates,
+		MongoToSQLThreshold:    config.MongoToSQLThreshold,
+		HistoryWindow:          config.BatchHistoryWindow,
+		BatchUploadMax:         config.BatchUploadMax,
+		AggregationMode:        config.AggregationMode,
+		FlushAge:               config.PendingFlushAge,
+		RawMaxPoints:           config.RawMaxPoints,
+		AiApiUrl:               config.AiApiUrl,
+		AiApiKey:               config.AiApiKey,
+		BaseHandler:            handlers.BaseHandler[models.Data]{DB: db},
+	}
+	if dataHandler.FlushAge <= 0 {
+		dataHandler.FlushAge = 3600
+	}
+	if err := handlers.SetAQITable(config.AQITable); err != nil {
+		panic(err)
+	}
+	dataHandler.Aggregator = SetupAggregator(config, dataHandler)
+	SetupReconciler(config, dataHandler)
+	retentionHandler := &handlers.RetentionHandler{
+		MongoCollection:      dbMongo,
+		QuarantineCollection: dataHandler.QuarantineCollection,
+		RawDays:              config.RetentionRawDays,
+		FineDays:             config.RetentionFineDays,
+		BaseHandler:          handlers.BaseHandler[models.RetentionPolicy]{DB: db},
+	}
+	SetupRetention(config, retentionHandler)
+	metricHandler := &handlers.MetricHandler{
+		BaseHandler: handlers.BaseHandler[models.Metric]{DB: db},
+	}
+	sceneHandler := &handlers.SceneHandler{
+		BaseHandler: handlers.BaseHandler[models.Scene]{DB: db},
+	}
+	aggregationProgressHandler := &handlers.AggregationProgressHandler{
+		BaseHandler: handlers.BaseHandler[models.AggregationProgress]{DB: db},
 	}
 	logHandler := &handlers.LogHandler{
 		BaseHandler: handlers.BaseHandler[models.Log]{DB: db},
@@ -31,6 +63,44 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, dbMongo *mongo.Collection, con
 	announcementHandler := &handlers.AnnouncementHandler{
 		BaseHandler: handlers.BaseHandler[models.Announcement]{DB: db},
 	}
+	transferHandler := &handlers.TransferHandler{
+		Expires:     config.DeviceTransferExpires,
+		BaseHandler: handlers.BaseHandler[models.DeviceTransfer]{DB: db},
+	}
+	deviceEventHandler := &handlers.DeviceEventHandler{
+		BaseHandler: handlers.BaseHandler[models.DeviceEvent]{DB: db},
+	}
+	twinHandler := &handlers.TwinHandler{
+		BaseHandler: handlers.BaseHandler[models.DeviceTwin]{DB: db},
+	}
+	commandHandler := &handlers.CommandHandler{
+		TTL:         config.CommandTTL,
+		Broker:      SetupMQTT(config.MQTTConfig, dataHandler),
+		BaseHandler: handlers.BaseHandler[models.DeviceCommand]{DB: db},
+	}
+	firmwareDir := config.FirmwareDir
+	if firmwareDir == "" {
+		firmwareDir = "firmwares"
+	}
+	firmwareHandler := &handlers.FirmwareHandler{
+		Dir:         firmwareDir,
+		BaseHandler: handlers.BaseHandler[models.Firmware]{DB: db},
+	}
+	campaignHandler := &handlers.CampaignHandler{
+		BaseHandler: handlers.BaseHandler[models.FirmwareCampaign]{DB: db},
+	}
+	calibrationHandler := &handlers.CalibrationHandler{
+		BaseHandler: handlers.BaseHandler[models.Calibration]{DB: db},
+	}
+	organizationHandler := &handlers.OrganizationHandler{
+		BaseHandler: handlers.BaseHandler[models.Organization]{DB: db},
+	}
+	siteHandler := &handlers.SiteHandler{
+		BaseHandler: handlers.BaseHandler[models.Site]{DB: db},
+	}
+	roomHandler := &handlers.RoomHandler{
+		BaseHandler: handlers.BaseHandler[models.Room]{DB: db},
+	}
 	ticketHandler := &handlers.TicketHandler{
 		BaseHandler: handlers.BaseHandler[models.Ticket]{DB: db},
 	}
@@ -59,16 +129,54 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, dbMongo *mongo.Collection, con
 
 		devices := apiRouter.Group("/devices")
 		{
+			// 设备通过签名访问
+			devices.POST("/commands/poll", logMiddleware.WithLogging(0), commandHandler.Poll)
+			devices.POST("/commands/ack", logMiddleware.WithLogging(0), commandHandler.Ack)
+			devices.GET("/firmwares/:uuid/download", logMiddleware.WithLogging(0), firmwareHandler.Download)
+
 			// 只允许普通用户访问
 			devices.GET("/my_devices", authMiddleware.UserOnly(), deviceHandler.MyDevices)
 			devices.GET("/my_devices/:uuid", authMiddleware.UserOnly(), deviceHandler.RetrieveMyDevice)
+			devices.GET("/my_devices/:uuid/events", authMiddleware.UserOnly(), deviceEventHandler.MyList)
+			devices.GET("/my_devices/:uuid/twin", authMiddleware.UserOnly(), twinHandler.RetrieveMyTwin)
+			devices.PUT("/my_devices/:uuid/twin", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), twinHandler.UpdateMyTwin)
 			devices.POST("/:uuid/bind", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), deviceHandler.Bind)
 			devices.POST("/:uuid/unbind", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), deviceHandler.Unbind)
 			devices.POST("/:uuid/set_nickname", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), deviceHandler.SetNickname)
+			devices.POST("/:uuid/set_profile", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), deviceHandler.SetProfile)
+			devices.POST("/:uuid/transfer", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), transferHandler.Create)
+			devices.GET("/transfers/my_transfers", authMiddleware.UserOnly(), transferHandler.MyTransfers)
+			devices.POST("/transfers/:uuid/accept", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), transferHandler.Accept)
+			devices.POST("/transfers/:uuid/reject", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), transferHandler.Reject)
+			devices.POST("/transfers/:uuid/cancel", authMiddleware.UserOnly(), logMiddleware.WithLogging(1), transferHandler.Cancel)
 
 			// 只允许管理员访问
 			devices.GET("/", authMiddleware.AdminOnly(), deviceHandler.List)
+			devices.GET("/transfers", authMiddleware.AdminOnly(), transferHandler.List)
+			devices.GET("/twins/out_of_sync", authMiddleware.AdminOnly(), twinHandler.OutOfSync)
+			devices.GET("/firmwares", authMiddleware.AdminOnly(), firmwareHandler.List)
+			devices.GET("/firmwares/:uuid", authMiddleware.AdminOnly(), firmwareHandler.Retrieve)
+			devices.POST("/firmwares", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), firmwareHandler.Create)
+			devices.DELETE("/firmwares/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), firmwareHandler.Destroy)
+			devices.GET("/firmware_campaigns", authMiddleware.AdminOnly(), campaignHandler.List)
+			devices.GET("/firmware_campaigns/:uuid", authMiddleware.AdminOnly(), campaignHandler.Retrieve)
+			devices.GET("/firmware_campaigns/:uuid/updates", authMiddleware.AdminOnly(), campaignHandler.Updates)
+			devices.POST("/firmware_campaigns", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), campaignHandler.Create)
+			devices.PUT("/firmware_campaigns/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), campaignHandler.Update)
+			devices.POST("/firmware_campaigns/:uuid/halt", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), campaignHandler.Halt)
+			devices.POST("/firmware_campaigns/:uuid/resume", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), campaignHandler.Resume)
+			devices.PUT("/calibrations/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), calibrationHandler.Update)
+			devices.DELETE("/calibrations/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), calibrationHandler.Destroy)
 			devices.GET("/:uuid", authMiddleware.AdminOnly(), deviceHandler.Retrieve)
+			devices.GET("/:uuid/events", authMiddleware.AdminOnly(), deviceEventHandler.List)
+			devices.GET("/:uuid/twin", authMiddleware.AdminOnly(), twinHandler.Retrieve)
+			devices.PUT("/:uuid/twin", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), twinHandler.Update)
+			devices.GET("/:uuid/commands", authMiddleware.AdminOnly(), commandHandler.List)
+			devices.POST("/:uuid/commands", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), commandHandler.Create)
+			devices.GET("/:uuid/calibrations", authMiddleware.AdminOnly(), calibrationHandler.List)
+			devices.POST("/:uuid/calibrations", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), calibrationHandler.Create)
+			devices.POST("/:uuid/calibrations/reprocess", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), dataHandler.Recalibrate)
+			devices.POST("/:uuid/maintenance", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), deviceHandler.SetMaintenance)
 			devices.POST("/", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), deviceHandler.Create)
 			devices.PUT("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), deviceHandler.Update)
 			devices.DELETE("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), deviceHandler.Destroy)
@@ -88,13 +196,82 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, dbMongo *mongo.Collection, con
 		data := apiRouter.Group("/data")
 		{
 			data.POST("/upload", logMiddleware.WithLogging(0), dataHandler.Upload)
+			data.POST("/upload_batch", logMiddleware.WithLogging(0), dataHandler.UploadBatch)
 
 			data.GET("/my_data", authMiddleware.UserOnly(), dataHandler.MyData)
+			data.GET("/my_raw", authMiddleware.UserOnly(), dataHandler.MyRaw)
+			data.GET("/series", authMiddleware.UserOrAdmin(), dataHandler.Series)
+			data.GET("/compliance", authMiddleware.UserOrAdmin(), dataHandler.Compliance)
 
 			data.GET("/", authMiddleware.AdminOnly(), dataHandler.List)
+			data.GET("/group_stats", authMiddleware.AdminOnly(), dataHandler.GroupStats)
+			data.GET("/raw", authMiddleware.AdminOnly(), dataHandler.Raw)
+			data.GET("/aggregation_progress", authMiddleware.AdminOnly(), aggregationProgressHandler.List)
+			data.GET("/quarantine", authMiddleware.AdminOnly(), dataHandler.ListQuarantine)
+			data.POST("/quarantine/release", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), dataHandler.ReleaseQuarantine)
+			data.POST("/quarantine/discard", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), dataHandler.DiscardQuarantine)
+			data.POST("/flush", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), dataHandler.Flush)
+			data.POST("/backfill_stats", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), dataHandler.BackfillStatsNow)
 			data.POST("/analysis", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), dataHandler.Analysis)
 		}
 
+		organizations := apiRouter.Group("/organizations")
+		{
+			organizations.GET("/", authMiddleware.AdminOnly(), organizationHandler.List)
+			organizations.GET("/:uuid", authMiddleware.AdminOnly(), organizationHandler.Retrieve)
+			organizations.POST("/", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), organizationHandler.Create)
+			organizations.PUT("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), organizationHandler.Update)
+			organizations.DELETE("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), organizationHandler.Destroy)
+		}
+
+		retention := apiRouter.Group("/retention_policies")
+		{
+			retention.GET("/", authMiddleware.AdminOnly(), retentionHandler.List)
+			retention.GET("/report", authMiddleware.AdminOnly(), retentionHandler.Report)
+			retention.POST("/", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), retentionHandler.Create)
+			retention.POST("/purge", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), retentionHandler.PurgeNow)
+			retention.PUT("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), retentionHandler.Update)
+			retention.DELETE("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), retentionHandler.Destroy)
+		}
+
+		metrics := apiRouter.Group("/metrics")
+		{
+			metrics.GET("/", authMiddleware.UserOrAdmin(), metricHandler.List)
+			metrics.POST("/", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), metricHandler.Create)
+			metrics.PUT("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), metricHandler.Update)
+			metrics.DELETE("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), metricHandler.Destroy)
+		}
+
+		scenes := apiRouter.Group("/scenes")
+		{
+			scenes.GET("/", authMiddleware.UserOrAdmin(), sceneHandler.List)
+			scenes.GET("/:uuid", authMiddleware.UserOrAdmin(), sceneHandler.Retrieve)
+			scenes.GET("/:uuid/versions", authMiddleware.UserOrAdmin(), sceneHandler.Versions)
+			scenes.POST("/", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), sceneHandler.Create)
+			scenes.POST("/reload", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), sceneHandler.Reload)
+			scenes.PUT("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), sceneHandler.Update)
+			scenes.PUT("/:uuid/thresholds", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), sceneHandler.UpdateThresholds)
+			scenes.DELETE("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), sceneHandler.Destroy)
+		}
+
+		sites := apiRouter.Group("/sites")
+		{
+			sites.GET("/", authMiddleware.AdminOnly(), siteHandler.List)
+			sites.GET("/:uuid", authMiddleware.AdminOnly(), siteHandler.Retrieve)
+			sites.POST("/", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), siteHandler.Create)
+			sites.PUT("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), siteHandler.Update)
+			sites.DELETE("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), siteHandler.Destroy)
+		}
+
+		rooms := apiRouter.Group("/rooms")
+		{
+			rooms.GET("/", authMiddleware.AdminOnly(), roomHandler.List)
+			rooms.GET("/:uuid", authMiddleware.AdminOnly(), roomHandler.Retrieve)
+			rooms.POST("/", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), roomHandler.Create)
+			rooms.PUT("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), roomHandler.Update)
+			rooms.DELETE("/:uuid", authMiddleware.AdminOnly(), logMiddleware.WithLogging(2), roomHandler.Destroy)
+		}
+
 		logs := apiRouter.Group("/logs")
 		{
 			logs.GET("/", authMiddleware.AdminOnly(), logHandler.List)
@@ -0,0 +1,63 @@
+package setup
+
+import (
+	"ssat_backend_rebuild/handlers"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 启动后台任务
+func SetupWorkers(db *gorm.DB, config Config) {
+	offlineTimeout := config.DeviceOfflineTimeout
+	if offlineTimeout <= 0 {
+		offlineTimeout = 60
+	}
+	sweepInterval := config.DeviceSweepInterval
+	if sweepInterval <= 0 {
+		sweepInterval = 15
+	}
+	sweeper := &handlers.DeviceStatusSweeper{
+		DB:             db,
+		Interval:       time.Duration(sweepInterval) * time.Second,
+		DefaultTimeout: time.Duration(offlineTimeout) * time.Second,
+	}
+	go sweeper.Run()
+}
+
+// 启动后台聚合任务，未配置 worker 数量时返回 nil
+func SetupAggregator(config Config, dataHandler *handlers.DataHandler) *handlers.Aggregator {
+	if config.AggregationWorkers <= 0 {
+		return nil
+	}
+	aggregator := handlers.NewAggregator(dataHandler, config.AggregationWorkers, config.AggregationQueueSize, config.AggregationRetries)
+	aggregator.Start()
+	return aggregator
+}
+
+// 启动补充聚合任务
+func SetupReconciler(config Config, dataHandler *handlers.DataHandler) {
+	interval := config.PendingFlushInterval
+	if interval <= 0 {
+		interval = 300
+	}
+	reconciler := &handlers.DataReconciler{
+		Data:     dataHandler,
+		Interval: time.Duration(interval) * time.Second,
+		MaxAge:   time.Duration(dataHandler.FlushAge) * time.Second,
+	}
+	go reconciler.Run()
+}
+
+// 启动数据清理任务，未配置任何保留天数时仍会按组织和设备的策略清理
+func SetupRetention(config Config, retentionHandler *handlers.RetentionHandler) {
+	interval := config.RetentionInterval
+	if interval <= 0 {
+		interval = 24 * 3600
+	}
+	purger := &handlers.RetentionPurger{
+		Retention: retentionHandler,
+		Interval:  time.Duration(interval) * time.Second,
+	}
+	go purger.Run()
+}
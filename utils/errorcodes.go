@@ -116,6 +116,16 @@ var (
 		HttpCode: 400,
 		Message:  "工单已关闭",
 	}
+	ErrTransferFinished = ErrorCode{
+		Code:     20,
+		HttpCode: 400,
+		Message:  "转移请求已处理",
+	}
+	ErrTransferExpired = ErrorCode{
+		Code:     21,
+		HttpCode: 400,
+		Message:  "转移请求已过期",
+	}
 	ErrForbidden = ErrorCode{
 		Code:     1001,
 		HttpCode: 403,